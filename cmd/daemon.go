@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/daemon"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// daemonTimeout bounds how long insert waits for the daemon before giving up.
+const daemonTimeout = 2 * time.Second
+
+func init() {
+	rootCmd.AddCommand(daemonCmd)
+}
+
+// socketPath is where the daemon listens, it is found without reading the config.
+func socketPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".xenophon", daemon.SocketName), nil
+}
+
+// insertThroughDaemon handles `xenophon insert` with a thin client when the daemon's
+// socket exists, before the config and engine are loaded. It reports false if the
+// command should run normally instead, e.g. because no daemon is running.
+func insertThroughDaemon(args []string) bool {
+	if len(args) == 0 || args[0] != insertCmd.Name() {
+		return false
+	}
+	path, err := socketPath()
+	if err != nil {
+		return false
+	}
+	if _, err = os.Stat(path); err != nil {
+		return false
+	}
+	if err = insertCmd.ParseFlags(args[1:]); err != nil || len(insertCmd.Flags().Args()) != 1 {
+		return false
+	}
+
+	initLoggers()
+	var entryOpts []storage.EntryOpt
+	if insertCmd.Flags().Changed("exit-code") {
+		entryOpts = append(entryOpts, storage.WithExitCode(insertExitCode))
+	}
+	entry, err := storage.NewStorageModule(nil).NewEntry(insertCmd.Flags().Arg(0), entryOpts...)
+	if err != nil {
+		ErrorLogger.Printf("can't insert %v\n", err)
+		os.Exit(1)
+	}
+	response, err := daemon.Insert(path, entry, daemonTimeout)
+	if errors.Is(err, daemon.ErrUnavailable) {
+		return false
+	}
+	if err != nil {
+		ErrorLogger.Printf("can't insert %v\n", err)
+		os.Exit(1)
+	}
+	if response.Warning != "" {
+		WarningLogger.Printf("%s\n", response.Warning)
+	}
+	return true
+}
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "keep the history open for fast inserts",
+	Long: `Keep the history open and listen on a Unix socket in the config directory. While it
+runs, insert hands commands to it instead of loading the config and opening the engine
+itself, and falls back to that when the daemon is stopped.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		path, err := socketPath()
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		l, err := daemon.Listen(path)
+		if err != nil {
+			ErrorLogger.Printf("could not listen on %s: %v", path, err)
+			return err
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+
+		InfoLogger.Printf("listening on %s", path)
+		if err = daemon.New(database).Serve(l); err != nil {
+			ErrorLogger.Printf("could not serve: %v", err)
+			return err
+		}
+		return nil
+	},
+}
@@ -0,0 +1,236 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/encrypted"
+	"github.com/svanellewee/xenophon/storage/replica"
+	"golang.org/x/term"
+)
+
+var (
+	mergeOutput string
+	mergeEngine string
+)
+
+func init() {
+	mergeCmd.Flags().StringVarP(&mergeOutput, "output", "o", "", "the history file to create")
+	mergeCmd.Flags().StringVar(&mergeEngine, "engine", "", "engine of files whose extension doesn't name one")
+	mergeCmd.MarkFlagRequired("output")
+	dbCmd.AddCommand(rekeyCmd)
+	dbCmd.AddCommand(mergeCmd)
+	rootCmd.AddCommand(dbCmd)
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "maintain the history database",
+}
+
+// newPassphrase reads the passphrase to rekey to, asking twice when prompting.
+func newPassphrase() (string, error) {
+	passphrase, err := readPassphrase(newPassphraseEnv, "new passphrase: ")
+	if err != nil || os.Getenv(newPassphraseEnv) != "" || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return passphrase, err
+	}
+	again, err := readPassphrase(newPassphraseEnv, "repeat new passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey",
+	Short: "re-encrypt the history with a new key",
+	Long: `Re-encrypt every entry with a new key, and encrypt entries stored before encryption
+was enabled. With a keyfile a new key is generated and replaces the old one. With a
+passphrase the new one is read from $` + newPassphraseEnv + `, or prompted for.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		config := encryptionConfig()
+		if !config.Bool("enabled", false) {
+			err := fmt.Errorf("encryption is not enabled, set %s.enabled in %s", encryptionKey, configFile)
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		old, err := keyring(config)
+		if err != nil {
+			ErrorLogger.Printf("could not load the current key: %v", err)
+			return err
+		}
+
+		var n int
+		if config.Bool("passphrase", false) {
+			passphrase, err := newPassphrase()
+			if err != nil {
+				ErrorLogger.Printf("%v", err)
+				return err
+			}
+			// Save the new salt before rekeying and only promote it after, so an interrupted
+			// rekey can be resumed with the same new passphrase.
+			current, err := saltPath(config)
+			if err != nil {
+				return err
+			}
+			pending := newSaltPath(current)
+			if _, err := os.Stat(pending); errors.Is(err, os.ErrNotExist) {
+				salt, err := encrypted.NewSalt()
+				if err != nil {
+					return err
+				}
+				if err = encrypted.WriteSalt(pending, salt); err != nil {
+					ErrorLogger.Printf("could not store the new salt: %v", err)
+					return err
+				}
+			}
+			salt, err := encrypted.LoadSalt(pending)
+			if err != nil {
+				ErrorLogger.Printf("could not read the new salt: %v", err)
+				return err
+			}
+			key, err := encrypted.KeyFromPassphrase(passphrase, salt)
+			if err != nil {
+				ErrorLogger.Printf("%v", err)
+				return err
+			}
+			// Resuming a rekey takes the new passphrase it was started with.
+			if err = encrypted.CheckPassphrase(pending, key); err != nil {
+				ErrorLogger.Printf("%v", err)
+				return err
+			}
+			from := encrypted.NewKeyring(append(old.Keys(), key)...)
+			if n, err = encrypted.Rekey(engine, from, encrypted.NewKeyring(key)); err != nil {
+				ErrorLogger.Printf("could not rekey: %v", err)
+				return err
+			}
+			if err = os.Rename(pending, current); err != nil {
+				ErrorLogger.Printf("could not store the new salt: %v", err)
+				return err
+			}
+		} else {
+			key, err := encrypted.NewKey()
+			if err != nil {
+				return err
+			}
+			// Keep the old keys until every entry is rekeyed, so an interrupted rekey loses nothing.
+			path, err := keyfilePath(config)
+			if err != nil {
+				return err
+			}
+			if err = encrypted.WriteKeyfile(path, encrypted.NewKeyring(append([]*encrypted.Key{key}, old.Keys()...)...)); err != nil {
+				ErrorLogger.Printf("could not store the new key: %v", err)
+				return err
+			}
+			if n, err = encrypted.Rekey(engine, old, encrypted.NewKeyring(key)); err != nil {
+				ErrorLogger.Printf("could not rekey: %v", err)
+				return err
+			}
+			if err = encrypted.WriteKeyfile(path, encrypted.NewKeyring(key)); err != nil {
+				ErrorLogger.Printf("could not remove the old keys: %v", err)
+				return err
+			}
+		}
+		fmt.Printf("rekeyed %d entries\n", n)
+
+		// A prediction model built before encryption was enabled holds commands in the clear.
+		if err := os.Remove(viper.GetString(predictModelKey)); err == nil {
+			InfoLogger.Printf("removed the unencrypted prediction model")
+		} else if !errors.Is(err, os.ErrNotExist) {
+			WarningLogger.Printf("could not remove the prediction model: %v", err)
+		}
+		return nil
+	},
+}
+
+// openMergeFile opens a history file for db merge, encrypted like the history. Inputs
+// must exist, opening a missing file would create an empty history.
+func openMergeFile(path string, create bool) (storage.StorageStreamer, error) {
+	if _, err := os.Stat(path); create && err == nil {
+		return nil, fmt.Errorf("%s already exists", path)
+	} else if !create && err != nil {
+		return nil, err
+	}
+	s, err := openFile(path, mergeEngine)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := withEncryption(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return wrapped, nil
+}
+
+func describe(e *storage.Entry) string {
+	exit := "-"
+	if e.ExitCode != nil {
+		exit = fmt.Sprint(*e.ExitCode)
+	}
+	return fmt.Sprintf("%d\t%s\t%s\t%s", e.Id, exit, e.Location, e.Command)
+}
+
+var mergeCmd = &cobra.Command{
+	Use:   "merge <primary> <other>... -o <merged>",
+	Short: "combine history files into a new one",
+	Long: `Combine history files, e.g. those of old installs, into a new file. Every entry of the
+primary is kept with its id, entries of the others are added unless the primary or an
+earlier file has one with the same host, session, time and command. Duplicates that
+differ otherwise are reported as conflicts. The files can use different engines.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		histories := make([]storage.StorageStreamer, 0, len(args))
+		defer func() {
+			for _, h := range histories {
+				h.Close()
+			}
+		}()
+		for _, path := range args {
+			h, err := openMergeFile(path, false)
+			if err != nil {
+				ErrorLogger.Printf("could not open %s: %v", path, err)
+				return err
+			}
+			histories = append(histories, h)
+		}
+		out, err := openMergeFile(mergeOutput, true)
+		if err != nil {
+			ErrorLogger.Printf("could not create %s: %v", mergeOutput, err)
+			return err
+		}
+		defer out.Close()
+
+		report, err := replica.Merge(out, histories[0], histories[1:]...)
+		if err != nil {
+			ErrorLogger.Printf("could not merge: %v", err)
+			return err
+		}
+		for _, c := range report.Conflicts {
+			fmt.Printf("conflict in %s: %s\n", args[c.Source+1], strings.Join(c.Fields, ", "))
+			fmt.Printf("  kept    %s\n", describe(c.Kept))
+			fmt.Printf("  skipped %s\n", describe(c.Skipped))
+		}
+		if report.Renumbered {
+			fmt.Printf("%s can't keep ids, the entries of %s were renumbered\n", mergeOutput, args[0])
+		}
+		fmt.Printf("%d entries from %s\n", report.Primary, args[0])
+		for i, n := range report.Added {
+			fmt.Printf("%d entries from %s\n", n, args[i+1])
+		}
+		fmt.Printf("%d duplicates skipped, %d conflicts\n", report.Duplicates, len(report.Conflicts))
+		return nil
+	},
+}
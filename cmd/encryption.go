@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/viper"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/encrypted"
+	"golang.org/x/term"
+)
+
+const (
+	passphraseEnv    = "XENOPHON_PASSPHRASE"
+	newPassphraseEnv = "XENOPHON_NEW_PASSPHRASE"
+)
+
+// encryptionConfig reads the `encryption` section of the config, e.g.
+//
+//	encryption:
+//	  enabled: true
+//	  keyfile: ~/.xenophon/history.key
+//
+// or, to derive the key from $XENOPHON_PASSPHRASE (prompted for when unset),
+//
+//	encryption:
+//	  enabled: true
+//	  passphrase: true
+//	  salt: ~/.xenophon/history.salt
+func encryptionConfig() storage.EngineConfig {
+	return storage.EngineConfig{
+		Dir:    filepath.Dir(configFile),
+		Values: viper.GetStringMap(encryptionKey),
+	}
+}
+
+func keyfilePath(config storage.EngineConfig) (string, error) {
+	return config.Path("keyfile", filepath.Join(config.Dir, "history.key"))
+}
+
+func saltPath(config storage.EngineConfig) (string, error) {
+	return config.Path("salt", filepath.Join(config.Dir, "history.salt"))
+}
+
+// newSaltPath keeps the salt of the new passphrase while rekeying, it replaces the salt
+// once every entry is rekeyed.
+func newSaltPath(salt string) string {
+	return salt + ".new"
+}
+
+// readPassphrase reads a passphrase from env, or prompts for it on a terminal.
+func readPassphrase(env, prompt string) (string, error) {
+	if passphrase := os.Getenv(env); passphrase != "" {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("no passphrase, set $%s", env)
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(passphrase), err
+}
+
+// keyring loads the key the history is encrypted with. A keyfile is created on first use.
+func keyring(config storage.EngineConfig) (*encrypted.Keyring, error) {
+	if config.Bool("passphrase", false) {
+		path, err := saltPath(config)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(newSaltPath(path)); err == nil {
+			WarningLogger.Printf("a rekey was interrupted, run `xenophon db rekey` again with the same new passphrase")
+		}
+		salt, err := encrypted.LoadSalt(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read salt: %w", err)
+		}
+		passphrase, err := readPassphrase(passphraseEnv, "passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		key, err := encrypted.KeyFromPassphrase(passphrase, salt)
+		if err != nil {
+			return nil, err
+		}
+		if err = encrypted.CheckPassphrase(path, key); err != nil {
+			return nil, err
+		}
+		return encrypted.NewKeyring(key), nil
+	}
+
+	path, err := keyfilePath(config)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := encrypted.LoadKeyfile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key, err := encrypted.NewKey()
+		if err != nil {
+			return nil, err
+		}
+		ring = encrypted.NewKeyring(key)
+		if err = encrypted.WriteKeyfile(path, ring); err != nil {
+			return nil, fmt.Errorf("could not create keyfile: %w", err)
+		}
+		InfoLogger.Printf("created keyfile at %s", path)
+		return ring, nil
+	}
+	return ring, err
+}
@@ -0,0 +1,40 @@
+package cmd
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var exportPeriod period
+
+func init() {
+	exportPeriod.addFlags(exportCmd)
+	rootCmd.AddCommand(exportCmd)
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "write the history as JSON lines",
+	Long:  `Write every entry of the history, or of a period, to stdout as one JSON object per line`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		results, err := exportPeriod.entries(time.Now())
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		for _, e := range results.Output() {
+			if err = encoder.Encode(e); err != nil {
+				ErrorLogger.Printf("could not write entry %d: %v", e.Id, err)
+				return err
+			}
+		}
+		return nil
+	},
+}
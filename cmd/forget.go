@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var (
+	forgetIds  []int64
+	forgetYes  bool
+	forgetHard bool
+	forgetUndo bool
+)
+
+func init() {
+	forgetCmd.Flags().Int64SliceVar(&forgetIds, "id", nil, "forget entries by id instead of a pattern")
+	forgetCmd.Flags().BoolVarP(&forgetYes, "yes", "y", false, "do not ask for confirmation")
+	forgetCmd.Flags().BoolVar(&forgetHard, "hard", false, "delete immediately, without the undo window")
+	forgetCmd.Flags().BoolVar(&forgetUndo, "undo", false, "restore the entries removed by the last forget")
+	rootCmd.AddCommand(forgetCmd)
+}
+
+// confirm asks a yes/no question on stdout and reads the answer from stdin.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func printEntries(entries []*storage.Entry) {
+	for _, e := range entries {
+		fmt.Printf("%d\t%s\t%s\n", e.Id, e.Location, e.Command)
+	}
+}
+
+var forgetCmd = &cobra.Command{
+	Use:   "forget [pattern]",
+	Short: "remove entries from history",
+	Long: `Remove the entries whose command matches a regular expression, or the given ids.
+Matches are shown for confirmation first. Forgotten entries can be restored with --undo
+until the undo window passes, use --hard for secrets that must be deleted right away.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		now := time.Now()
+		if _, err := database.PurgeTombstones(now); err != nil {
+			WarningLogger.Printf("could not purge forgotten entries: %v", err)
+		}
+
+		if forgetUndo {
+			restored, err := database.Undo(now)
+			if err != nil {
+				ErrorLogger.Printf("could not undo: %v", err)
+				return err
+			}
+			printEntries(restored)
+			fmt.Printf("restored %d entries\n", len(restored))
+			return nil
+		}
+
+		if len(args) == 0 && len(forgetIds) == 0 {
+			return fmt.Errorf("need a pattern or --id")
+		}
+		var filters []storage.FilterType
+		if len(args) > 0 {
+			re, err := regexp.Compile(args[0])
+			if err != nil {
+				ErrorLogger.Printf("invalid pattern: %v", err)
+				return err
+			}
+			filters = append(filters, storage.CommandMatches(re))
+		}
+		if len(forgetIds) > 0 {
+			ids := make(map[int64]bool, len(forgetIds))
+			for _, id := range forgetIds {
+				ids[id] = true
+			}
+			filters = append(filters, func(i int, e *storage.Entry) bool { return ids[e.Id] })
+		}
+
+		results := database.LastEntries(math.MaxInt32)
+		for _, filter := range filters {
+			results = results.Filter(filter)
+		}
+		matches := results.Output()
+		if len(matches) == 0 {
+			fmt.Println("nothing to forget")
+			return nil
+		}
+
+		printEntries(matches)
+		if !forgetYes && !confirm(fmt.Sprintf("Forget %d entries?", len(matches))) {
+			return nil
+		}
+
+		ids := storage.Ids(matches)
+		var err error
+		if forgetHard {
+			err = database.Delete(ids)
+		} else {
+			err = database.Forget(ids)
+		}
+		if err != nil {
+			ErrorLogger.Printf("could not forget entries: %v", err)
+			return err
+		}
+		fmt.Printf("forgot %d entries\n", len(ids))
+		return nil
+	},
+}
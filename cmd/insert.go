@@ -1,8 +1,16 @@
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"errors"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var insertExitCode int
 
 func init() {
+	insertCmd.Flags().IntVarP(&insertExitCode, "exit-code", "e", 0, "exit status of the command")
 	rootCmd.AddCommand(insertCmd)
 }
 
@@ -12,8 +20,15 @@ var insertCmd = &cobra.Command{
 	Long:  `Insert into history store`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 
-		_, err := database.Insert(args[0])
-		if err != nil {
+		var entryOpts []storage.EntryOpt
+		if cmd.Flags().Changed("exit-code") {
+			entryOpts = append(entryOpts, storage.WithExitCode(insertExitCode))
+		}
+
+		_, err := database.Insert(args[0], entryOpts...)
+		if errors.Is(err, storage.ErrInsertHook) {
+			WarningLogger.Printf("%v\n", err)
+		} else if err != nil {
 			ErrorLogger.Printf("can't insert %v\n", err)
 			return err
 		}
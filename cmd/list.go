@@ -3,26 +3,143 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/render"
+	"github.com/svanellewee/xenophon/storage"
+	"golang.org/x/term"
+)
+
+var (
+	listPeriod period
+	listOutput output
 )
 
 func init() {
+	listPeriod.addFlags(listCmd)
+	listOutput.addFlags(listCmd)
 	rootCmd.AddCommand(listCmd)
 }
 
+// output holds the flags that choose how entries are shown.
+type output struct {
+	unique   string
+	reverse  bool
+	after    int64
+	offset   int
+	limit    int
+	format   string
+	template string
+}
+
+func (o *output) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&o.unique, "unique", "", "show the last run of every command with the number of runs, with =consecutive only collapse repeated runs")
+	cmd.Flags().Lookup("unique").NoOptDefVal = "all"
+	cmd.Flags().BoolVarP(&o.reverse, "reverse", "r", false, "show the newest entries first")
+	cmd.Flags().Int64Var(&o.after, "after", 0, "only show entries after the one with this id, e.g. the last one of the previous page")
+	cmd.Flags().IntVar(&o.offset, "offset", 0, "skip this many entries")
+	cmd.Flags().IntVarP(&o.limit, "limit", "n", 0, "show at most this many entries, 0 for all")
+	cmd.Flags().StringVar(&o.format, "format", "table", "output format, table or json")
+	cmd.Flags().StringVar(&o.template, "template", "", "Go text/template for every entry, e.g. '{{.Id}} {{.Command}}', with the functions ago, short and exit")
+}
+
+// dedup deduplicates results as --unique says.
+func (o *output) dedup(results storage.ResultStreamer) (storage.ResultStreamer, error) {
+	switch o.unique {
+	case "":
+		return results, nil
+	case "all":
+		return results.Dedup(storage.DedupUnique), nil
+	case "consecutive":
+		return results.Dedup(storage.DedupConsecutive), nil
+	default:
+		return nil, fmt.Errorf("unknown --unique=%s, use all or consecutive", o.unique)
+	}
+}
+
+// renderOptions colours output only for terminals, and not at all if NO_COLOR is set.
+func renderOptions() render.Options {
+	home, _ := os.UserHomeDir()
+	_, noColor := os.LookupEnv("NO_COLOR")
+	return render.Options{
+		Color: !noColor && term.IsTerminal(int(os.Stdout.Fd())),
+		Now:   time.Now(),
+		Home:  home,
+	}
+}
+
+// page orders results and picks the page that --after, --offset and --limit ask for.
+func (o *output) page(results storage.ResultStreamer) storage.ResultStreamer {
+	if o.reverse {
+		results = results.Desc()
+	}
+	if o.after > 0 {
+		results = results.After(o.after)
+	}
+	if o.offset > 0 {
+		results = results.Offset(o.offset)
+	}
+	if o.limit > 0 {
+		results = results.Limit(o.limit)
+	}
+	return results
+}
+
+// write deduplicates and pages results and prints them with --template or in --format.
+func (o *output) write(results storage.ResultStreamer) error {
+	results, err := o.dedup(results)
+	if err != nil {
+		return err
+	}
+	results = o.page(results)
+	entries := results.Output()
+	opts := renderOptions()
+	if o.template != "" {
+		tmpl, err := render.NewTemplate(o.template, opts)
+		if err != nil {
+			return fmt.Errorf("invalid --template: %w", err)
+		}
+		return render.Template(os.Stdout, entries, tmpl)
+	}
+	switch o.format {
+	case "table":
+		return render.Table(os.Stdout, entries, opts)
+	case "json":
+		return render.JSON(os.Stdout, entries)
+	default:
+		return fmt.Errorf("unknown --format %q, use table or json", o.format)
+	}
+}
+
 var listCmd = &cobra.Command{
 	Use:   "list",
 	Short: "list entire command history in current directory",
-	Long:  `List entire command history in current directory`,
+	Long: `List entire command history in current directory, or the part of it run in a period.
+Entries are shown as a table, as JSON or through a Go text/template, which is executed
+with every storage.Entry, e.g. --template '{{.Id}} {{ago .Time}} {{exit .ExitCode}} {{short .Location}} {{.Command}}'.
+Exit codes are coloured on terminals unless NO_COLOR is set. With --unique every command
+is shown once, with its number of runs in .Count. Long histories can be paged with --limit,
+going on from the last id shown with --after, e.g. list --reverse --limit 20 --after 1234.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		location, err := os.Getwd()
 		if err != nil {
 			ErrorLogger.Printf("could not determine location: %v", err)
 			return err
 		}
-		for _, e := range database.Location(location).Output() {
-			fmt.Println(e)
+		results := database.Location(location)
+		if listPeriod.set() {
+			if results, err = listPeriod.entries(time.Now()); err != nil {
+				ErrorLogger.Printf("%v", err)
+				return err
+			}
+			results = results.Filter(func(i int, e *storage.Entry) bool {
+				return string(e.Location) == location
+			})
+		}
+		if err = listOutput.write(results); err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
 		}
 		return nil
 	},
@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var noteRemove bool
+
+func init() {
+	noteCmd.Flags().BoolVarP(&noteRemove, "remove", "d", false, "remove the note of the entry")
+	rootCmd.AddCommand(noteCmd)
+}
+
+var noteCmd = &cobra.Command{
+	Use:   "note <id> <text>...",
+	Short: "leave a note on an entry",
+	Long: `Leave a note on the entry with the given id, e.g. note 1234 "this fixed the DNS issue".
+A new note replaces the old one, --remove removes it. Notes are shown by list, starred and
+export, and search finds entries by their notes too.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if noteRemove {
+			return cobra.ExactArgs(1)(cmd, args)
+		}
+		return cobra.MinimumNArgs(2)(cmd, args)
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+		id, err := parseId(args[0])
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		note := strings.TrimSpace(strings.Join(args[1:], " "))
+		err = database.Note(id, note)
+		if err == storage.ErrNotFound {
+			err = fmt.Errorf("there is no entry %d", id)
+		}
+		if err != nil {
+			ErrorLogger.Printf("could not note %d: %v", id, err)
+			return err
+		}
+		return nil
+	},
+}
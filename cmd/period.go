@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// forever is the end of a period without --until.
+var forever = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// period holds the --since and --until flags of a command.
+type period struct {
+	since, until string
+}
+
+func (p *period) addFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&p.since, "since", "", `only entries since a date (2006-01-02), a duration ago (2h, 3d) or a phrase ("yesterday", "last monday", "this week")`)
+	cmd.Flags().StringVar(&p.until, "until", "", "only entries until a time like --since, the whole of a date or phrase")
+}
+
+func (p *period) set() bool {
+	return p.since != "" || p.until != ""
+}
+
+// bounds resolves the flags in the local time zone, an end that wasn't given is the zero time.
+func (p *period) bounds(now time.Time) (since, until time.Time, err error) {
+	if p.since != "" {
+		if since, err = storage.ParseSince(p.since, now); err != nil {
+			return since, until, fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+	if p.until != "" {
+		if until, err = storage.ParseUntil(p.until, now); err != nil {
+			return since, until, fmt.Errorf("invalid --until: %w", err)
+		}
+	}
+	if !since.IsZero() && !until.IsZero() && until.Before(since) {
+		return since, until, fmt.Errorf("--until %s is before --since %s", p.until, p.since)
+	}
+	return since, until, nil
+}
+
+// entries are those of the period, the whole history if neither flag was given.
+func (p *period) entries(now time.Time) (storage.ResultStreamer, error) {
+	if !p.set() {
+		return database.LastEntries(math.MaxInt32), nil
+	}
+	since, until, err := p.bounds(now)
+	if err != nil {
+		return nil, err
+	}
+	if until.IsZero() {
+		until = forever
+	}
+	return database.Period(since, until), nil
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/svanellewee/xenophon/storage/predict"
+)
+
+var (
+	predictAfter   []string
+	predictLimit   int
+	predictRebuild bool
+)
+
+func init() {
+	predictCmd.Flags().StringArrayVarP(&predictAfter, "after", "a", nil, "previous command, repeat for a longer context (oldest first)")
+	predictCmd.Flags().IntVarP(&predictLimit, "limit", "n", 5, "maximum number of candidates")
+	predictCmd.Flags().BoolVar(&predictRebuild, "rebuild", false, "rebuild the model from the entire history")
+	rootCmd.AddCommand(predictCmd)
+}
+
+// loadModel reads the saved prediction model with the observations logged since, training
+// and saving it first if needed.
+func loadModel(rebuild bool) (*predict.Model, error) {
+	modelFile := viper.GetString(predictModelKey)
+	if !rebuild {
+		m, err := predict.Compact(modelFile)
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return m, err
+		}
+	}
+
+	m, err := predict.Rebuild(modelFile, database.LastEntries(math.MaxInt32).Output(), predict.DefaultOrder)
+	if err != nil {
+		return nil, fmt.Errorf("could not save model: %w", err)
+	}
+	InfoLogger.Printf("built prediction model at %s", modelFile)
+	return m, nil
+}
+
+var predictCmd = &cobra.Command{
+	Use:   "predict",
+	Short: "predict the next command",
+	Long: `Predict the next command from the commands that usually followed the previous ones
+in the current directory. Without --after the current session's last commands are used.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if encryptionConfig().Bool("enabled", false) {
+			err := errors.New("prediction is not available for encrypted histories, the model would hold commands in the clear")
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		m, err := loadModel(predictRebuild)
+		if err != nil {
+			ErrorLogger.Printf("could not load prediction model: %v", err)
+			return err
+		}
+
+		location, err := database.Locator.Get()
+		if err != nil {
+			ErrorLogger.Printf("could not determine location: %v", err)
+			return err
+		}
+
+		after := predictAfter
+		if len(after) == 0 {
+			session, err := database.Session.Get()
+			if err != nil {
+				ErrorLogger.Printf("could not determine session: %v", err)
+				return err
+			}
+			after = m.Recent(session)
+		}
+
+		for i, c := range m.Predict(location, after) {
+			if i >= predictLimit {
+				break
+			}
+			fmt.Printf("%.2f\t%s\n", c.Confidence, c.Command)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var (
+	pruneDryRun  bool
+	pruneVerbose bool
+)
+
+func init() {
+	pruneCmd.Flags().BoolVarP(&pruneDryRun, "dry-run", "n", false, "only report what would be removed")
+	pruneCmd.Flags().BoolVarP(&pruneVerbose, "verbose", "v", false, "list every removed entry")
+	rootCmd.AddCommand(pruneCmd)
+}
+
+// retentionPolicy reads the `retention` section of the config, e.g.
+//
+//	retention:
+//	  maxage: 8760h
+//	  maxcount: 100000
+//	  failedmaxage: 720h
+//	  keepunique: true
+//	  every: 100
+//	  overrides:
+//	    - location: /tmp
+//	      maxage: 24h
+//	    - pattern: ^(ls|pwd)$
+//	      maxage: 168h
+func retentionPolicy() (storage.RetentionPolicy, error) {
+	var policy storage.RetentionPolicy
+	if err := viper.UnmarshalKey(retentionKey, &policy); err != nil {
+		return policy, fmt.Errorf("could not read %s config: %w", retentionKey, err)
+	}
+	return policy, nil
+}
+
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "apply the retention policy",
+	Long:  `Remove the entries that the retention policy in the config expires, and report them`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		policy, err := retentionPolicy()
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+
+		pruned, err := database.Prune(policy, time.Now(), pruneDryRun)
+		if err != nil {
+			ErrorLogger.Printf("could not prune: %v", err)
+			return err
+		}
+
+		reasons := make(map[string]int)
+		for _, p := range pruned {
+			reasons[p.Reason]++
+			if pruneVerbose {
+				fmt.Printf("%d\t%s\t%s\t(%s)\n", p.Entry.Id, p.Entry.Location, p.Entry.Command, p.Reason)
+			}
+		}
+		for _, c := range storage.TopCounted(reasons, len(reasons)) {
+			fmt.Printf("%6d  %s\n", c.Count, c.Key)
+		}
+		if pruneDryRun {
+			fmt.Printf("would remove %d entries\n", len(pruned))
+		} else {
+			fmt.Printf("removed %d entries\n", len(pruned))
+		}
+		return nil
+	},
+}
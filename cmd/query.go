@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var (
+	queryCount bool
+	queryBy    string
+)
+
+func init() {
+	queryCmd.Flags().BoolVarP(&queryCount, "count", "c", false, "only print how many entries match")
+	queryCmd.Flags().StringVar(&queryBy, "by", "", "count the matching entries per command, location or day")
+	rootCmd.AddCommand(queryCmd)
+}
+
+var queryCmd = &cobra.Command{
+	Use:   "query <expression>",
+	Short: "list the entries matching a query",
+	Long: `List the entries matching a query expression, e.g.
+
+  xenophon query 'cmd~"^git" and dir:~/src/** and since:2d and exit!=0 and host:laptop'
+
+Fields are compared with an operator and a value, which is quoted if it has spaces:
+
+  cmd      :text contains, =, != equal, ~, !~ regular expression
+  dir      :glob (* a name, ** any names, /** a whole tree), =, !=, ~, !~
+  host     :, =, !=, ~, !~
+  session  :, =, !=, ~, !~
+  exit     :, =, !=, <, <=, >, >=
+  since    :2d, :1w3d, :36h, :2006-01-02 or an RFC 3339 time
+  until    like since, including that second
+
+Conditions are combined with and, or, not and parentheses, and is implied between
+conditions. A word without a field matches commands that contain it.
+
+With --count only the number of matching entries is printed, e.g. to see how often a
+command ran, and with --by command, location or day their number per group, most first.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		q, err := storage.ParseQuery(strings.Join(args, " "), time.Now())
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		results, err := database.Query(q)
+		if err != nil {
+			ErrorLogger.Printf("could not query history: %v", err)
+			return err
+		}
+		switch {
+		case queryBy != "":
+			group, err := storage.ParseGrouping(queryBy)
+			if err != nil {
+				ErrorLogger.Printf("%v", err)
+				return err
+			}
+			for _, c := range results.CountBy(group) {
+				fmt.Printf("%d\t%s\n", c.Count, c.Key)
+			}
+		case queryCount:
+			fmt.Println(results.Count())
+		default:
+			printEntries(results.Output())
+		}
+		return nil
+	},
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"log"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
@@ -10,7 +11,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/svanellewee/xenophon/storage"
-	"github.com/svanellewee/xenophon/storage/engines/sqlite3"
+	"github.com/svanellewee/xenophon/storage/encrypted"
+	"github.com/svanellewee/xenophon/storage/predict"
 )
 
 var configFile string
@@ -23,7 +25,11 @@ var (
 
 const (
 	engineKey       = "storageengine"
-	databaseFileKey = "databasepath"
+	databaseFileKey = "databasepath" // deprecated, set `path` in the engine's section
+	predictModelKey = "predictmodel"
+	undoWindowKey   = "undowindow"
+	retentionKey    = "retention"
+	encryptionKey   = "encryption"
 	configName      = "config"
 	configType      = "yaml"
 )
@@ -56,14 +62,30 @@ func buildConfigDir() (string, error) {
 	return configHome, nil
 }
 
+// preferredEngines are the defaults for new configs, the first one that is registered wins.
+var preferredEngines = []string{"sqlite3", "bolt"}
+
+func defaultEngine() string {
+	registered := storage.Engines()
+	for _, name := range preferredEngines {
+		for _, r := range registered {
+			if r == name {
+				return name
+			}
+		}
+	}
+	return preferredEngines[0]
+}
+
 func makeConfigFile(configHome string) error {
 
 	viper.AddConfigPath(configHome)
 	viper.SetConfigName(configName)
 	viper.SetConfigType(configType)
 
-	viper.SetDefault(databaseFileKey, filepath.Join(configHome, "history.db"))
-	viper.SetDefault(engineKey, "sqlite3")
+	viper.SetDefault(engineKey, defaultEngine())
+	viper.SetDefault(predictModelKey, filepath.Join(configHome, "predict.json"))
+	viper.SetDefault(undoWindowKey, "72h")
 
 	configFile = filepath.Join(configHome, configName+"."+configType)
 	if _, err := os.Stat(configFile); err != nil {
@@ -85,22 +107,58 @@ func makeConfigFile(configHome string) error {
 
 var (
 	database *storage.DatabaseModule
+	// engine is the storage engine without the encryption layer.
+	engine storage.StorageStreamer
 )
 
+// engineConfig collects the config section of the named engine. The legacy `databasepath`
+// key is still honoured as the path of sqlite3, which it always was, other engines keep
+// their own default files.
+func engineConfig(name string) storage.EngineConfig {
+	values := viper.GetStringMap(name)
+	if _, ok := values["path"]; !ok && name == "sqlite3" && viper.IsSet(databaseFileKey) {
+		values["path"] = viper.GetString(databaseFileKey)
+	}
+	return storage.EngineConfig{
+		Dir:    filepath.Dir(configFile),
+		Values: values,
+	}
+}
+
 // initEngine creates the backend specified by the `engineKey`
 func initEngine() {
-	engine := viper.GetString(engineKey)
-	switch engine {
-	// case "memory":
-	// 	db := memory.NewMemoryStore()
-	// 	database = storage.NewStorageModule(db)
-	default:
-		WarningLogger.Printf("Unknown engine %s, default to sqlite3", engine)
-		fallthrough
-	case "sqlite3":
-		db := sqlite3.NewSqliteStorage(viper.GetString(databaseFileKey))
-		database = storage.NewStorageModule(db)
+	name := viper.GetString(engineKey)
+	db, err := storage.Open(name, engineConfig(name))
+	if err != nil {
+		ErrorLogger.Fatalf("Failed to open %s storage: %v", name, err)
+	}
+	engine = db
+	config := encryptionConfig()
+	encrypt := config.Bool("enabled", false)
+	if encrypt {
+		ring, err := keyring(config)
+		if err != nil {
+			ErrorLogger.Fatalf("Failed to load the encryption key: %v", err)
+		}
+		db = encrypted.New(db, ring)
+	}
+	database = storage.NewStorageModule(db,
+		storage.SetUndoWindow(viper.GetDuration(undoWindowKey)))
+	// The prediction model holds commands in the clear, it is not kept for encrypted histories.
+	if !encrypt {
+		modelFile := viper.GetString(predictModelKey)
+		database.InsertHooks = append(database.InsertHooks, predict.Hook(modelFile))
+		database.ForgetHooks = append(database.ForgetHooks, predict.ForgetHook(modelFile, func() []*storage.Entry {
+			return database.LastEntries(math.MaxInt32).Output()
+		}))
 	}
+
+	policy, err := retentionPolicy()
+	if err != nil {
+		WarningLogger.Printf("retention policy ignored: %v", err)
+		return
+	}
+	database.InsertHooks = append(database.InsertHooks, database.PruneHook(policy))
 }
 
 func init() {
@@ -145,6 +203,9 @@ var rootCmd = &cobra.Command{
 }
 
 func Execute() {
+	if insertThroughDaemon(os.Args[1:]) {
+		return
+	}
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
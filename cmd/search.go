@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var (
+	searchPeriod period
+	searchOutput output
+)
+
+func init() {
+	searchPeriod.addFlags(searchCmd)
+	searchOutput.addFlags(searchCmd)
+	rootCmd.AddCommand(searchCmd)
+}
+
+// containsWords matches entries whose command and note contain every word, ignoring case.
+func containsWords(words []string) storage.FilterType {
+	lower := make([]string, 0, len(words))
+	for _, word := range words {
+		lower = append(lower, strings.ToLower(word))
+	}
+	return func(i int, e *storage.Entry) bool {
+		text := strings.ToLower(e.Command + "\n" + e.Note)
+		for _, word := range lower {
+			if !strings.Contains(text, word) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+var searchCmd = &cobra.Command{
+	Use:   "search <word>...",
+	Short: "search the whole history",
+	Long:  `List the entries, in any directory, whose command and note contain every word, ignoring case`,
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		results, err := searchPeriod.entries(time.Now())
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		if err = searchOutput.write(results.Filter(containsWords(args))); err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		return nil
+	},
+}
@@ -0,0 +1,113 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/svanellewee/xenophon/server"
+)
+
+const (
+	serveKey      = "serve"
+	defaultListen = "127.0.0.1:8765"
+)
+
+var (
+	serveListen  string
+	serveTokens  []string
+	serveTLSCert string
+	serveTLSKey  string
+	serveNoAuth  bool
+)
+
+func init() {
+	serveCmd.Flags().StringVar(&serveListen, "listen", "", "address to listen on (default "+defaultListen+")")
+	serveCmd.Flags().StringArrayVar(&serveTokens, "token", nil, "token clients authenticate with, repeatable")
+	serveCmd.Flags().StringVar(&serveTLSCert, "tls-cert", "", "certificate file, serve HTTPS")
+	serveCmd.Flags().StringVar(&serveTLSKey, "tls-key", "", "private key file of the certificate")
+	serveCmd.Flags().BoolVar(&serveNoAuth, "no-auth", false, "allow requests without a token")
+	rootCmd.AddCommand(serveCmd)
+}
+
+// serveConfig merges the flags over the `serve` section of the config, e.g.
+//
+//	serve:
+//	  listen: 0.0.0.0:8765
+//	  tokens: [a-long-random-token]
+//	  tlscert: /etc/xenophon/cert.pem
+//	  tlskey: /etc/xenophon/key.pem
+func serveConfig() (listen string, tokens []string, cert, key string) {
+	listen, cert, key = serveListen, serveTLSCert, serveTLSKey
+	if listen == "" {
+		listen = viper.GetString(serveKey + ".listen")
+	}
+	if listen == "" {
+		listen = defaultListen
+	}
+	if cert == "" {
+		cert = viper.GetString(serveKey + ".tlscert")
+	}
+	if key == "" {
+		key = viper.GetString(serveKey + ".tlskey")
+	}
+	tokens = append(append([]string{}, serveTokens...), viper.GetStringSlice(serveKey+".tokens")...)
+	return listen, tokens, cert, key
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "share the history over HTTP",
+	Long: `Serve the history as an HTTP/JSON API, so several machines can share it.
+Clients authenticate with one of the tokens as "Authorization: Bearer <token>".`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		listen, tokens, cert, key := serveConfig()
+		if len(tokens) == 0 && !serveNoAuth {
+			err := errors.New("no tokens, set --token or serve.tokens, or pass --no-auth")
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		if (cert == "") != (key == "") {
+			err := errors.New("TLS needs both a certificate and a key")
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+
+		srv := &http.Server{
+			Addr:              listen,
+			Handler:           server.New(database, server.WithTokens(tokens...)),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			srv.Shutdown(shutdown)
+		}()
+
+		var err error
+		if cert != "" {
+			InfoLogger.Printf("serving https://%s", listen)
+			err = srv.ListenAndServeTLS(cert, key)
+		} else {
+			InfoLogger.Printf("serving http://%s", listen)
+			err = srv.ListenAndServe()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			ErrorLogger.Printf("could not serve: %v", err)
+			return fmt.Errorf("could not serve: %w", err)
+		}
+		return nil
+	},
+}
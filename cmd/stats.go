@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var (
+	statsPeriod period
+	statsDir    string
+	statsHost   string
+	statsTop    int
+)
+
+func init() {
+	statsPeriod.addFlags(statsCmd)
+	statsCmd.Flags().StringVar(&statsDir, "dir", "", "only entries in this directory and below")
+	statsCmd.Flags().StringVar(&statsHost, "host", "", "only entries from this host")
+	statsCmd.Flags().IntVarP(&statsTop, "top", "n", storage.DefaultStatsTop, "rows per ranking")
+	rootCmd.AddCommand(statsCmd)
+}
+
+// bar draws count relative to max as a bar of at most width blocks.
+func bar(count, max, width int) string {
+	if max == 0 {
+		return ""
+	}
+	return strings.Repeat("#", count*width/max)
+}
+
+func printCounted(title string, counted []storage.Counted) {
+	fmt.Println(title)
+	for _, c := range counted {
+		fmt.Printf("  %6d  %s\n", c.Count, c.Key)
+	}
+	fmt.Println()
+}
+
+func printHistogram(title string, labels []string, counts []int) {
+	max := 0
+	for _, c := range counts {
+		if c > max {
+			max = c
+		}
+	}
+	fmt.Println(title)
+	for i, c := range counts {
+		fmt.Printf("  %3s %6d  %s\n", labels[i], c, bar(c, max, 40))
+	}
+	fmt.Println()
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "show usage statistics",
+	Long:  `Show the top commands, programs and directories, when you are active, failure rates and streaks`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		since, until, err := statsPeriod.bounds(time.Now())
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		q := storage.StatsQuery{
+			Since: since,
+			Until: until,
+			Host:  storage.HostName(statsHost),
+			Top:   statsTop,
+		}
+		if statsDir != "" {
+			dir, err := filepath.Abs(statsDir)
+			if err != nil {
+				ErrorLogger.Printf("invalid --dir: %v", err)
+				return err
+			}
+			q.Location = dir
+		}
+
+		stats, err := database.Stats(q)
+		if err != nil {
+			ErrorLogger.Printf("could not compute statistics: %v", err)
+			return err
+		}
+
+		fmt.Printf("%d commands\n\n", stats.Total)
+		printCounted("Top commands", stats.TopCommands)
+		printCounted("Top programs", stats.TopPrograms)
+		printCounted("Busiest directories", stats.TopLocations)
+
+		hours := make([]string, len(stats.ByHour))
+		for i := range hours {
+			hours[i] = fmt.Sprintf("%02d", i)
+		}
+		printHistogram("Activity by hour", hours, stats.ByHour[:])
+
+		weekdays := make([]string, len(stats.ByWeekday))
+		for i := range weekdays {
+			weekdays[i] = time.Weekday(i).String()[:3]
+		}
+		printHistogram("Activity by weekday", weekdays, stats.ByWeekday[:])
+
+		if len(stats.Failures) > 0 {
+			fmt.Println("Failure rate per program")
+			for _, f := range stats.Failures {
+				fmt.Printf("  %5.1f%%  %d/%d  %s\n", 100*f.Rate(), f.Failed, f.Runs, f.Program)
+			}
+			fmt.Println()
+		}
+
+		fmt.Printf("Current streak: %d days, longest streak: %d days\n", stats.CurrentStreak, stats.LongestStreak)
+		return nil
+	},
+}
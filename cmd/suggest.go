@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// projectMarkers are the files or directories that mark the root of a project.
+var projectMarkers = []string{".git", ".hg", ".svn", "go.mod", "package.json"}
+
+var (
+	suggestLimit int
+	suggestScan  int
+)
+
+func init() {
+	suggestCmd.Flags().IntVarP(&suggestLimit, "limit", "n", 10, "maximum number of suggestions")
+	suggestCmd.Flags().IntVar(&suggestScan, "scan", 5000, "number of recent entries searched for project-wide commands")
+	rootCmd.AddCommand(suggestCmd)
+}
+
+// projectRoot walks up from dir until it finds a project marker, returns "" if there is none.
+func projectRoot(dir string) string {
+	for current := filepath.Clean(dir); ; current = filepath.Dir(current) {
+		for _, marker := range projectMarkers {
+			if _, err := os.Stat(filepath.Join(current, marker)); err == nil {
+				return current
+			}
+		}
+		if parent := filepath.Dir(current); parent == current {
+			return ""
+		}
+	}
+}
+
+var suggestCmd = &cobra.Command{
+	Use:   "suggest [prefix]",
+	Short: "suggest commands usually run in the current directory",
+	Long: `Suggest the commands you usually run in the current directory and its project root,
+ranked by frequency and recency. An optional prefix limits the suggestions, so the
+first line can drive shell autosuggestions.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		location, err := os.Getwd()
+		if err != nil {
+			ErrorLogger.Printf("could not determine location: %v", err)
+			return err
+		}
+		prefix := strings.Join(args, " ")
+
+		entries := database.Location(location).Output()
+		if root := projectRoot(location); root != "" && root != location {
+			seen := make(map[int64]bool, len(entries))
+			for _, e := range entries {
+				seen[e.Id] = true
+			}
+			for _, e := range database.LastEntries(suggestScan).Filter(storage.UnderLocation(root)).Output() {
+				if !seen[e.Id] {
+					entries = append(entries, e)
+				}
+			}
+		}
+
+		for i, s := range storage.Suggest(entries, prefix, time.Now()) {
+			if i >= suggestLimit {
+				break
+			}
+			fmt.Println(s.Command)
+		}
+		return nil
+	},
+}
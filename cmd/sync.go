@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/encrypted"
+	"github.com/svanellewee/xenophon/storage/replica"
+)
+
+var (
+	syncEngine string
+	syncToken  string
+)
+
+func init() {
+	syncCmd.Flags().StringVar(&syncEngine, "engine", "", "engine of a peer file, guessed from its extension otherwise")
+	syncCmd.Flags().StringVar(&syncToken, "token", "", "token for a peer server, the remote section's token otherwise")
+	rootCmd.AddCommand(syncCmd)
+}
+
+// fileEngines guess the engine of a history file from its extension.
+var fileEngines = map[string]string{
+	".db":     "sqlite3",
+	".sqlite": "sqlite3",
+	".bolt":   "bolt",
+	".jsonl":  "jsonl",
+}
+
+// openFile opens the history file at path with the named engine, or the one its
+// extension names.
+func openFile(path, name string) (storage.StorageStreamer, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		if name = fileEngines[filepath.Ext(path)]; name == "" {
+			return nil, fmt.Errorf("can't tell the engine of %s, use --engine", path)
+		}
+	}
+	return storage.Open(name, storage.EngineConfig{
+		Dir:    filepath.Dir(path),
+		Values: map[string]interface{}{"path": path},
+	})
+}
+
+// withEncryption encrypts s with the configured key, if encryption is enabled.
+func withEncryption(s storage.StorageStreamer) (storage.StorageStreamer, error) {
+	config := encryptionConfig()
+	if !config.Bool("enabled", false) {
+		return s, nil
+	}
+	ring, err := keyring(config)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the encryption key: %w", err)
+	}
+	return encrypted.New(s, ring), nil
+}
+
+// openPeer opens a server URL with the remote engine, configured like the `remote`
+// section, or a history file like openFile.
+func openPeer(peer string) (storage.StorageStreamer, error) {
+	if strings.HasPrefix(peer, "http://") || strings.HasPrefix(peer, "https://") {
+		config := engineConfig("remote")
+		config.Values["url"] = peer
+		config.Values["queue"] = filepath.Join(config.Dir, "sync", peerKey(peer)+"-queue.db")
+		if syncToken != "" {
+			config.Values["token"] = syncToken
+		}
+		return storage.Open("remote", config)
+	}
+	return openFile(peer, syncEngine)
+}
+
+// peerKey names the files kept for a peer.
+func peerKey(peer string) string {
+	if abs, err := filepath.Abs(peer); err == nil && !strings.Contains(peer, "://") {
+		peer = abs
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(peer)))[:16]
+}
+
+var syncCmd = &cobra.Command{
+	Use:   "sync <peer>",
+	Short: "reconcile the history with another one",
+	Long: `Reconcile the history with a peer, another history file or a server's URL, so that
+both have the same entries. Entries only one side has are copied, deletions are copied
+too, even those made while the two were apart. With encryption enabled the peer is
+encrypted with the same key.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+
+		peer, err := openPeer(args[0])
+		if err != nil {
+			ErrorLogger.Printf("could not open %s: %v", args[0], err)
+			return err
+		}
+		defer peer.Close()
+		if peer, err = withEncryption(peer); err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+
+		statePath := filepath.Join(filepath.Dir(configFile), "sync", peerKey(args[0])+".json")
+		state, err := replica.LoadState(statePath)
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		next, report, err := replica.Sync(database.Storage, peer, state, time.Now())
+		if err != nil {
+			ErrorLogger.Printf("could not sync with %s: %v", args[0], err)
+			return err
+		}
+		if err = next.Save(statePath); err != nil {
+			ErrorLogger.Printf("could not save the sync state: %v", err)
+			return err
+		}
+		fmt.Printf("local: %d added, %d deleted\n", report.Local.Added, report.Local.Deleted)
+		fmt.Printf("%s: %d added, %d deleted\n", args[0], report.Peer.Added, report.Peer.Deleted)
+		return nil
+	},
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var (
+	starRemove    bool
+	tagRemove     bool
+	starredOutput output
+)
+
+func init() {
+	starCmd.Flags().BoolVarP(&starRemove, "remove", "d", false, "unstar the entries")
+	tagCmd.Flags().BoolVarP(&tagRemove, "remove", "d", false, "take the tags off the entry")
+	starredOutput.addFlags(starredCmd)
+	rootCmd.AddCommand(starCmd)
+	rootCmd.AddCommand(tagCmd)
+	rootCmd.AddCommand(starredCmd)
+}
+
+func parseId(arg string) (int64, error) {
+	id, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("%q is not an entry id", arg)
+	}
+	return id, nil
+}
+
+// retag adds tags to or removes them from the entry with id.
+func retag(id int64, remove bool, tags ...string) error {
+	var err error
+	if remove {
+		err = database.Untag(id, tags...)
+	} else {
+		err = database.Tag(id, tags...)
+	}
+	if err == storage.ErrNotFound {
+		return fmt.Errorf("there is no entry %d", id)
+	}
+	return err
+}
+
+var starCmd = &cobra.Command{
+	Use:   "star <id>...",
+	Short: "star entries, to find them with starred",
+	Long: `Star the entries with the given ids, e.g. a long incantation worth keeping, so that
+starred lists them. Starring tags entries with "` + storage.StarTag + `", --remove unstars them.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+		for _, arg := range args {
+			id, err := parseId(arg)
+			if err != nil {
+				ErrorLogger.Printf("%v", err)
+				return err
+			}
+			if err = retag(id, starRemove, storage.StarTag); err != nil {
+				ErrorLogger.Printf("could not star %d: %v", id, err)
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+var tagCmd = &cobra.Command{
+	Use:   "tag <id> <tag>...",
+	Short: "tag an entry",
+	Long: `Tag the entry with the given id, e.g. tag 1234 deploy prod. Tags are words without
+spaces, starred <tag> lists the entries with a tag and --remove takes tags off again.`,
+	Args: cobra.MinimumNArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+		id, err := parseId(args[0])
+		if err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		if err = retag(id, tagRemove, args[1:]...); err != nil {
+			ErrorLogger.Printf("could not tag %d: %v", id, err)
+			return err
+		}
+		return nil
+	},
+}
+
+var starredCmd = &cobra.Command{
+	Use:   "starred [tag]",
+	Short: "list starred entries, or those with a tag",
+	Long: `List the starred entries of every directory, or the entries tagged with tag, like list
+does: as a table, as JSON or through a template.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		defer database.Storage.Close()
+		tag := storage.StarTag
+		if len(args) > 0 {
+			tag = args[0]
+		}
+		if err := starredOutput.write(database.Storage.Tag(tag)); err != nil {
+			ErrorLogger.Printf("%v", err)
+			return err
+		}
+		return nil
+	},
+}
@@ -0,0 +1,226 @@
+// Package daemon keeps a DatabaseModule open behind a Unix socket, so that inserting a
+// command from a shell prompt costs a socket round trip instead of opening the engine.
+//
+// Clients send one JSON Request per line and read one JSON Response per line. Entries
+// are written by a single goroutine, which stores every request that arrived while it
+// was writing with one AddBatch. A request is answered once its entry is stored.
+package daemon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// SocketName is the name of the socket in the config directory.
+const SocketName = "daemon.sock"
+
+// DefaultMaxBatch is the most entries written at once.
+const DefaultMaxBatch = 100
+
+// requestTimeout bounds how long a connection may take to send a request.
+const requestTimeout = 5 * time.Second
+
+// ErrRunning is returned by Listen when another daemon serves the socket.
+var ErrRunning = errors.New("daemon is already running")
+
+// Request asks the daemon to store Entry, whose details the client collected.
+type Request struct {
+	Entry *storage.Entry `json:"entry"`
+}
+
+// Response answers a Request with the stored entry's id. Warning is set if the entry was
+// stored but an insert hook failed.
+type Response struct {
+	Id      int64  `json:"id,omitempty"`
+	Warning string `json:"warning,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type pending struct {
+	entry *storage.Entry
+	done  chan Response
+}
+
+type Daemon struct {
+	db       *storage.DatabaseModule
+	maxBatch int
+	requests chan *pending
+	conns    sync.WaitGroup
+}
+
+type Opt func(d *Daemon)
+
+// WithMaxBatch sets the most entries written at once.
+func WithMaxBatch(n int) Opt {
+	return func(d *Daemon) {
+		d.maxBatch = n
+	}
+}
+
+func New(db *storage.DatabaseModule, opts ...Opt) *Daemon {
+	d := &Daemon{db: db, maxBatch: DefaultMaxBatch}
+	for _, opt := range opts {
+		opt(d)
+	}
+	d.requests = make(chan *pending, d.maxBatch)
+	return d
+}
+
+// Listen creates the socket at path, only the user can connect to it. A socket left
+// behind by a daemon that died is replaced.
+func Listen(path string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, ErrRunning
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve answers the connections of l until it is closed, then waits for the requests
+// that were received to be written.
+func (d *Daemon) Serve(l net.Listener) error {
+	written := make(chan struct{})
+	go func() {
+		d.writeLoop()
+		close(written)
+	}()
+	defer func() {
+		d.conns.Wait()
+		close(d.requests)
+		<-written
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		d.conns.Add(1)
+		go func() {
+			defer d.conns.Done()
+			d.handle(conn)
+		}()
+	}
+}
+
+// handle answers the requests of a connection until the client closes it.
+func (d *Daemon) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		conn.SetDeadline(time.Now().Add(requestTimeout))
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		request := Request{}
+		if err = json.Unmarshal(line, &request); err != nil || request.Entry == nil {
+			encoder.Encode(Response{Error: fmt.Sprintf("bad request: %v", err)})
+			return
+		}
+		p := &pending{entry: request.Entry, done: make(chan Response, 1)}
+		d.requests <- p
+		if err = encoder.Encode(<-p.done); err != nil {
+			return
+		}
+	}
+}
+
+// writeLoop writes the requests in batches until the channel is closed.
+func (d *Daemon) writeLoop() {
+	for p := range d.requests {
+		batch := []*pending{p}
+	collect:
+		for len(batch) < d.maxBatch {
+			select {
+			case next, ok := <-d.requests:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, next)
+			default:
+				break collect
+			}
+		}
+		d.write(batch)
+	}
+}
+
+// write stores a batch with a single AddBatch, a hook failure is reported to all of it.
+func (d *Daemon) write(batch []*pending) {
+	entries := make([]*storage.Entry, 0, len(batch))
+	for _, p := range batch {
+		entries = append(entries, p.entry)
+	}
+	stored, err := d.db.InsertEntries(entries)
+	if err != nil && !errors.Is(err, storage.ErrInsertHook) {
+		for _, p := range batch {
+			p.done <- Response{Error: err.Error()}
+		}
+		return
+	}
+	for i, p := range batch {
+		response := Response{Id: stored[i].Id}
+		if err != nil {
+			response.Warning = err.Error()
+		}
+		p.done <- response
+	}
+}
+
+// ErrUnavailable is returned by Insert when no daemon could be reached, the entry was
+// not sent and can be stored directly instead.
+var ErrUnavailable = errors.New("daemon is not available")
+
+// Insert sends e to the daemon listening at path and waits until it is stored.
+func Insert(path string, e *storage.Entry, timeout time.Duration) (*Response, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = json.NewEncoder(conn).Encode(Request{Entry: e}); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	response := &Response{}
+	if err = json.NewDecoder(conn).Decode(response); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("no answer from the daemon: %w", err)
+	}
+	if response.Error != "" {
+		return response, errors.New(response.Error)
+	}
+	return response, nil
+}
@@ -0,0 +1,124 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+// start serves db on a socket in a temporary directory until the test ends.
+func start(t *testing.T, db *storage.DatabaseModule) string {
+	path := filepath.Join(t.TempDir(), SocketName)
+	l, err := Listen(path)
+	require.Nil(t, err)
+	served := make(chan error)
+	go func() { served <- New(db).Serve(l) }()
+	t.Cleanup(func() {
+		l.Close()
+		assert.Nil(t, <-served)
+	})
+	return path
+}
+
+func TestInsert(t *testing.T) {
+	db := storage.NewStorageModule(memory.NewMemoryStore())
+	path := start(t, db)
+
+	code := 1
+	response, err := Insert(path, &storage.Entry{Command: "make", Location: "/src", Host: "laptop", ExitCode: &code}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), response.Id)
+
+	entries := db.LastEntries(10).Output()
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, "make", entries[0].Command)
+	assert.Equal(t, storage.LocationPath("/src"), entries[0].Location)
+	assert.Equal(t, 1, *entries[0].ExitCode)
+	assert.NotEqual(t, "", entries[0].UUID, "the daemon's module completes the entry")
+}
+
+func TestConcurrentInserts(t *testing.T) {
+	db := storage.NewStorageModule(memory.NewMemoryStore())
+	path := start(t, db)
+
+	var wg sync.WaitGroup
+	ids := make(chan int64, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			response, err := Insert(path, &storage.Entry{Command: fmt.Sprintf("command %d", i)}, 5*time.Second)
+			if assert.Nil(t, err) {
+				ids <- response.Id
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[int64]bool{}
+	for id := range ids {
+		assert.False(t, seen[id], "ids are unique")
+		seen[id] = true
+	}
+	assert.Equal(t, 50, len(seen))
+	assert.Equal(t, 50, len(db.LastEntries(100).Output()))
+}
+
+func TestInsertHookWarning(t *testing.T) {
+	db := storage.NewStorageModule(memory.NewMemoryStore(), storage.AddInsertHook(func(e *storage.Entry) error {
+		return errors.New("model is locked")
+	}))
+	path := start(t, db)
+
+	response, err := Insert(path, &storage.Entry{Command: "ls"}, time.Second)
+	require.Nil(t, err)
+	assert.Equal(t, int64(1), response.Id)
+	assert.Contains(t, response.Warning, "model is locked")
+	assert.Equal(t, []string{"ls"}, storagetest.Commands(db.LastEntries(10).Output()))
+}
+
+func TestInsertErrors(t *testing.T) {
+	db := storage.NewStorageModule(memory.NewMemoryStore())
+	path := start(t, db)
+
+	_, err := Insert(filepath.Join(t.TempDir(), SocketName), &storage.Entry{Command: "ls"}, time.Second)
+	assert.ErrorIs(t, err, ErrUnavailable, "nothing listens there")
+
+	conn, err := net.Dial("unix", path)
+	require.Nil(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("{not json\n"))
+	require.Nil(t, err)
+	response := make([]byte, 256)
+	n, _ := conn.Read(response)
+	assert.Contains(t, string(response[:n]), "bad request")
+}
+
+func TestListen(t *testing.T) {
+	db := storage.NewStorageModule(memory.NewMemoryStore())
+	path := start(t, db)
+	_, err := Listen(path)
+	assert.ErrorIs(t, err, ErrRunning)
+
+	// A socket file nobody listens on is left by a daemon that died.
+	stale := filepath.Join(t.TempDir(), SocketName)
+	require.Nil(t, os.WriteFile(stale, nil, 0600))
+	l, err := Listen(stale)
+	require.Nil(t, err)
+	defer l.Close()
+	info, err := os.Stat(stale)
+	require.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
@@ -0,0 +1,9 @@
+//go:build cgo
+
+package main
+
+// These engines need cgo for sqlite, builds with CGO_ENABLED=0 default to the bolt engine.
+import (
+	_ "github.com/svanellewee/xenophon/storage/engines/remote"
+	_ "github.com/svanellewee/xenophon/storage/engines/sqlite3"
+)
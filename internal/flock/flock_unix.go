@@ -0,0 +1,28 @@
+//go:build !windows
+
+// Package flock takes advisory locks on files shared by several xenophon processes.
+package flock
+
+import (
+	"os"
+	"syscall"
+)
+
+// Lock takes an advisory lock on f, shared for readers and exclusive for writers.
+func Lock(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// Unlock releases the lock on f.
+func Unlock(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
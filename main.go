@@ -2,6 +2,11 @@ package main
 
 import (
 	"github.com/svanellewee/xenophon/cmd"
+
+	// Storage engines register themselves, import others here to make them available.
+	_ "github.com/svanellewee/xenophon/storage/engines/bolt"
+	_ "github.com/svanellewee/xenophon/storage/engines/jsonl"
+	_ "github.com/svanellewee/xenophon/storage/engines/memory"
 )
 
 var err error
@@ -0,0 +1,203 @@
+// Package render writes entries for people: as an aligned table, as JSON or through a
+// text/template.
+package render
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// DefaultPathWidth is the width paths are shortened to in tables.
+const DefaultPathWidth = 30
+
+// ANSI colours of exit codes. They have the same length, so that the table stays aligned.
+const (
+	green = "\x1b[32m"
+	red   = "\x1b[31m"
+	grey  = "\x1b[90m"
+	reset = "\x1b[0m"
+)
+
+// oneLine keeps commands on their row.
+var oneLine = strings.NewReplacer("\n", " ", "\t", " ")
+
+// Options are the details of the output.
+type Options struct {
+	Color     bool      // colour exit codes, off for NO_COLOR and output that isn't a terminal
+	Now       time.Time // what times are relative to
+	Home      string    // shortened to ~ in paths
+	PathWidth int       // paths are shortened to this width, DefaultPathWidth if zero
+}
+
+func (o Options) pathWidth() int {
+	if o.PathWidth <= 0 {
+		return DefaultPathWidth
+	}
+	return o.PathWidth
+}
+
+// Relative describes when t was, as seen at now: seconds, minutes, hours or days ago, or
+// the date for anything older than a week.
+func Relative(t *time.Time, now time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	d := now.Sub(*t)
+	switch {
+	case d < 0:
+		return t.Local().Format("2006-01-02 15:04")
+	case d < time.Minute:
+		return fmt.Sprintf("%ds ago", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	case d < 7*24*time.Hour:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	default:
+		return t.Local().Format(storage.DayLayout)
+	}
+}
+
+// ShortPath replaces home with ~ and, while path is wider than width, shortens the
+// directories above the last one to their first letter, e.g. ~/s/app/web becomes ~/s/a/web.
+func ShortPath(path, home string, width int) string {
+	if home != "" && home != "/" {
+		if path == home {
+			path = "~"
+		} else if strings.HasPrefix(path, home+"/") {
+			path = "~" + path[len(home):]
+		}
+	}
+	parts := strings.Split(path, "/")
+	for i := 0; i < len(parts)-1 && utf8.RuneCountInString(path) > width; i++ {
+		part := parts[i]
+		if part == "" || part == "~" {
+			continue
+		}
+		first, size := utf8.DecodeRuneInString(part)
+		short := string(first)
+		if first == '.' && size < len(part) {
+			// Keep hidden directories recognisable.
+			next, _ := utf8.DecodeRuneInString(part[size:])
+			short += string(next)
+		}
+		parts[i] = short
+		path = strings.Join(parts, "/")
+	}
+	return path
+}
+
+// exit formats an exit code, coloured green for success and red for failure.
+func exit(code *int, color bool) string {
+	text, colour := "-", grey
+	if code != nil {
+		text, colour = fmt.Sprint(*code), green
+		if *code != 0 {
+			colour = red
+		}
+	}
+	if !color {
+		return text
+	}
+	return colour + text + reset
+}
+
+// note formats the note of an entry as a shell comment after its command, in grey.
+func note(text string, color bool) string {
+	if text == "" {
+		return ""
+	}
+	text = "  # " + oneLine.Replace(text)
+	if !color {
+		return text
+	}
+	return grey + text + reset
+}
+
+// Table writes entries as aligned columns with a header, notes follow their commands.
+func Table(w io.Writer, entries []*storage.Entry, opts Options) error {
+	width := opts.pathWidth()
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	header := "EXIT"
+	if opts.Color {
+		// Pad the header like the coloured codes below it.
+		header = grey + reset + header
+	}
+	// Deduplicated entries get a column with the number of runs they stand for, and
+	// tagged ones a column with their tags.
+	counted, tagged := false, false
+	for _, e := range entries {
+		counted = counted || e.Count > 0
+		tagged = tagged || len(e.Tags) > 0
+	}
+	fmt.Fprint(table, "ID\tWHEN\t")
+	if counted {
+		fmt.Fprint(table, "RUNS\t")
+	}
+	fmt.Fprintf(table, "%s\tDIRECTORY\t", header)
+	if tagged {
+		fmt.Fprint(table, "TAGS\t")
+	}
+	fmt.Fprint(table, "COMMAND\n")
+	for _, e := range entries {
+		fmt.Fprintf(table, "%d\t%s\t", e.Id, Relative(e.Time, opts.Now))
+		if counted {
+			fmt.Fprintf(table, "%d\t", e.Count)
+		}
+		fmt.Fprintf(table, "%s\t%s\t",
+			exit(e.ExitCode, opts.Color),
+			ShortPath(string(e.Location), opts.Home, width))
+		if tagged {
+			fmt.Fprintf(table, "%s\t", strings.Join(e.Tags, ","))
+		}
+		fmt.Fprintf(table, "%s%s\n", oneLine.Replace(e.Command), note(e.Note, opts.Color))
+	}
+	return table.Flush()
+}
+
+// JSON writes entries as an indented JSON array.
+func JSON(w io.Writer, entries []*storage.Entry) error {
+	if entries == nil {
+		entries = []*storage.Entry{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(entries)
+}
+
+// NewTemplate parses text, which is executed once per entry with the storage.Entry as
+// its data, e.g. `{{.Id}} {{.Command}}`. A newline is written after every entry unless
+// text ends with one. Besides the built-in functions it can call ago, the relative time
+// of a time, short, the shortened form of a path, and exit, the exit code or "-".
+func NewTemplate(text string, opts Options) (*template.Template, error) {
+	width := opts.pathWidth()
+	if !strings.HasSuffix(text, "\n") {
+		text += "\n"
+	}
+	return template.New("entry").Funcs(template.FuncMap{
+		"ago": func(t *time.Time) string { return Relative(t, opts.Now) },
+		"short": func(path storage.LocationPath) string {
+			return ShortPath(string(path), opts.Home, width)
+		},
+		"exit": func(code *int) string { return exit(code, opts.Color) },
+	}).Parse(text)
+}
+
+// Template writes every entry through tmpl.
+func Template(w io.Writer, entries []*storage.Entry, tmpl *template.Template) error {
+	for _, e := range entries {
+		if err := tmpl.Execute(w, e); err != nil {
+			return fmt.Errorf("could not render entry %d: %w", e.Id, err)
+		}
+	}
+	return nil
+}
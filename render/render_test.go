@@ -0,0 +1,163 @@
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+var now = time.Date(2021, time.March, 10, 12, 0, 0, 0, time.Local)
+
+func entries() []*storage.Entry {
+	ok, failed := 0, 127
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	return []*storage.Entry{
+		{Id: 1, Time: at(30 * time.Second), Location: "/home/me/src/app", Command: "git status", ExitCode: &ok},
+		{Id: 12, Time: at(3 * time.Hour), Location: "/tmp", Command: "nosuchcommand\tx", ExitCode: &failed},
+		{Id: 123, Time: at(30 * 24 * time.Hour), Location: "/home/me", Command: "ls"},
+	}
+}
+
+func TestRelative(t *testing.T) {
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	assert.Equal(t, "-", Relative(nil, now))
+	assert.Equal(t, "0s ago", Relative(&now, now))
+	assert.Equal(t, "59s ago", Relative(at(59*time.Second), now))
+	assert.Equal(t, "5m ago", Relative(at(5*time.Minute+30*time.Second), now))
+	assert.Equal(t, "23h ago", Relative(at(23*time.Hour), now))
+	assert.Equal(t, "6d ago", Relative(at(6*24*time.Hour), now))
+	assert.Equal(t, "2021-03-01", Relative(at(9*24*time.Hour), now))
+	assert.Equal(t, "2021-03-10 12:05", Relative(at(-5*time.Minute), now), "times in the future are shown as they are")
+}
+
+func TestShortPath(t *testing.T) {
+	assert.Equal(t, "~", ShortPath("/home/me", "/home/me", 30))
+	assert.Equal(t, "~/src", ShortPath("/home/me/src", "/home/me", 30))
+	assert.Equal(t, "/home/meself", ShortPath("/home/meself", "/home/me", 30), "only whole directories are home")
+	assert.Equal(t, "/srv/www", ShortPath("/srv/www", "/", 30))
+	assert.Equal(t, "~/s/a/web", ShortPath("/home/me/src/app/web", "/home/me", 9))
+	assert.Equal(t, "~/s/app/web", ShortPath("/home/me/src/app/web", "/home/me", 11), "only as much as needed")
+	assert.Equal(t, "~/.c/é/x", ShortPath("/home/me/.config/élan/x", "/home/me", 5), "the last directory is kept")
+	assert.Equal(t, "/v/l/postgresql", ShortPath("/var/lib/postgresql", "", 10))
+}
+
+func TestTable(t *testing.T) {
+	var out bytes.Buffer
+	require.Nil(t, Table(&out, entries(), Options{Now: now, Home: "/home/me"}))
+	expected := strings.Join([]string{
+		"ID   WHEN        EXIT  DIRECTORY  COMMAND",
+		"1    30s ago     0     ~/src/app  git status",
+		"12   3h ago      127   /tmp       nosuchcommand x",
+		"123  2021-02-08  -     ~          ls",
+		"",
+	}, "\n")
+	assert.Equal(t, expected, out.String())
+
+	out.Reset()
+	require.Nil(t, Table(&out, entries(), Options{Now: now, Home: "/home/me", Color: true}))
+	lines := strings.Split(out.String(), "\n")
+	assert.Contains(t, lines[1], green+"0"+reset)
+	assert.Contains(t, lines[2], red+"127"+reset)
+	assert.Contains(t, lines[3], grey+"-"+reset)
+	// Without the colours, the columns line up as before.
+	plain := strings.NewReplacer(green, "", red, "", grey, "", reset, "").Replace(out.String())
+	assert.Equal(t, expected, plain)
+}
+
+func TestTableCounts(t *testing.T) {
+	counted := entries()
+	counted[0].Count, counted[1].Count, counted[2].Count = 3, 1, 12
+	var out bytes.Buffer
+	require.Nil(t, Table(&out, counted, Options{Now: now, Home: "/home/me"}))
+	assert.Equal(t, strings.Join([]string{
+		"ID   WHEN        RUNS  EXIT  DIRECTORY  COMMAND",
+		"1    30s ago     3     0     ~/src/app  git status",
+		"12   3h ago      1     127   /tmp       nosuchcommand x",
+		"123  2021-02-08  12    -     ~          ls",
+		"",
+	}, "\n"), out.String())
+}
+
+func TestTableTags(t *testing.T) {
+	tagged := entries()
+	tagged[0].Tags = []string{"git", "starred"}
+	var out bytes.Buffer
+	require.Nil(t, Table(&out, tagged, Options{Now: now, Home: "/home/me"}))
+	assert.Equal(t, strings.Join([]string{
+		"ID   WHEN        EXIT  DIRECTORY  TAGS         COMMAND",
+		"1    30s ago     0     ~/src/app  git,starred  git status",
+		"12   3h ago      127   /tmp                    nosuchcommand x",
+		"123  2021-02-08  -     ~                       ls",
+		"",
+	}, "\n"), out.String())
+}
+
+func TestTableNotes(t *testing.T) {
+	noted := entries()[:2]
+	noted[0].Note = "shows\nthe branch"
+	var out bytes.Buffer
+	require.Nil(t, Table(&out, noted, Options{Now: now, Home: "/home/me"}))
+	assert.Equal(t, strings.Join([]string{
+		"ID  WHEN     EXIT  DIRECTORY  COMMAND",
+		"1   30s ago  0     ~/src/app  git status  # shows the branch",
+		"12  3h ago   127   /tmp       nosuchcommand x",
+		"",
+	}, "\n"), out.String())
+
+	out.Reset()
+	require.Nil(t, Table(&out, noted, Options{Now: now, Home: "/home/me", Color: true}))
+	assert.Contains(t, out.String(), "git status"+grey+"  # shows the branch"+reset)
+}
+
+func TestJSON(t *testing.T) {
+	var out bytes.Buffer
+	require.Nil(t, JSON(&out, nil))
+	assert.Equal(t, "[]\n", out.String())
+
+	out.Reset()
+	require.Nil(t, JSON(&out, entries()))
+	var decoded []*storage.Entry
+	require.Nil(t, json.Unmarshal(out.Bytes(), &decoded))
+	require.Equal(t, 3, len(decoded))
+	for i, e := range entries() {
+		assert.Equal(t, e.Id, decoded[i].Id)
+		assert.Equal(t, e.Command, decoded[i].Command)
+		assert.Equal(t, e.ExitCode, decoded[i].ExitCode)
+		assert.True(t, e.Time.Equal(*decoded[i].Time))
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	tmpl, err := NewTemplate(`{{.Id}} {{exit .ExitCode}} {{short .Location}} {{ago .Time}} {{.Command | printf "%q"}}`, Options{Now: now, Home: "/home/me"})
+	require.Nil(t, err)
+	var out bytes.Buffer
+	require.Nil(t, Template(&out, entries(), tmpl))
+	assert.Equal(t, `1 0 ~/src/app 30s ago "git status"
+12 127 /tmp 3h ago "nosuchcommand\tx"
+123 - ~ 2021-02-08 "ls"
+`, out.String())
+
+	tmpl, err = NewTemplate("{{.Command}}\n", Options{})
+	require.Nil(t, err)
+	out.Reset()
+	require.Nil(t, Template(&out, entries()[2:], tmpl))
+	assert.Equal(t, "ls\n", out.String(), "no newline is added to a template ending with one")
+
+	_, err = NewTemplate("{{.Command", Options{})
+	assert.Error(t, err)
+	tmpl, err = NewTemplate("{{.Nope}}", Options{})
+	require.Nil(t, err)
+	assert.Error(t, Template(&out, entries(), tmpl))
+}
@@ -0,0 +1,423 @@
+// Package server exposes a DatabaseModule over an HTTP/JSON API, so that several machines
+// can share one history.
+//
+//	POST   /v1/entries           store the JSON entry in the body, its id is assigned
+//	GET    /v1/entries           query, see Query
+//	DELETE /v1/entries?id=1&id=2 forget entries, with hard=true they are deleted immediately
+//	GET    /v1/tombstones        list the soft-deleted entries
+//	POST   /v1/tombstones        soft-delete the entries of a JSON Tombstone, e.g. for a sync
+//	DELETE /v1/tombstones?id=1   restore soft-deleted entries
+//
+// Every request must carry one of the server's tokens as `Authorization: Bearer <token>`.
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// EntriesPath is where the API serves entries.
+const EntriesPath = "/v1/entries"
+
+// TombstonesPath is where the API serves soft-deleted entries.
+const TombstonesPath = "/v1/tombstones"
+
+// maxBodySize limits the size of an entry that is posted.
+const maxBodySize = 1 << 20
+
+type Server struct {
+	db     *storage.DatabaseModule
+	tokens []string
+}
+
+type Opt func(s *Server)
+
+// WithTokens sets the tokens that clients authenticate with. Without tokens every request is allowed.
+func WithTokens(tokens ...string) Opt {
+	return func(s *Server) {
+		s.tokens = append(s.tokens, tokens...)
+	}
+}
+
+func New(db *storage.DatabaseModule, opts ...Opt) *Server {
+	s := &Server{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Error is the body of every response that is not a success.
+type Error struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, Error{Error: err.Error()})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if len(s.tokens) == 0 {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(header, "Bearer ")
+	valid := 0
+	for _, token := range s.tokens {
+		valid |= subtle.ConstantTimeCompare([]byte(given), []byte(token))
+	}
+	return valid == 1
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="xenophon"`)
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+		return
+	}
+	var handlers map[string]http.HandlerFunc
+	switch r.URL.Path {
+	case EntriesPath:
+		handlers = map[string]http.HandlerFunc{
+			http.MethodGet:    s.query,
+			http.MethodPost:   s.insert,
+			http.MethodDelete: s.delete,
+		}
+	case TombstonesPath:
+		handlers = map[string]http.HandlerFunc{
+			http.MethodGet:    s.tombstones,
+			http.MethodPost:   s.tombstone,
+			http.MethodDelete: s.restore,
+		}
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint %s", r.URL.Path))
+		return
+	}
+	handler, ok := handlers[r.Method]
+	if !ok {
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+	handler(w, r)
+}
+
+func (s *Server) insert(w http.ResponseWriter, r *http.Request) {
+	entry := &storage.Entry{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(entry); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad entry: %w", err))
+		return
+	}
+	if strings.TrimSpace(entry.Command) == "" {
+		writeError(w, http.StatusBadRequest, errors.New("bad entry: command is empty"))
+		return
+	}
+	// Clients send the time the command ran, the server's time is used otherwise. Synced
+	// entries keep their UUID and sequence number.
+	entry.Id, entry.Deleted = 0, nil
+
+	e, err := s.db.InsertEntry(entry)
+	if err != nil && !errors.Is(err, storage.ErrInsertHook) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, e)
+}
+
+// Query selects entries with the parameters of a GET request, all of which are optional
+// and combined:
+//
+//	location=/src/app      entries run in the directory
+//	under=/src             entries run in the directory or below it
+//	start=, end=           entries in the period, RFC 3339 times with optional fractions
+//	match=^git             entries whose command matches the regular expression
+//	host=, session=        entries from the host or session
+//	exit=1                 entries that exited with the status
+//	last=10                only the last matching entries
+type Query struct {
+	Location string
+	Under    string
+	Start    *time.Time
+	End      *time.Time
+	Match    *regexp.Regexp
+	Host     string
+	Session  string
+	Exit     *int
+	Last     int
+}
+
+func parseTime(name, value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("bad %s: %w", name, err)
+	}
+	return &t, nil
+}
+
+// ParseQuery reads a Query from the parameters of a request.
+func ParseQuery(values map[string][]string) (*Query, error) {
+	get := func(name string) string {
+		if v := values[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	q := &Query{
+		Location: get("location"),
+		Under:    get("under"),
+		Host:     get("host"),
+		Session:  get("session"),
+	}
+	var err error
+	if q.Start, err = parseTime("start", get("start")); err != nil {
+		return nil, err
+	}
+	if q.End, err = parseTime("end", get("end")); err != nil {
+		return nil, err
+	}
+	if match := get("match"); match != "" {
+		if q.Match, err = regexp.Compile(match); err != nil {
+			return nil, fmt.Errorf("bad match: %w", err)
+		}
+	}
+	if exit := get("exit"); exit != "" {
+		code, err := strconv.Atoi(exit)
+		if err != nil {
+			return nil, fmt.Errorf("bad exit: %w", err)
+		}
+		q.Exit = &code
+	}
+	if last := get("last"); last != "" {
+		if q.Last, err = strconv.Atoi(last); err != nil || q.Last < 0 {
+			return nil, fmt.Errorf("bad last: %q", last)
+		}
+	}
+	return q, nil
+}
+
+func (q *Query) period() (time.Time, time.Time) {
+	start, end := time.Time{}, time.Now()
+	if q.Start != nil {
+		start = *q.Start
+	}
+	if q.End != nil {
+		end = *q.End
+	}
+	return start, end
+}
+
+// filters are the conditions of q that the engine did not select on.
+func (q *Query) filters(byPeriod bool) []storage.FilterType {
+	var filters []storage.FilterType
+	if (q.Start != nil || q.End != nil) && !byPeriod {
+		start, end := q.period()
+		filters = append(filters, func(i int, e *storage.Entry) bool {
+			return e.Time != nil && !e.Time.Before(start) && !e.Time.After(end)
+		})
+	}
+	if q.Under != "" {
+		filters = append(filters, storage.UnderLocation(q.Under))
+	}
+	if q.Match != nil {
+		filters = append(filters, storage.CommandMatches(q.Match))
+	}
+	if q.Host != "" {
+		filters = append(filters, func(i int, e *storage.Entry) bool { return string(e.Host) == q.Host })
+	}
+	if q.Session != "" {
+		filters = append(filters, func(i int, e *storage.Entry) bool { return string(e.Session) == q.Session })
+	}
+	if q.Exit != nil {
+		filters = append(filters, func(i int, e *storage.Entry) bool { return e.ExitCode != nil && *e.ExitCode == *q.Exit })
+	}
+	return filters
+}
+
+// Run selects the entries of db that match q. The location or period is left to the
+// engine, the other conditions are filters on its results, and the last entries are
+// limited by the engine too. It fails when db could not read all of them.
+func (q *Query) Run(db *storage.DatabaseModule) ([]*storage.Entry, error) {
+	var results storage.ResultStreamer
+	filters := q.filters(false)
+	switch {
+	case q.Location != "":
+		results = db.Location(q.Location)
+	case q.Start != nil || q.End != nil:
+		filters = q.filters(true)
+		results = db.Period(q.period())
+	case q.Last > 0 && len(filters) == 0:
+		// Only the last entries are asked for, the engine reads no others.
+		return output(db.LastEntries(q.Last))
+	default:
+		results = db.LastEntries(math.MaxInt32)
+	}
+
+	if len(filters) > 0 {
+		results = results.Filter(func(i int, e *storage.Entry) bool {
+			for _, filter := range filters {
+				if !filter(i, e) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+
+	if q.Last > 0 {
+		results = results.Desc().Limit(q.Last).Asc()
+	}
+	return output(results)
+}
+
+// output reads results, failing unless they are complete.
+func output(results storage.ResultStreamer) ([]*storage.Entry, error) {
+	entries := results.Output()
+	return entries, storage.Err(results)
+}
+
+func (s *Server) query(w http.ResponseWriter, r *http.Request) {
+	q, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	entries, err := q.Run(s.db)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if entries == nil {
+		entries = []*storage.Entry{}
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// Deleted is the response to a delete.
+type Deleted struct {
+	Ids []int64 `json:"ids"`
+}
+
+// parseIds reads the id parameters of a request, there must be at least one.
+func parseIds(values map[string][]string) ([]int64, error) {
+	ids := make([]int64, 0, len(values["id"]))
+	for _, value := range values["id"] {
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad id %q", value)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, errors.New("no ids given")
+	}
+	return ids, nil
+}
+
+func (s *Server) delete(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	ids, err := parseIds(values)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if hard, _ := strconv.ParseBool(values.Get("hard")); hard {
+		err = s.db.Delete(ids)
+	} else {
+		err = s.db.Forget(ids)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Deleted{Ids: ids})
+}
+
+// Tombstone is the body of a soft-delete, the entries with Ids are deleted at At.
+type Tombstone struct {
+	Ids []int64   `json:"ids"`
+	At  time.Time `json:"at"`
+}
+
+func (s *Server) tombstones(w http.ResponseWriter, r *http.Request) {
+	entries := []*storage.Entry{}
+	if engine, ok := s.db.Storage.(storage.TombstoneEngine); ok {
+		tombstones, err := engine.Tombstones()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		entries = append(entries, tombstones...)
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+// tombstone soft-deletes entries at the given time, engines without tombstones delete
+// them like Forget does.
+func (s *Server) tombstone(w http.ResponseWriter, r *http.Request) {
+	tombstone := Tombstone{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&tombstone); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("bad tombstone: %w", err))
+		return
+	}
+	if len(tombstone.Ids) == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("no ids given"))
+		return
+	}
+	if tombstone.At.IsZero() {
+		tombstone.At = time.Now()
+	}
+
+	var err error
+	if engine, ok := s.db.Storage.(storage.TombstoneEngine); ok {
+		err = engine.Tombstone(tombstone.Ids, tombstone.At)
+	} else {
+		err = s.db.Delete(tombstone.Ids)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Deleted{Ids: tombstone.Ids})
+}
+
+func (s *Server) restore(w http.ResponseWriter, r *http.Request) {
+	ids, err := parseIds(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	engine, ok := s.db.Storage.(storage.TombstoneEngine)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, storage.ErrNoTombstones)
+		return
+	}
+	if err = engine.Restore(ids); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, Deleted{Ids: ids})
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+const token = "s3cret"
+
+type client struct {
+	t     *testing.T
+	http  *http.Client
+	url   string
+	token string
+}
+
+func (c *client) do(method, path string, body interface{}, result interface{}) int {
+	var data bytes.Buffer
+	if body != nil {
+		require.Nil(c.t, json.NewEncoder(&data).Encode(body))
+	}
+	req, err := http.NewRequest(method, c.url+path, &data)
+	require.Nil(c.t, err)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	require.Nil(c.t, err)
+	defer resp.Body.Close()
+	if result != nil {
+		require.Nil(c.t, json.NewDecoder(resp.Body).Decode(result))
+	}
+	return resp.StatusCode
+}
+
+func (c *client) insert(command, location, host string, exit int) *storage.Entry {
+	e := &storage.Entry{}
+	status := c.do(http.MethodPost, EntriesPath, &storage.Entry{
+		Command:  command,
+		Location: storage.LocationPath(location),
+		Host:     storage.HostName(host),
+		ExitCode: &exit,
+	}, e)
+	require.Equal(c.t, http.StatusCreated, status)
+	return e
+}
+
+func (c *client) query(values url.Values) []string {
+	var entries []*storage.Entry
+	require.Equal(c.t, http.StatusOK, c.do(http.MethodGet, EntriesPath+"?"+values.Encode(), nil, &entries))
+	return storagetest.Commands(entries)
+}
+
+func newServer(t *testing.T, tls bool) (*httptest.Server, *storage.DatabaseModule) {
+	db := storage.NewStorageModule(memory.NewMemoryStore(), storage.SetUndoWindow(time.Hour))
+	var ts *httptest.Server
+	if tls {
+		ts = httptest.NewTLSServer(New(db, WithTokens(token)))
+	} else {
+		ts = httptest.NewServer(New(db, WithTokens(token)))
+	}
+	t.Cleanup(ts.Close)
+	return ts, db
+}
+
+func TestServer(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		ts, db := newServer(t, tls)
+		c := &client{t: t, http: ts.Client(), url: ts.URL, token: token}
+
+		start := time.Now().Add(-time.Second)
+		first := c.insert("git status", "/src/app", "laptop", 0)
+		assert.Equal(t, "git status", first.Command)
+		assert.NotNil(t, first.Time)
+		assert.True(t, first.Id > 0)
+		c.insert("make test", "/src/app/web", "laptop", 2)
+		c.insert("git push", "/src/app", "desktop", 1)
+		c.insert("ls", "/", "desktop", 0)
+		assert.Equal(t, 4, len(db.LastEntries(10).Output()))
+
+		assert.Equal(t, []string{"git status", "make test", "git push", "ls"}, c.query(url.Values{}))
+		assert.Equal(t, []string{"git push", "ls"}, c.query(url.Values{"last": {"2"}}))
+		assert.Equal(t, []string{"git status", "git push"}, c.query(url.Values{"location": {"/src/app"}}))
+		assert.Equal(t, []string{"git status", "make test", "git push"}, c.query(url.Values{"under": {"/src/app"}}))
+		assert.Equal(t, []string{"git push"}, c.query(url.Values{"match": {"^git"}, "host": {"desktop"}}))
+		assert.Equal(t, []string{"make test"}, c.query(url.Values{"exit": {"2"}}))
+		assert.Equal(t, []string{"git status"}, c.query(url.Values{"location": {"/src/app"}, "last": {"2"}, "match": {"status"}}))
+		period := url.Values{
+			"start": {start.Format(time.RFC3339)},
+			"end":   {time.Now().Add(time.Second).Format(time.RFC3339)},
+		}
+		assert.Equal(t, 4, len(c.query(period)))
+		period.Set("location", "/")
+		assert.Equal(t, []string{"ls"}, c.query(period))
+		assert.Equal(t, 0, len(c.query(url.Values{"start": {time.Now().Add(time.Hour).Format(time.RFC3339)}})))
+
+		var deleted Deleted
+		assert.Equal(t, http.StatusOK, c.do(http.MethodDelete, EntriesPath+"?id=1&id=2", nil, &deleted))
+		assert.Equal(t, []int64{1, 2}, deleted.Ids)
+		assert.Equal(t, []string{"git push", "ls"}, c.query(url.Values{}))
+		// Without hard the entries are forgotten, and can be restored.
+		restored, err := db.Undo(time.Now())
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(restored))
+		assert.Equal(t, http.StatusOK, c.do(http.MethodDelete, EntriesPath+"?id=4&hard=true", nil, nil))
+		assert.Equal(t, []string{"git status", "make test", "git push"}, c.query(url.Values{}))
+	}
+}
+
+func TestServerTombstones(t *testing.T) {
+	ts, _ := newServer(t, false)
+	c := &client{t: t, http: ts.Client(), url: ts.URL, token: token}
+	c.insert("git status", "/src", "laptop", 0)
+	c.insert("ls", "/", "laptop", 0)
+
+	at := time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)
+	var deleted Deleted
+	assert.Equal(t, http.StatusOK, c.do(http.MethodPost, TombstonesPath, &Tombstone{Ids: []int64{1}, At: at}, &deleted))
+	assert.Equal(t, []int64{1}, deleted.Ids)
+	assert.Equal(t, []string{"ls"}, c.query(url.Values{}))
+
+	var tombstones []*storage.Entry
+	assert.Equal(t, http.StatusOK, c.do(http.MethodGet, TombstonesPath, nil, &tombstones))
+	require.Equal(t, 1, len(tombstones))
+	assert.Equal(t, "git status", tombstones[0].Command)
+	assert.True(t, at.Equal(*tombstones[0].Deleted), "the given deletion time is kept")
+
+	assert.Equal(t, http.StatusOK, c.do(http.MethodDelete, TombstonesPath+"?id=1", nil, nil))
+	assert.Equal(t, []string{"git status", "ls"}, c.query(url.Values{}))
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPost, TombstonesPath, &Tombstone{}, nil))
+}
+
+func TestServerErrors(t *testing.T) {
+	ts, _ := newServer(t, false)
+	c := &client{t: t, http: ts.Client(), url: ts.URL, token: token}
+
+	var apiErr Error
+	for _, bad := range []string{"last=-1", "exit=x", "match=(", "start=yesterday"} {
+		assert.Equal(t, http.StatusBadRequest, c.do(http.MethodGet, EntriesPath+"?"+bad, nil, &apiErr), bad)
+		assert.NotEqual(t, "", apiErr.Error)
+	}
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodPost, EntriesPath, &storage.Entry{Command: " "}, nil))
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodDelete, EntriesPath, nil, nil))
+	assert.Equal(t, http.StatusBadRequest, c.do(http.MethodDelete, EntriesPath+"?id=one", nil, nil))
+	assert.Equal(t, http.StatusNotFound, c.do(http.MethodGet, "/v1/other", nil, nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, c.do(http.MethodPut, EntriesPath, nil, nil))
+}
+
+func TestServerAuthentication(t *testing.T) {
+	ts, db := newServer(t, false)
+
+	for _, given := range []string{"", "wrong", token + "x"} {
+		c := &client{t: t, http: ts.Client(), url: ts.URL, token: given}
+		assert.Equal(t, http.StatusUnauthorized, c.do(http.MethodGet, EntriesPath, nil, nil))
+		assert.Equal(t, http.StatusUnauthorized, c.do(http.MethodPost, EntriesPath, &storage.Entry{Command: "ls"}, nil))
+	}
+	assert.Equal(t, 0, len(db.LastEntries(10).Output()))
+
+	// The token is only taken with the Bearer scheme.
+	req, err := http.NewRequest(http.MethodGet, ts.URL+EntriesPath, nil)
+	require.Nil(t, err)
+	req.Header.Set("Authorization", token)
+	resp, err := ts.Client().Do(req)
+	require.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	open := httptest.NewServer(New(db))
+	defer open.Close()
+	c := &client{t: t, http: open.Client(), url: open.URL}
+	assert.Equal(t, http.StatusOK, c.do(http.MethodGet, EntriesPath, nil, nil), "no tokens, no authentication")
+}
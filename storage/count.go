@@ -0,0 +1,52 @@
+package storage
+
+import "fmt"
+
+// Grouping selects what ResultStreamer.CountBy counts entries by.
+type Grouping int
+
+const (
+	// GroupCommand counts the runs of every command.
+	GroupCommand Grouping = iota
+	// GroupLocation counts the entries run in every directory.
+	GroupLocation
+	// GroupDay counts the entries of every local calendar day, formatted with DayLayout.
+	GroupDay
+)
+
+// ParseGrouping reads a grouping by its name: command, location or day.
+func ParseGrouping(name string) (Grouping, error) {
+	switch name {
+	case "command":
+		return GroupCommand, nil
+	case "location":
+		return GroupLocation, nil
+	case "day":
+		return GroupDay, nil
+	}
+	return 0, fmt.Errorf("can't count by %q, use command, location or day", name)
+}
+
+// Key is the group of e.
+func (g Grouping) Key(e *Entry) string {
+	switch g {
+	case GroupLocation:
+		return string(e.Location)
+	case GroupDay:
+		if e.Time == nil {
+			return ""
+		}
+		return e.Time.Local().Format(DayLayout)
+	default:
+		return e.Command
+	}
+}
+
+// CountBy counts entries per group, most first and then by key, like TopCounted.
+func CountBy(entries []*Entry, group Grouping) []Counted {
+	counts := make(map[string]int)
+	for _, e := range entries {
+		counts[group.Key(e)]++
+	}
+	return TopCounted(counts, len(counts))
+}
@@ -0,0 +1,17 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseGrouping(t *testing.T) {
+	for name, expected := range map[string]Grouping{"command": GroupCommand, "location": GroupLocation, "day": GroupDay} {
+		group, err := ParseGrouping(name)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, group)
+	}
+	_, err := ParseGrouping("host")
+	assert.EqualError(t, err, `can't count by "host", use command, location or day`)
+}
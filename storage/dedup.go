@@ -0,0 +1,59 @@
+package storage
+
+// DedupMode selects how ResultStreamer.Dedup collapses entries with the same command.
+type DedupMode int
+
+const (
+	// DedupNone keeps every entry.
+	DedupNone DedupMode = iota
+	// DedupConsecutive collapses runs of the same command into their last entry.
+	DedupConsecutive
+	// DedupUnique keeps the last entry of every command, where it is in the results.
+	DedupUnique
+)
+
+// runs is how many entries e stands for, Count is only set on deduplicated entries.
+func runs(e *Entry) int {
+	if e.Count > 0 {
+		return e.Count
+	}
+	return 1
+}
+
+// Dedup collapses entries with the same command as mode says, the kept entries are
+// copies whose Count is the number of entries they stand for.
+func Dedup(entries []*Entry, mode DedupMode) []*Entry {
+	switch mode {
+	case DedupConsecutive:
+		results := make([]*Entry, 0, len(entries))
+		for i := 0; i < len(entries); {
+			count, j := 0, i
+			for ; j < len(entries) && entries[j].Command == entries[i].Command; j++ {
+				count += runs(entries[j])
+			}
+			last := *entries[j-1]
+			last.Count = count
+			results = append(results, &last)
+			i = j
+		}
+		return results
+	case DedupUnique:
+		counts := make(map[string]int)
+		lastIndex := make(map[string]int)
+		for i, e := range entries {
+			counts[e.Command] += runs(e)
+			lastIndex[e.Command] = i
+		}
+		results := make([]*Entry, 0, len(counts))
+		for i, e := range entries {
+			if lastIndex[e.Command] == i {
+				kept := *e
+				kept.Count = counts[e.Command]
+				results = append(results, &kept)
+			}
+		}
+		return results
+	default:
+		return entries
+	}
+}
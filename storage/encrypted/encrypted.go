@@ -0,0 +1,375 @@
+// Package encrypted encrypts the command, environment and note of entries before they
+// reach the engine it wraps, so that history is unreadable at rest whatever the engine.
+//
+// Ids, times, locations, sessions, hosts, exit codes and tags are stored in the clear,
+// so the engine can still answer LastEntries, Period, Location and Tag itself. Filters
+// run on the decrypted entries. Engine specific statistics are not passed through, they
+// would count ciphertext, so stats fall back to reading the decrypted history.
+package encrypted
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/svanellewee/xenophon/storage"
+)
+
+type encryptedStorage struct {
+	results
+	inner storage.StorageStreamer
+}
+
+// tombstoneStorage is used for engines that implement storage.TombstoneEngine, so that
+// the decorator only claims what the engine can do.
+type tombstoneStorage struct {
+	*encryptedStorage
+	tombstones storage.TombstoneEngine
+}
+
+// New encrypts the history stored in inner with the first key of ring.
+func New(inner storage.StorageStreamer, ring *Keyring) storage.StorageStreamer {
+	s := &encryptedStorage{
+		results: results{inner: inner, ring: ring},
+		inner:   inner,
+	}
+	if tombstones, ok := inner.(storage.TombstoneEngine); ok {
+		return &tombstoneStorage{encryptedStorage: s, tombstones: tombstones}
+	}
+	return s
+}
+
+// seal returns a copy of e with its command, environment and note encrypted.
+func seal(ring *Keyring, e *storage.Entry) (*storage.Entry, error) {
+	sealed := clone(e)
+	command, err := ring.Encrypt(e.Command)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Command = command
+	if sealed.Note, err = sealNote(ring, e.Note); err != nil {
+		return nil, err
+	}
+	if len(e.Env) > 0 {
+		env, err := json.Marshal(e.Env)
+		if err != nil {
+			return nil, err
+		}
+		text, err := ring.Encrypt(string(env))
+		if err != nil {
+			return nil, err
+		}
+		sealed.Env = storage.Environment{text}
+	}
+	return sealed, nil
+}
+
+// sealNote encrypts a note, no note stays empty so that it is still removed.
+func sealNote(ring *Keyring, note string) (string, error) {
+	if note == "" {
+		return "", nil
+	}
+	return ring.Encrypt(note)
+}
+
+// open returns a copy of e with its command, environment and note decrypted.
+func open(ring *Keyring, e *storage.Entry) (*storage.Entry, error) {
+	opened := clone(e)
+	command, err := ring.Decrypt(e.Command)
+	if err != nil {
+		return nil, fmt.Errorf("entry %d: %w", e.Id, err)
+	}
+	opened.Command = command
+	if IsEncrypted(e.Note) {
+		if opened.Note, err = ring.Decrypt(e.Note); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", e.Id, err)
+		}
+	}
+	if len(e.Env) == 1 && IsEncrypted(e.Env[0]) {
+		text, err := ring.Decrypt(e.Env[0])
+		if err != nil {
+			return nil, fmt.Errorf("entry %d: %w", e.Id, err)
+		}
+		opened.Env = nil
+		if err = json.Unmarshal([]byte(text), &opened.Env); err != nil {
+			return nil, fmt.Errorf("entry %d: %w", e.Id, err)
+		}
+	}
+	return opened, nil
+}
+
+// clone copies e, the engine's entries are never modified.
+func clone(e *storage.Entry) *storage.Entry {
+	c := &storage.Entry{Id: e.Id, Time: e.Time}
+	e.Copy(c)
+	return c
+}
+
+// openAll decrypts entries. Entries that can't be decrypted, e.g. because their key was
+// lost, are returned as stored rather than hiding them.
+func openAll(ring *Keyring, entries []*storage.Entry) []*storage.Entry {
+	results := make([]*storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		opened, err := open(ring, e)
+		if err != nil {
+			opened = e
+		}
+		results = append(results, opened)
+	}
+	return results
+}
+
+// results streams over the engine's results, decrypting them on Output.
+type results struct {
+	inner storage.ResultStreamer
+	ring  *Keyring
+	desc  bool
+}
+
+// decrypted streams over the decrypted results in memory, in the same order.
+func (r results) decrypted() storage.ResultStreamer {
+	if r.desc {
+		asc := r.inner.Asc()
+		entries := openAll(r.ring, asc.Output())
+		return storage.IncompleteResults(entries, storage.Err(asc)).Desc()
+	}
+	entries := r.Output()
+	return storage.IncompleteResults(entries, r.Err())
+}
+
+// LastEntries implements storage.ResultStreamer
+func (r results) LastEntries(n int) storage.ResultStreamer {
+	return results{inner: r.inner.LastEntries(n), ring: r.ring, desc: r.desc}
+}
+
+// Period implements storage.ResultStreamer
+func (r results) Period(start time.Time, end time.Time) storage.ResultStreamer {
+	return results{inner: r.inner.Period(start, end), ring: r.ring, desc: r.desc}
+}
+
+// Location implements storage.ResultStreamer
+func (r results) Location(location string) storage.ResultStreamer {
+	return results{inner: r.inner.Location(location), ring: r.ring, desc: r.desc}
+}
+
+// Filter implements storage.ResultStreamer, filters see the decrypted entries.
+func (r results) Filter(filter storage.FilterType) storage.ResultStreamer {
+	return r.decrypted().Filter(filter)
+}
+
+// Tag implements storage.ResultStreamer, tags are stored in the clear.
+func (r results) Tag(name string) storage.ResultStreamer {
+	return results{inner: r.inner.Tag(name), ring: r.ring, desc: r.desc}
+}
+
+// Dedup implements storage.ResultStreamer, commands are compared decrypted.
+func (r results) Dedup(mode storage.DedupMode) storage.ResultStreamer {
+	return r.decrypted().Dedup(mode)
+}
+
+// Asc implements storage.ResultStreamer
+func (r results) Asc() storage.ResultStreamer {
+	return results{inner: r.inner.Asc(), ring: r.ring}
+}
+
+// Desc implements storage.ResultStreamer
+func (r results) Desc() storage.ResultStreamer {
+	return results{inner: r.inner.Desc(), ring: r.ring, desc: true}
+}
+
+// Limit implements storage.ResultStreamer
+func (r results) Limit(n int) storage.ResultStreamer {
+	return results{inner: r.inner.Limit(n), ring: r.ring, desc: r.desc}
+}
+
+// Offset implements storage.ResultStreamer
+func (r results) Offset(n int) storage.ResultStreamer {
+	return results{inner: r.inner.Offset(n), ring: r.ring, desc: r.desc}
+}
+
+// After implements storage.ResultStreamer
+func (r results) After(id int64) storage.ResultStreamer {
+	return results{inner: r.inner.After(id), ring: r.ring, desc: r.desc}
+}
+
+// Count implements storage.ResultStreamer, without decrypting the results.
+func (r results) Count() int {
+	return r.inner.Count()
+}
+
+// CountBy implements storage.ResultStreamer, only commands are decrypted to be counted.
+func (r results) CountBy(group storage.Grouping) []storage.Counted {
+	if group == storage.GroupCommand {
+		return storage.CountBy(r.Output(), group)
+	}
+	return r.inner.CountBy(group)
+}
+
+// Output implements storage.ResultStreamer
+func (r results) Output() []*storage.Entry {
+	return openAll(r.ring, r.inner.Output())
+}
+
+// Err reports why the engine's results are incomplete, see storage.Err.
+func (r results) Err() error {
+	return storage.Err(r.inner)
+}
+
+// Add implements storage.StorageEngine
+func (s *encryptedStorage) Add(e *storage.Entry) (*storage.Entry, error) {
+	sealed, err := seal(s.ring, e)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.inner.Add(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return open(s.ring, stored)
+}
+
+// AddBatch implements storage.StorageEngine
+func (s *encryptedStorage) AddBatch(entries []*storage.Entry) ([]*storage.Entry, error) {
+	sealed := make([]*storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		c, err := seal(s.ring, e)
+		if err != nil {
+			return nil, err
+		}
+		sealed = append(sealed, c)
+	}
+	stored, err := s.inner.AddBatch(sealed)
+	if err != nil {
+		return nil, err
+	}
+	opened := make([]*storage.Entry, 0, len(stored))
+	for _, e := range stored {
+		o, err := open(s.ring, e)
+		if err != nil {
+			return nil, err
+		}
+		opened = append(opened, o)
+	}
+	return opened, nil
+}
+
+// Import implements storage.ImportEngine, it fails with storage.ErrNoImport if the
+// wrapped engine can't keep ids.
+func (s *encryptedStorage) Import(entries []*storage.Entry) error {
+	engine, ok := s.inner.(storage.ImportEngine)
+	if !ok {
+		return storage.ErrNoImport
+	}
+	sealed := make([]*storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		c, err := seal(s.ring, e)
+		if err != nil {
+			return err
+		}
+		sealed = append(sealed, c)
+	}
+	return engine.Import(sealed)
+}
+
+// SetNote implements storage.NoteEngine, it fails with storage.ErrNoNotes if the wrapped
+// engine can't store notes.
+func (s *encryptedStorage) SetNote(id int64, note string) error {
+	engine, ok := s.inner.(storage.NoteEngine)
+	if !ok {
+		return storage.ErrNoNotes
+	}
+	sealed, err := sealNote(s.ring, note)
+	if err != nil {
+		return err
+	}
+	return engine.SetNote(id, sealed)
+}
+
+// AddTags implements storage.TagEngine, it fails with storage.ErrNoTags if the wrapped
+// engine can't tag entries. Tags are stored in the clear, so that the engine can find them.
+func (s *encryptedStorage) AddTags(id int64, tags []string) error {
+	engine, ok := s.inner.(storage.TagEngine)
+	if !ok {
+		return storage.ErrNoTags
+	}
+	return engine.AddTags(id, tags)
+}
+
+// RemoveTags implements storage.TagEngine
+func (s *encryptedStorage) RemoveTags(id int64, tags []string) error {
+	engine, ok := s.inner.(storage.TagEngine)
+	if !ok {
+		return storage.ErrNoTags
+	}
+	return engine.RemoveTags(id, tags)
+}
+
+// Delete implements storage.StorageEngine
+func (s *encryptedStorage) Delete(ids []int64) error {
+	return s.inner.Delete(ids)
+}
+
+// DeleteMatching implements storage.StorageEngine
+func (s *encryptedStorage) DeleteMatching(filter storage.FilterType) (int, error) {
+	ids := storage.Ids(s.LastEntries(math.MaxInt32).Filter(filter).Output())
+	return len(ids), s.inner.Delete(ids)
+}
+
+func (s *encryptedStorage) Close() error {
+	return s.inner.Close()
+}
+
+// Tombstone implements storage.TombstoneEngine
+func (s *tombstoneStorage) Tombstone(ids []int64, at time.Time) error {
+	return s.tombstones.Tombstone(ids, at)
+}
+
+// Restore implements storage.TombstoneEngine
+func (s *tombstoneStorage) Restore(ids []int64) error {
+	return s.tombstones.Restore(ids)
+}
+
+// Tombstones implements storage.TombstoneEngine
+func (s *tombstoneStorage) Tombstones() ([]*storage.Entry, error) {
+	tombstones, err := s.tombstones.Tombstones()
+	if err != nil {
+		return nil, err
+	}
+	return openAll(s.ring, tombstones), nil
+}
+
+// Rekey re-encrypts all entries of inner, the engine without the decorator, that were
+// sealed with a key in from, or not encrypted at all, with the first key of to. It
+// returns how many entries were rewritten.
+func Rekey(inner storage.StorageStreamer, from, to *Keyring) (int, error) {
+	updater, ok := inner.(storage.UpdateEngine)
+	if !ok {
+		return 0, storage.ErrNoUpdate
+	}
+	entries, err := storage.ReadAll(inner)
+	if err != nil {
+		return 0, err
+	}
+	if tombstones, ok := inner.(storage.TombstoneEngine); ok {
+		deleted, err := tombstones.Tombstones()
+		if err != nil {
+			return 0, err
+		}
+		entries = append(entries, deleted...)
+	}
+
+	updates := make([]*storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		opened, err := open(from, e)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err := seal(to, opened)
+		if err != nil {
+			return 0, err
+		}
+		updates = append(updates, sealed)
+	}
+	return len(updates), updater.Update(updates)
+}
@@ -0,0 +1,170 @@
+package encrypted
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/jsonl"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+func newRing(t *testing.T) *Keyring {
+	key, err := NewKey()
+	assert.Nil(t, err)
+	return NewKeyring(key)
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StorageStreamer {
+		return New(memory.NewMemoryStore(), newRing(t))
+	})
+}
+
+func TestConformanceOnFiles(t *testing.T) {
+	// Tags and notes of a file engine go through the decorator too.
+	storagetest.Run(t, func(t *testing.T) storage.StorageStreamer {
+		inner, err := jsonl.NewJsonlStorage(filepath.Join(t.TempDir(), "history.jsonl"), 0, true)
+		assert.Nil(t, err)
+		return New(inner, newRing(t))
+	})
+}
+
+func TestEncryptsAtRest(t *testing.T) {
+	inner := memory.NewMemoryStore()
+	s := New(inner, newRing(t))
+	mod := storage.NewStorageModule(s,
+		storage.SetLocationGetter(storagetest.NewLocation("/src")),
+		storage.SetEnvironmentGetter(storagetest.NewEnvironment("TOKEN=secret")),
+		storage.SetUndoWindow(time.Hour))
+
+	e, err := mod.Insert("export TOKEN=secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "export TOKEN=secret", e.Command)
+	assert.Equal(t, storage.Environment{"TOKEN=secret"}, e.Env)
+
+	stored := inner.LastEntries(1).Output()[0]
+	assert.True(t, IsEncrypted(stored.Command))
+	assert.Equal(t, 1, len(stored.Env))
+	assert.False(t, strings.Contains(stored.Env[0], "secret"))
+	assert.Equal(t, storage.LocationPath("/src"), stored.Location)
+
+	assert.Equal(t, []string{"export TOKEN=secret"}, storagetest.Commands(mod.Location("/src").Output()))
+	assert.Equal(t, storage.Environment{"TOKEN=secret"}, mod.LastEntries(1).Output()[0].Env)
+
+	assert.Nil(t, mod.Note(e.Id, "the secret of the staging cluster"))
+	assert.True(t, IsEncrypted(inner.LastEntries(1).Output()[0].Note))
+	assert.Equal(t, "the secret of the staging cluster", mod.LastEntries(1).Output()[0].Note)
+
+	// Tags are kept in the clear, for the engine to select on.
+	assert.Nil(t, mod.Tag(e.Id, "staging"))
+	assert.Equal(t, []int64{e.Id}, storage.Ids(inner.Tag("staging").Output()))
+	assert.Equal(t, []string{"export TOKEN=secret"}, storagetest.Commands(s.Tag("staging").Output()))
+
+	// Soft-deletes pass through to the engine and come back decrypted.
+	n, err := mod.ForgetMatching(func(i int, e *storage.Entry) bool { return e.Command == "export TOKEN=secret" })
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	tombstones, err := s.(storage.TombstoneEngine).Tombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"export TOKEN=secret"}, storagetest.Commands(tombstones))
+}
+
+func TestWrongKey(t *testing.T) {
+	inner := memory.NewMemoryStore()
+	_, err := storage.NewStorageModule(New(inner, newRing(t))).Insert("ls")
+	assert.Nil(t, err)
+
+	// The entry is not hidden, it is shown as stored.
+	entries := New(inner, newRing(t)).LastEntries(10).Output()
+	assert.Equal(t, 1, len(entries))
+	assert.True(t, IsEncrypted(entries[0].Command))
+
+	_, err = newRing(t).Decrypt(entries[0].Command)
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
+
+func TestRekey(t *testing.T) {
+	inner := memory.NewMemoryStore()
+	_, err := storage.NewStorageModule(inner).Insert("stored before encryption")
+	assert.Nil(t, err)
+
+	old := newRing(t)
+	mod := storage.NewStorageModule(New(inner, old))
+	e, err := mod.Insert("ls")
+	assert.Nil(t, err)
+	assert.Nil(t, mod.Note(e.Id, "lists files"))
+	assert.Equal(t, []string{"stored before encryption", "ls"}, storagetest.Commands(mod.LastEntries(10).Output()))
+
+	next := newRing(t)
+	n, err := Rekey(inner, old, next)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	for _, e := range inner.LastEntries(10).Output() {
+		assert.True(t, IsEncrypted(e.Command))
+	}
+	assert.Equal(t, []string{"stored before encryption", "ls"}, storagetest.Commands(New(inner, next).LastEntries(10).Output()))
+	assert.Equal(t, "lists files", New(inner, next).LastEntries(1).Output()[0].Note, "notes are rekeyed too")
+
+	_, err = Rekey(inner, old, newRing(t))
+	assert.ErrorIs(t, err, ErrUnknownKey, "rekeying with the wrong key changes nothing")
+	assert.Equal(t, []string{"stored before encryption", "ls"}, storagetest.Commands(New(inner, next).LastEntries(10).Output()))
+}
+
+func TestKeyfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.key")
+	first, err := NewKey()
+	assert.Nil(t, err)
+	second, err := NewKey()
+	assert.Nil(t, err)
+	assert.Nil(t, WriteKeyfile(path, NewKeyring(first, second)))
+
+	ring, err := LoadKeyfile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{first.ID, second.ID}, []string{ring.Keys()[0].ID, ring.Keys()[1].ID})
+
+	text, err := NewKeyring(second).Encrypt("ls")
+	assert.Nil(t, err)
+	plaintext, err := ring.Decrypt(text)
+	assert.Nil(t, err)
+	assert.Equal(t, "ls", plaintext)
+}
+
+func TestPassphrase(t *testing.T) {
+	salt, err := LoadSalt(filepath.Join(t.TempDir(), "history.salt"))
+	assert.Nil(t, err)
+
+	key, err := KeyFromPassphrase("correct horse", salt)
+	assert.Nil(t, err)
+	again, err := KeyFromPassphrase("correct horse", salt)
+	assert.Nil(t, err)
+	other, err := KeyFromPassphrase("battery staple", salt)
+	assert.Nil(t, err)
+	assert.Equal(t, key.ID, again.ID)
+	assert.NotEqual(t, key.ID, other.ID)
+
+	_, err = KeyFromPassphrase("", salt)
+	assert.NotNil(t, err)
+}
+
+func TestCheckPassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.salt")
+	salt, err := LoadSalt(path)
+	assert.Nil(t, err)
+	key, err := KeyFromPassphrase("correct horse", salt)
+	assert.Nil(t, err)
+	other, err := KeyFromPassphrase("battery staple", salt)
+	assert.Nil(t, err)
+
+	// The first passphrase is recorded, without changing the salt.
+	assert.Nil(t, CheckPassphrase(path, key))
+	again, err := LoadSalt(path)
+	assert.Nil(t, err)
+	assert.Equal(t, salt, again)
+	assert.Nil(t, CheckPassphrase(path, key))
+	assert.ErrorIs(t, CheckPassphrase(path, other), ErrWrongPassphrase)
+}
@@ -0,0 +1,276 @@
+package encrypted
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// prefix marks encrypted text, followed by the id of the key and the sealed text.
+const prefix = "xen1:"
+
+const (
+	keySize  = 32
+	saltSize = 16
+)
+
+// verifierLabel is authenticated with a key derived from a passphrase, the MAC is stored
+// after the salt to recognise the passphrase by.
+const verifierLabel = "xenophon passphrase verifier"
+
+var (
+	ErrUnknownKey      = errors.New("text was encrypted with a key that is not in the keyring")
+	ErrNoKeys          = errors.New("keyring is empty")
+	ErrWrongPassphrase = errors.New("passphrase does not match the one the history is encrypted with")
+)
+
+// Key is an AES-256 key, identified by a short hash so that text records which key sealed it.
+type Key struct {
+	ID     string
+	secret []byte
+}
+
+func newKey(secret []byte) *Key {
+	sum := sha256.Sum256(secret)
+	return &Key{ID: hex.EncodeToString(sum[:4]), secret: secret}
+}
+
+// NewKey generates a random key.
+func NewKey() (*Key, error) {
+	secret := make([]byte, keySize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return newKey(secret), nil
+}
+
+// KeyFromPassphrase derives a key from a passphrase with scrypt.
+func KeyFromPassphrase(passphrase string, salt []byte) (*Key, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	secret, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	return newKey(secret), nil
+}
+
+// Keyring encrypts with its first key and decrypts with any of them, so that history that
+// is partly sealed with an older key stays readable while it is rekeyed.
+type Keyring struct {
+	keys []*Key
+}
+
+func NewKeyring(keys ...*Key) *Keyring {
+	return &Keyring{keys: keys}
+}
+
+// Keys lists the keys of the ring, the one that encrypts first.
+func (r *Keyring) Keys() []*Key {
+	return r.keys
+}
+
+func (r *Keyring) find(id string) *Key {
+	for _, k := range r.keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	return nil
+}
+
+func aead(k *Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(k.secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IsEncrypted reports whether text was produced by Encrypt.
+func IsEncrypted(text string) bool {
+	return strings.HasPrefix(text, prefix)
+}
+
+// Encrypt seals plaintext with the first key of the ring.
+func (r *Keyring) Encrypt(plaintext string) (string, error) {
+	if len(r.keys) == 0 {
+		return "", ErrNoKeys
+	}
+	k := r.keys[0]
+	gcm, err := aead(k)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), []byte(k.ID))
+	return prefix + k.ID + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens text sealed by Encrypt. Text that is not encrypted is returned as is, it
+// was stored before encryption was enabled.
+func (r *Keyring) Decrypt(text string) (string, error) {
+	if !IsEncrypted(text) {
+		return text, nil
+	}
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(text, prefix), ":")
+	if !ok {
+		return "", errors.New("malformed encrypted text")
+	}
+	k := r.find(id)
+	if k == nil {
+		return "", fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted text: %w", err)
+	}
+	gcm, err := aead(k)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted text: too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(k.ID))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// writeFile replaces path atomically with data that only the owner can read.
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadKeyfile reads a keyring from a file with one hex encoded key per line.
+func LoadKeyfile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ring := NewKeyring()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		secret, err := hex.DecodeString(line)
+		if err != nil || len(secret) != keySize {
+			return nil, fmt.Errorf("%s: bad key", path)
+		}
+		ring.keys = append(ring.keys, newKey(secret))
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ring.keys) == 0 {
+		return nil, fmt.Errorf("%s: %w", path, ErrNoKeys)
+	}
+	return ring, nil
+}
+
+// WriteKeyfile stores the keys of ring in path, replacing it atomically.
+func WriteKeyfile(path string, ring *Keyring) error {
+	var b strings.Builder
+	for _, k := range ring.keys {
+		b.WriteString(hex.EncodeToString(k.secret))
+		b.WriteString("\n")
+	}
+	return writeFile(path, []byte(b.String()))
+}
+
+// NewSalt generates a random salt for KeyFromPassphrase.
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// readSalt reads the lines of a salt file: the salt, then the verifier of the passphrase
+// once one is checked.
+func readSalt(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("%s: no salt", path)
+	}
+	return lines, nil
+}
+
+// LoadSalt reads the salt of the passphrase from path, creating one on first use.
+func LoadSalt(path string) ([]byte, error) {
+	lines, err := readSalt(path)
+	if errors.Is(err, os.ErrNotExist) {
+		salt, err := NewSalt()
+		if err != nil {
+			return nil, err
+		}
+		return salt, WriteSalt(path, salt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return hex.DecodeString(lines[0])
+}
+
+// WriteSalt stores salt in path, replacing it atomically.
+func WriteSalt(path string, salt []byte) error {
+	return writeFile(path, []byte(hex.EncodeToString(salt)+"\n"))
+}
+
+// verifier authenticates verifierLabel with k.
+func verifier(k *Key) string {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(verifierLabel))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckPassphrase fails with ErrWrongPassphrase unless k was derived from the passphrase
+// of the salt in path. The first key checked is recorded after the salt, so a salt
+// written by WriteSalt belongs to the passphrase it is first used with.
+func CheckPassphrase(path string, k *Key) error {
+	lines, err := readSalt(path)
+	if err != nil {
+		return err
+	}
+	if len(lines) == 1 {
+		return writeFile(path, []byte(lines[0]+"\n"+verifier(k)+"\n"))
+	}
+	if !hmac.Equal([]byte(lines[1]), []byte(verifier(k))) {
+		return ErrWrongPassphrase
+	}
+	return nil
+}
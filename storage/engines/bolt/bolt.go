@@ -0,0 +1,549 @@
+// Package bolt stores history in an embedded bbolt key-value file. It is pure Go, so
+// xenophon can be built with CGO_ENABLED=0.
+//
+// Entries are JSON values keyed by their big-endian id. Two index buckets hold empty
+// values under sortable keys, time+id and location+NUL+id, so Period and Location are
+// range scans. Tombstones stay in the entries bucket with Deleted set.
+//
+// bbolt locks the whole file while it is open, exclusively for writers. The file is only
+// opened for the duration of a transaction, read-only for reads, so a long running
+// process like the daemon or serve doesn't lock every other command out. Within a
+// process the lock of the file is not shared between opens, so transactions on the same
+// file take turns on a lock of their own instead of timing out on it.
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/svanellewee/xenophon/storage"
+	bbolt "go.etcd.io/bbolt"
+)
+
+var (
+	entriesBucket  = []byte("entries")
+	timeBucket     = []byte("time")
+	locationBucket = []byte("location")
+)
+
+func init() {
+	storage.Register("bolt", func(config storage.EngineConfig) (storage.StorageStreamer, error) {
+		return NewBoltStorage(
+			config.String("path", filepath.Join(config.Dir, "history.bolt")),
+			config.Duration("timeout", 5*time.Second))
+	})
+}
+
+type boltStorage struct {
+	path    string
+	timeout time.Duration
+	// turns lets the transactions of this process on path take turns.
+	turns *sync.RWMutex
+}
+
+// turns holds a lock for every file opened by this process, by absolute path.
+var turns sync.Map
+
+// turnsFor returns the lock for transactions on path.
+func turnsFor(path string) *sync.RWMutex {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	lock, _ := turns.LoadOrStore(path, &sync.RWMutex{})
+	return lock.(*sync.RWMutex)
+}
+
+// NewBoltStorage opens or creates the database at fileLocation. While a transaction of
+// another process holds the file, a writer waits up to timeout for it.
+func NewBoltStorage(fileLocation string, timeout time.Duration) (storage.StorageStreamer, error) {
+	s := &boltStorage{path: fileLocation, timeout: timeout, turns: turnsFor(fileLocation)}
+	err := s.update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{entriesBucket, timeBucket, locationBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// open opens the file for a single transaction, read-only ones share the lock.
+func (s *boltStorage) open(readOnly bool) (*bbolt.DB, error) {
+	return bbolt.Open(s.path, 0600, &bbolt.Options{Timeout: s.timeout, ReadOnly: readOnly})
+}
+
+// read runs fn in a read-only transaction.
+func (s *boltStorage) read(fn func(tx *bbolt.Tx) error) error {
+	s.turns.RLock()
+	defer s.turns.RUnlock()
+	db, err := s.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(fn)
+}
+
+// update runs fn in a read-write transaction.
+func (s *boltStorage) update(fn func(tx *bbolt.Tx) error) error {
+	s.turns.Lock()
+	defer s.turns.Unlock()
+	db, err := s.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+func idKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func keyId(key []byte) int64 {
+	return int64(binary.BigEndian.Uint64(key[len(key)-8:]))
+}
+
+// timeKey sorts by time, then id. Times before 1970 sort first.
+func timeKey(t time.Time, id int64) []byte {
+	key := make([]byte, 16)
+	nanos := t.UnixNano()
+	if nanos < 0 {
+		nanos = 0
+	}
+	binary.BigEndian.PutUint64(key, uint64(nanos))
+	binary.BigEndian.PutUint64(key[8:], uint64(id))
+	return key
+}
+
+func locationPrefix(location storage.LocationPath) []byte {
+	return append([]byte(location), 0)
+}
+
+func locationKey(location storage.LocationPath, id int64) []byte {
+	return append(locationPrefix(location), idKey(id)...)
+}
+
+func getEntry(tx *bbolt.Tx, id int64) (*storage.Entry, error) {
+	value := tx.Bucket(entriesBucket).Get(idKey(id))
+	if value == nil {
+		return nil, storage.ErrNotFound
+	}
+	e := &storage.Entry{}
+	if err := json.Unmarshal(value, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func putEntry(tx *bbolt.Tx, e *storage.Entry) error {
+	value, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(entriesBucket).Put(idKey(e.Id), value)
+}
+
+// collect reads the live entries with ids, in order, skipping tombstones.
+func collect(tx *bbolt.Tx, ids []int64) ([]*storage.Entry, error) {
+	results := make([]*storage.Entry, 0, len(ids))
+	for _, id := range ids {
+		e, err := getEntry(tx, id)
+		if err == storage.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if e.Deleted == nil {
+			results = append(results, e)
+		}
+	}
+	return results, nil
+}
+
+// view runs a read-only query, without results but with the error if it fails.
+func (s *boltStorage) view(query func(tx *bbolt.Tx) ([]*storage.Entry, error)) storage.ResultStreamer {
+	var results []*storage.Entry
+	err := s.read(func(tx *bbolt.Tx) error {
+		var err error
+		results, err = query(tx)
+		return err
+	})
+	if err != nil {
+		return storage.IncompleteResults(nil, err)
+	}
+	return storage.NewResults(results)
+}
+
+// entries reads all live entries, or with tombstones only the soft-deleted ones.
+func entries(tx *bbolt.Tx, tombstones bool) ([]*storage.Entry, error) {
+	results := make([]*storage.Entry, 0, storage.DefaultCapacity)
+	err := tx.Bucket(entriesBucket).ForEach(func(k, v []byte) error {
+		e := &storage.Entry{}
+		if err := json.Unmarshal(v, e); err != nil {
+			return err
+		}
+		if (e.Deleted != nil) == tombstones {
+			results = append(results, e)
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Output implements storage.ResultStreamer
+func (s *boltStorage) Output() []*storage.Entry {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Output()
+}
+
+// Filter implements storage.ResultStreamer
+func (s *boltStorage) Filter(filter storage.FilterType) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Filter(filter)
+}
+
+// Tag implements storage.ResultStreamer
+func (s *boltStorage) Tag(name string) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Tag(name)
+}
+
+// Dedup implements storage.ResultStreamer
+func (s *boltStorage) Dedup(mode storage.DedupMode) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Dedup(mode)
+}
+
+// Asc implements storage.ResultStreamer
+func (s *boltStorage) Asc() storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Asc()
+}
+
+// Desc implements storage.ResultStreamer
+func (s *boltStorage) Desc() storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Desc()
+}
+
+// Limit implements storage.ResultStreamer
+func (s *boltStorage) Limit(n int) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Limit(n)
+}
+
+// Offset implements storage.ResultStreamer
+func (s *boltStorage) Offset(n int) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Offset(n)
+}
+
+// After implements storage.ResultStreamer
+func (s *boltStorage) After(id int64) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).After(id)
+}
+
+// Count implements storage.ResultStreamer
+func (s *boltStorage) Count() int {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).Count()
+}
+
+// CountBy implements storage.ResultStreamer
+func (s *boltStorage) CountBy(group storage.Grouping) []storage.Counted {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		return entries(tx, false)
+	}).CountBy(group)
+}
+
+// LastEntries implements storage.ResultStreamer
+func (s *boltStorage) LastEntries(n int) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		results := make([]*storage.Entry, 0, storage.DefaultCapacity)
+		c := tx.Bucket(entriesBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(results) < n; k, v = c.Prev() {
+			e := &storage.Entry{}
+			if err := json.Unmarshal(v, e); err != nil {
+				return nil, err
+			}
+			if e.Deleted == nil {
+				results = append(results, e)
+			}
+		}
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+		return results, nil
+	})
+}
+
+// Period implements storage.ResultStreamer
+func (s *boltStorage) Period(start time.Time, end time.Time) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		var ids []int64
+		last := timeKey(end, math.MaxInt64)
+		c := tx.Bucket(timeBucket).Cursor()
+		for k, _ := c.Seek(timeKey(start, 0)); k != nil && bytes.Compare(k, last) <= 0; k, _ = c.Next() {
+			ids = append(ids, keyId(k))
+		}
+		return collect(tx, ids)
+	})
+}
+
+// Location implements storage.ResultStreamer
+func (s *boltStorage) Location(location string) storage.ResultStreamer {
+	return s.view(func(tx *bbolt.Tx) ([]*storage.Entry, error) {
+		var ids []int64
+		prefix := locationPrefix(storage.LocationPath(location))
+		c := tx.Bucket(locationBucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix) && len(k) == len(prefix)+8; k, _ = c.Next() {
+			ids = append(ids, keyId(k))
+		}
+		return collect(tx, ids)
+	})
+}
+
+// Add implements storage.StorageEngine
+func (s *boltStorage) Add(e *storage.Entry) (*storage.Entry, error) {
+	stored, err := s.AddBatch([]*storage.Entry{e})
+	if err != nil {
+		return nil, err
+	}
+	return stored[0], nil
+}
+
+// AddBatch implements storage.StorageEngine, in a single transaction.
+func (s *boltStorage) AddBatch(entries []*storage.Entry) ([]*storage.Entry, error) {
+	now := time.Now()
+	stored := make([]*storage.Entry, 0, len(entries))
+	err := s.update(func(tx *bbolt.Tx) error {
+		for _, e := range entries {
+			t := now
+			if e.Time != nil {
+				t = *e.Time
+			}
+			c := &storage.Entry{}
+			e.Copy(c)
+			c.Time = &t
+			c.Env = nil
+			c.Deleted = nil
+
+			id, err := tx.Bucket(entriesBucket).NextSequence()
+			if err != nil {
+				return err
+			}
+			c.Id = int64(id)
+			if err = putIndexed(tx, c); err != nil {
+				return err
+			}
+			stored = append(stored, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// putIndexed stores a new entry and its index keys.
+func putIndexed(tx *bbolt.Tx, e *storage.Entry) error {
+	if err := putEntry(tx, e); err != nil {
+		return err
+	}
+	if err := tx.Bucket(timeBucket).Put(timeKey(*e.Time, e.Id), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(locationBucket).Put(locationKey(e.Location, e.Id), nil)
+}
+
+// Import implements storage.ImportEngine, the id sequence is moved past the imported ids.
+func (s *boltStorage) Import(entries []*storage.Entry) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		for _, e := range entries {
+			if bucket.Get(idKey(e.Id)) != nil {
+				return fmt.Errorf("entry %d already exists", e.Id)
+			}
+			stored := &storage.Entry{Id: e.Id, Time: e.Time}
+			e.Copy(stored)
+			stored.Env = nil
+			stored.Deleted = nil
+			if stored.Time == nil {
+				t := time.Now()
+				stored.Time = &t
+			}
+			if err := putIndexed(tx, stored); err != nil {
+				return err
+			}
+			if uint64(e.Id) > bucket.Sequence() {
+				if err := bucket.SetSequence(uint64(e.Id)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Delete implements storage.StorageEngine
+func (s *boltStorage) Delete(ids []int64) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		for _, id := range ids {
+			e, err := getEntry(tx, id)
+			if err == storage.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if e.Time != nil {
+				if err = tx.Bucket(timeBucket).Delete(timeKey(*e.Time, id)); err != nil {
+					return err
+				}
+			}
+			if err = tx.Bucket(locationBucket).Delete(locationKey(e.Location, id)); err != nil {
+				return err
+			}
+			if err = tx.Bucket(entriesBucket).Delete(idKey(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteMatching implements storage.StorageEngine
+func (s *boltStorage) DeleteMatching(filter storage.FilterType) (int, error) {
+	ids := storage.Ids(s.Filter(filter).Output())
+	return len(ids), s.Delete(ids)
+}
+
+// setDeleted updates the tombstone of ids, nil restores them.
+func (s *boltStorage) setDeleted(ids []int64, deleted *time.Time) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		for _, id := range ids {
+			e, err := getEntry(tx, id)
+			if err == storage.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if deleted != nil && e.Deleted != nil {
+				continue
+			}
+			e.Deleted = deleted
+			if err = putEntry(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Update implements storage.UpdateEngine, the environment is not stored.
+func (s *boltStorage) Update(entries []*storage.Entry) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		for _, u := range entries {
+			e, err := getEntry(tx, u.Id)
+			if err == storage.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			e.Command = u.Command
+			e.Note = u.Note
+			if err = putEntry(tx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// retag replaces the tags of the stored entry with id by change of them.
+func (s *boltStorage) retag(id int64, change func(tags []string) []string) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		e, err := getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+		e.Tags = change(e.Tags)
+		return putEntry(tx, e)
+	})
+}
+
+// SetNote implements storage.NoteEngine
+func (s *boltStorage) SetNote(id int64, note string) error {
+	return s.update(func(tx *bbolt.Tx) error {
+		e, err := getEntry(tx, id)
+		if err != nil {
+			return err
+		}
+		e.Note = note
+		return putEntry(tx, e)
+	})
+}
+
+// AddTags implements storage.TagEngine
+func (s *boltStorage) AddTags(id int64, tags []string) error {
+	return s.retag(id, func(current []string) []string { return storage.MergeTags(current, tags) })
+}
+
+// RemoveTags implements storage.TagEngine
+func (s *boltStorage) RemoveTags(id int64, tags []string) error {
+	return s.retag(id, func(current []string) []string { return storage.DropTags(current, tags) })
+}
+
+// Tombstone implements storage.TombstoneEngine
+func (s *boltStorage) Tombstone(ids []int64, at time.Time) error {
+	return s.setDeleted(ids, &at)
+}
+
+// Restore implements storage.TombstoneEngine
+func (s *boltStorage) Restore(ids []int64) error {
+	return s.setDeleted(ids, nil)
+}
+
+// Tombstones implements storage.TombstoneEngine
+func (s *boltStorage) Tombstones() ([]*storage.Entry, error) {
+	var results []*storage.Entry
+	err := s.read(func(tx *bbolt.Tx) error {
+		var err error
+		results, err = entries(tx, true)
+		return err
+	})
+	return results, err
+}
+
+// Close implements storage.StorageEngine, the file is only open during transactions.
+func (s *boltStorage) Close() error {
+	return nil
+}
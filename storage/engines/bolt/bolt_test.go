@@ -0,0 +1,109 @@
+package bolt
+
+import (
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+	bbolt "go.etcd.io/bbolt"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StorageStreamer {
+		store, err := NewBoltStorage(filepath.Join(t.TempDir(), "history.bolt"), time.Second)
+		assert.Nil(t, err)
+		return store
+	})
+}
+
+func TestBolt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.bolt")
+	store, err := NewBoltStorage(path, time.Second)
+	assert.Nil(t, err)
+
+	where := storagetest.NewLocation("")
+	mod := storage.NewStorageModule(store, storage.SetLocationGetter(where), storage.SetUndoWindow(time.Hour))
+	testCases := []struct {
+		command  string
+		location string
+	}{
+		{"cd /", "/tmp"},
+		{"echo $PATH", "/"},
+		{"cd /tmp/hello", "/"},
+		{"vim", "/tmp/bla"},
+	}
+	start := time.Now()
+	for _, testCase := range testCases {
+		where.Set(testCase.location, nil)
+		_, err := mod.Insert(testCase.command)
+		assert.Nil(t, err)
+	}
+	end := time.Now()
+
+	assert.Equal(t, []string{"echo $PATH", "cd /tmp/hello", "vim"}, storagetest.Commands(mod.LastEntries(3).Output()))
+	assert.Equal(t, []string{"echo $PATH", "cd /tmp/hello"}, storagetest.Commands(mod.Location("/").Output()))
+	assert.Equal(t, 0, len(mod.Location("/tm").Output()))
+	assert.Equal(t, 4, len(mod.Period(start, end).Output()))
+	assert.Equal(t, 0, len(mod.Period(end.Add(time.Second), end.Add(time.Minute)).Output()))
+
+	n, err := mod.ForgetMatching(storage.CommandMatches(regexp.MustCompile("^cd")))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"echo $PATH"}, storagetest.Commands(mod.Location("/").Output()))
+	assert.Equal(t, 2, len(mod.Period(start, end).Output()))
+
+	restored, err := mod.Undo(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(restored))
+	assert.Equal(t, 4, len(mod.LastEntries(10).Output()))
+
+	// Hard deletes also drop the index keys, and ids are never reused.
+	assert.Nil(t, store.Delete([]int64{1, 2}))
+	assert.Equal(t, []string{"cd /tmp/hello"}, storagetest.Commands(mod.Location("/").Output()))
+	assert.Equal(t, 2, len(mod.Period(start, end).Output()))
+	assert.Nil(t, store.Close())
+
+	store, err = NewBoltStorage(path, time.Second)
+	assert.Nil(t, err)
+	defer store.Close()
+	e, err := storage.NewStorageModule(store).Insert("ls")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), e.Id)
+	assert.Equal(t, []string{"cd /tmp/hello", "vim", "ls"}, storagetest.Commands(store.LastEntries(10).Output()))
+}
+
+func TestSharedFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.bolt")
+	daemon, err := NewBoltStorage(path, 100*time.Millisecond)
+	assert.Nil(t, err)
+	defer daemon.Close()
+
+	// A second process can use the file while the first keeps its store open.
+	shell, err := NewBoltStorage(path, 100*time.Millisecond)
+	assert.Nil(t, err)
+	defer shell.Close()
+	_, err = storage.NewStorageModule(shell).Insert("ls")
+	assert.Nil(t, err)
+	_, err = storage.NewStorageModule(daemon).Insert("pwd")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ls", "pwd"}, storagetest.Commands(shell.LastEntries(10).Output()))
+}
+
+func TestReadErrorsAreReported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.bolt")
+	store, err := NewBoltStorage(path, 100*time.Millisecond)
+	assert.Nil(t, err)
+	defer store.Close()
+
+	// Another process writing for longer than the timeout fails the read.
+	other, err := bbolt.Open(path, 0600, nil)
+	assert.Nil(t, err)
+	defer other.Close()
+	results := store.LastEntries(10)
+	assert.Empty(t, results.Output())
+	assert.ErrorIs(t, storage.Err(results), bbolt.ErrTimeout)
+}
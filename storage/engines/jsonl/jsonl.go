@@ -0,0 +1,903 @@
+// Package jsonl stores history as JSON Lines in a file that stays greppable without
+// xenophon, one entry or operation per line.
+//
+// Entry ids are stored in their lines. New ids are the byte offset of the entry's line
+// across all segments plus one, plus the base that a compaction records in the first line,
+// so writers assign them from the file sizes alone. Tombstones, restores, tags and notes
+// are appended as operations. Deletes and updates compact the history instead: every
+// segment is rewritten with the live entries in their current state, so that deleted and
+// replaced commands don't linger in the file. Writers hold an exclusive flock on a sidecar
+// lock file, so concurrent shells neither interleave lines nor race a rotation or a
+// compaction. An optional sidecar index holds only ids, offsets, times, locations and
+// operations, so that Location and Period read the full lines of the matching entries only.
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/xenophon/internal/flock"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+const (
+	opDelete    = "delete"
+	opTombstone = "tombstone"
+	opRestore   = "restore"
+	opUpdate    = "update"
+	opTag       = "tag"
+	opUntag     = "untag"
+	opNote      = "note"
+	opBase      = "base"
+)
+
+// record is a line of the history file, an entry when Op is empty and an operation on Ids
+// otherwise. Tags and untags carry the tags that are added to or taken off the entry
+// instead of Ids, and notes its new note. Deletes and updates are only read from histories
+// written before they compacted. Base is only set on the first line of a compacted history,
+// and Offset only in the index, where it locates the entry's line.
+type record struct {
+	Op     string     `json:"op,omitempty"`
+	Ids    []int64    `json:"ids,omitempty"`
+	At     *time.Time `json:"at,omitempty"`
+	Base   int64      `json:"base,omitempty"`
+	Offset *int64     `json:"offset,omitempty"`
+	*storage.Entry
+}
+
+func init() {
+	storage.Register("jsonl", func(config storage.EngineConfig) (storage.StorageStreamer, error) {
+		return NewJsonlStorage(
+			config.String("path", filepath.Join(config.Dir, "history.jsonl")),
+			int64(config.Int("maxsize", 0)),
+			config.Bool("index", false))
+	})
+}
+
+type jsonlStorage struct {
+	path    string
+	maxSize int64 // rotate the file once it reaches this many bytes, 0 never
+	index   bool
+}
+
+// NewJsonlStorage opens the history at fileLocation, creating it on the first Add. With
+// index a sidecar index is kept, and (re)built from the history when it is out of date.
+func NewJsonlStorage(fileLocation string, maxSize int64, index bool) (storage.StorageStreamer, error) {
+	s := &jsonlStorage{
+		path:    fileLocation,
+		maxSize: maxSize,
+		index:   index,
+	}
+	if err := os.MkdirAll(filepath.Dir(fileLocation), 0700); err != nil {
+		return nil, err
+	}
+	if index && s.indexStale() {
+		if err := s.rebuildIndex(); err != nil {
+			return nil, fmt.Errorf("could not build index: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// indexStale reports whether the index is missing, or older than the history because
+// it was written to while the index was disabled.
+func (s *jsonlStorage) indexStale() bool {
+	index, err := os.Stat(s.indexPath())
+	if err != nil {
+		return true
+	}
+	data, err := os.Stat(s.path)
+	return err == nil && index.ModTime().Before(data.ModTime())
+}
+
+func (s *jsonlStorage) indexPath() string {
+	return s.path + ".idx"
+}
+
+// rotatedPath names the n-th rotated segment, history.jsonl becomes history.1.jsonl.
+func (s *jsonlStorage) rotatedPath(n int) string {
+	ext := filepath.Ext(s.path)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(s.path, ext), n, ext)
+}
+
+type segment struct {
+	path string
+	base int64 // offset of the segment's first byte across all segments
+	size int64
+}
+
+// segments lists the rotated segments, oldest first, followed by the current file.
+func (s *jsonlStorage) segments() ([]segment, error) {
+	var segments []segment
+	var base int64
+	for n := 1; ; n++ {
+		info, err := os.Stat(s.rotatedPath(n))
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment{path: s.rotatedPath(n), base: base, size: info.Size()})
+		base += info.Size()
+	}
+
+	current := segment{path: s.path, base: base}
+	info, err := os.Stat(s.path)
+	if err == nil {
+		current.size = info.Size()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return append(segments, current), nil
+}
+
+// lock takes the lock shared by all processes that use the history.
+func (s *jsonlStorage) lock(exclusive bool) (*os.File, error) {
+	f, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = flock.Lock(f, exclusive); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func unlock(f *os.File) {
+	flock.Unlock(f)
+	f.Close()
+}
+
+// readLines calls fn with every complete line of the file and the offset it starts at.
+// A trailing line without newline is a write that is still in progress, or was cut off.
+func readLines(path string, fn func(offset int64, line []byte) error) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(bytes.TrimSpace(line)) > 0 {
+			if err = fn(offset, line); err != nil {
+				return err
+			}
+		}
+		offset += int64(len(line))
+	}
+}
+
+func decode(path string, offset int64, line []byte) (*record, error) {
+	rec := &record{}
+	if err := json.Unmarshal(line, rec); err != nil {
+		return nil, fmt.Errorf("%s: bad line at offset %d: %w", path, offset, err)
+	}
+	return rec, nil
+}
+
+// history replays records into the current state of the entries.
+type history struct {
+	entries []*storage.Entry
+	byId    map[int64]*storage.Entry
+	gone    map[int64]bool
+	updates map[int64]*storage.Entry
+	tagged  map[int64]bool
+	noted   map[int64]string
+	offsets map[int64]int64
+}
+
+func newHistory() *history {
+	return &history{
+		entries: make([]*storage.Entry, 0, storage.DefaultCapacity),
+		byId:    make(map[int64]*storage.Entry),
+		gone:    make(map[int64]bool),
+		updates: make(map[int64]*storage.Entry),
+		tagged:  make(map[int64]bool),
+		noted:   make(map[int64]string),
+		offsets: make(map[int64]int64),
+	}
+}
+
+func (h *history) apply(rec *record) {
+	switch rec.Op {
+	case "":
+		if rec.Entry != nil {
+			h.entries = append(h.entries, rec.Entry)
+			h.byId[rec.Entry.Id] = rec.Entry
+			if rec.Offset != nil {
+				h.offsets[rec.Entry.Id] = *rec.Offset
+			} else {
+				// indexes written before compaction located entries by their id
+				h.offsets[rec.Entry.Id] = rec.Entry.Id - 1
+			}
+		}
+	case opDelete:
+		for _, id := range rec.Ids {
+			h.gone[id] = true
+		}
+	case opTombstone:
+		for _, id := range rec.Ids {
+			if e, ok := h.byId[id]; ok && e.Deleted == nil {
+				e.Deleted = rec.At
+			}
+		}
+	case opRestore:
+		for _, id := range rec.Ids {
+			if e, ok := h.byId[id]; ok {
+				e.Deleted = nil
+			}
+		}
+	case opUpdate:
+		if rec.Entry != nil {
+			h.updates[rec.Entry.Id] = rec.Entry
+			h.noted[rec.Entry.Id] = rec.Entry.Note
+			if e, ok := h.byId[rec.Entry.Id]; ok {
+				e.Command = rec.Entry.Command
+				e.Note = rec.Entry.Note
+			}
+		}
+	case opNote:
+		if rec.Entry != nil {
+			h.noted[rec.Entry.Id] = rec.Entry.Note
+			if e, ok := h.byId[rec.Entry.Id]; ok {
+				e.Note = rec.Entry.Note
+			}
+		}
+	case opTag, opUntag:
+		if rec.Entry != nil {
+			h.tagged[rec.Entry.Id] = true
+			if e, ok := h.byId[rec.Entry.Id]; ok {
+				if rec.Op == opTag {
+					e.Tags = storage.MergeTags(e.Tags, rec.Entry.Tags)
+				} else {
+					e.Tags = storage.DropTags(e.Tags, rec.Entry.Tags)
+				}
+			}
+		}
+	}
+}
+
+// overlay applies the updates to entries that were read from their original lines.
+func (h *history) overlay(entries []*storage.Entry) {
+	for _, e := range entries {
+		if u, ok := h.updates[e.Id]; ok {
+			e.Command = u.Command
+		}
+		if note, ok := h.noted[e.Id]; ok {
+			e.Note = note
+		}
+		if h.tagged[e.Id] {
+			e.Tags = h.byId[e.Id].Tags
+		}
+	}
+}
+
+// selectEntries returns the entries that were not deleted, with or without a tombstone.
+func (h *history) selectEntries(tombstones bool) []*storage.Entry {
+	results := make([]*storage.Entry, 0, len(h.entries))
+	for _, e := range h.entries {
+		if !h.gone[e.Id] && (e.Deleted != nil) == tombstones {
+			results = append(results, e)
+		}
+	}
+	return results
+}
+
+// replay reads the files, the segments or the index, into a history.
+func replay(paths ...string) (*history, error) {
+	h := newHistory()
+	for _, path := range paths {
+		err := readLines(path, func(offset int64, line []byte) error {
+			rec, err := decode(path, offset, line)
+			if err != nil {
+				return err
+			}
+			h.apply(rec)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+func (s *jsonlStorage) load() (*history, error) {
+	lock, err := s.lock(false)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock(lock)
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	return replay(paths(segments)...)
+}
+
+func paths(segments []segment) []string {
+	paths := make([]string, 0, len(segments))
+	for _, seg := range segments {
+		paths = append(paths, seg.path)
+	}
+	return paths
+}
+
+// base reads the base of new ids from the first line of the oldest segment, 0 for a
+// history that was never compacted.
+func base(segments []segment) (int64, error) {
+	f, err := os.Open(segments[0].path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	rec, err := decode(segments[0].path, 0, line)
+	if err != nil {
+		return 0, err
+	}
+	if rec.Op != opBase {
+		return 0, nil
+	}
+	return rec.Base, nil
+}
+
+// end is the offset after the last byte across all segments.
+func end(segments []segment) int64 {
+	last := segments[len(segments)-1]
+	return last.base + last.size
+}
+
+// indexRecord is the part of a record at offset that is kept in the index, operations
+// are kept whole.
+func indexRecord(rec *record, offset int64) *record {
+	if rec.Op != "" || rec.Entry == nil {
+		return rec
+	}
+	return &record{Offset: &offset, Entry: &storage.Entry{
+		Id:       rec.Entry.Id,
+		Time:     rec.Entry.Time,
+		Location: rec.Entry.Location,
+		Tags:     rec.Entry.Tags,
+		Deleted:  rec.Entry.Deleted,
+	}}
+}
+
+// trimPartial cuts a line without newline off the end of the file at path, left by a
+// write that was interrupted, so that the next record starts on a line of its own. The
+// caller holds the exclusive lock. It returns the size of the file.
+func trimPartial(path string) (int64, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	size := info.Size()
+	end := size
+	chunk := make([]byte, 4096)
+	for end > 0 {
+		start := end - int64(len(chunk))
+		if start < 0 {
+			start = 0
+		}
+		if _, err = f.ReadAt(chunk[:end-start], start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk[:end-start], '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return size, nil
+	}
+	return end, f.Truncate(end)
+}
+
+func appendTo(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// write appends records in a single write, assigning the ids of entries first.
+func (s *jsonlStorage) write(records ...*record) error {
+	lock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock(lock)
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	base, err := base(segments)
+	if err != nil {
+		return err
+	}
+	current := segments[len(segments)-1]
+	if current.size, err = trimPartial(current.path); err != nil {
+		return err
+	}
+	if s.maxSize > 0 && current.size >= s.maxSize {
+		if err = os.Rename(s.path, s.rotatedPath(len(segments))); err != nil {
+			return fmt.Errorf("could not rotate: %w", err)
+		}
+		current = segment{path: s.path, base: current.base + current.size}
+	}
+
+	var data, index bytes.Buffer
+	encoder, indexEncoder := json.NewEncoder(&data), json.NewEncoder(&index)
+	for _, rec := range records {
+		offset := current.base + current.size + int64(data.Len())
+		if rec.Op == "" && rec.Entry != nil {
+			rec.Entry.Id = base + offset + 1
+		}
+		if err = encoder.Encode(rec); err != nil {
+			return err
+		}
+		if err = indexEncoder.Encode(indexRecord(rec, offset)); err != nil {
+			return err
+		}
+	}
+
+	if err = appendTo(s.path, data.Bytes()); err != nil {
+		return err
+	}
+	if !s.index {
+		return nil
+	}
+	if _, err = trimPartial(s.indexPath()); err != nil {
+		return err
+	}
+	return appendTo(s.indexPath(), index.Bytes())
+}
+
+func (s *jsonlStorage) rebuildIndex() error {
+	lock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock(lock)
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	return s.writeIndex(segments)
+}
+
+// writeIndex replaces the index with one of the segments, the caller holds the exclusive lock.
+func (s *jsonlStorage) writeIndex(segments []segment) error {
+	var index bytes.Buffer
+	encoder := json.NewEncoder(&index)
+	for _, seg := range segments {
+		err := readLines(seg.path, func(offset int64, line []byte) error {
+			rec, err := decode(seg.path, offset, line)
+			if err != nil {
+				return err
+			}
+			return encoder.Encode(indexRecord(rec, seg.base+offset))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return replaceFile(s.indexPath(), index.Bytes())
+}
+
+// replaceFile atomically replaces the file at path with data, which is synced to disk first.
+func replaceFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// compact applies change to the history and rewrites every segment with the live entries
+// that were added to it, in their current state and without the operations on them. The
+// first line records the base of new ids, so that ids are never handed out twice.
+func (s *jsonlStorage) compact(change func(h *history)) error {
+	lock, err := s.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock(lock)
+
+	segments, err := s.segments()
+	if err != nil {
+		return err
+	}
+	h, err := replay(paths(segments)...)
+	if err != nil {
+		return err
+	}
+	change(h)
+	base, err := base(segments)
+	if err != nil {
+		return err
+	}
+
+	for i, seg := range segments {
+		if i > 0 && seg.size == 0 {
+			continue
+		}
+		var data bytes.Buffer
+		encoder := json.NewEncoder(&data)
+		if i == 0 {
+			if err = encoder.Encode(&record{Op: opBase, Base: base + end(segments)}); err != nil {
+				return err
+			}
+		}
+		err = readLines(seg.path, func(offset int64, line []byte) error {
+			rec, err := decode(seg.path, offset, line)
+			if err != nil {
+				return err
+			}
+			if rec.Op != "" || rec.Entry == nil || h.gone[rec.Entry.Id] {
+				return nil
+			}
+			return encoder.Encode(&record{Entry: h.byId[rec.Entry.Id]})
+		})
+		if err != nil {
+			return err
+		}
+		if err = replaceFile(seg.path, data.Bytes()); err != nil {
+			return fmt.Errorf("could not compact %s: %w", seg.path, err)
+		}
+	}
+
+	if !s.index {
+		return nil
+	}
+	if segments, err = s.segments(); err != nil {
+		return err
+	}
+	return s.writeIndex(segments)
+}
+
+// readEntries reads the full lines at offsets, in order, from the segments.
+func (s *jsonlStorage) readEntries(offsets []int64) ([]*storage.Entry, error) {
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	entries := make([]*storage.Entry, 0, len(offsets))
+	for _, offset := range offsets {
+		for _, seg := range segments {
+			if offset < seg.base || offset >= seg.base+seg.size {
+				continue
+			}
+			f, ok := files[seg.path]
+			if !ok {
+				if f, err = os.Open(seg.path); err != nil {
+					return nil, err
+				}
+				files[seg.path] = f
+			}
+			line, err := bufio.NewReader(io.NewSectionReader(f, offset-seg.base, seg.size)).ReadBytes('\n')
+			if err != nil {
+				return nil, fmt.Errorf("%s: could not read entry at offset %d: %w", seg.path, offset-seg.base, err)
+			}
+			rec, err := decode(seg.path, offset-seg.base, line)
+			if err != nil {
+				return nil, err
+			}
+			if rec.Entry != nil {
+				entries = append(entries, rec.Entry)
+			}
+			break
+		}
+	}
+	return entries, nil
+}
+
+// indexed selects entries with the index, or by reading the whole history without one.
+func (s *jsonlStorage) indexed(match storage.FilterType) storage.ResultStreamer {
+	if !s.index {
+		return s.Filter(match)
+	}
+
+	lock, err := s.lock(false)
+	if err != nil {
+		return storage.IncompleteResults(nil, err)
+	}
+	defer unlock(lock)
+
+	h, err := replay(s.indexPath())
+	if err != nil {
+		return storage.IncompleteResults(nil, err)
+	}
+	var offsets []int64
+	for i, e := range h.selectEntries(false) {
+		if match(i, e) {
+			offsets = append(offsets, h.offsets[e.Id])
+		}
+	}
+	entries, err := s.readEntries(offsets)
+	if err != nil {
+		return storage.IncompleteResults(nil, err)
+	}
+	h.overlay(entries)
+	return storage.NewResults(entries)
+}
+
+// results streams over the live entries, without any if the history can't be read.
+func (s *jsonlStorage) results() storage.ResultStreamer {
+	h, err := s.load()
+	if err != nil {
+		return storage.IncompleteResults(nil, err)
+	}
+	return storage.NewResults(h.selectEntries(false))
+}
+
+// Output implements storage.ResultStreamer
+func (s *jsonlStorage) Output() []*storage.Entry {
+	return s.results().Output()
+}
+
+// Filter implements storage.ResultStreamer
+func (s *jsonlStorage) Filter(filter storage.FilterType) storage.ResultStreamer {
+	return s.results().Filter(filter)
+}
+
+// Tag implements storage.ResultStreamer
+func (s *jsonlStorage) Tag(name string) storage.ResultStreamer {
+	return s.results().Tag(name)
+}
+
+// Dedup implements storage.ResultStreamer
+func (s *jsonlStorage) Dedup(mode storage.DedupMode) storage.ResultStreamer {
+	return s.results().Dedup(mode)
+}
+
+// Asc implements storage.ResultStreamer
+func (s *jsonlStorage) Asc() storage.ResultStreamer {
+	return s.results().Asc()
+}
+
+// Desc implements storage.ResultStreamer
+func (s *jsonlStorage) Desc() storage.ResultStreamer {
+	return s.results().Desc()
+}
+
+// Limit implements storage.ResultStreamer
+func (s *jsonlStorage) Limit(n int) storage.ResultStreamer {
+	return s.results().Limit(n)
+}
+
+// Offset implements storage.ResultStreamer
+func (s *jsonlStorage) Offset(n int) storage.ResultStreamer {
+	return s.results().Offset(n)
+}
+
+// After implements storage.ResultStreamer
+func (s *jsonlStorage) After(id int64) storage.ResultStreamer {
+	return s.results().After(id)
+}
+
+// Count implements storage.ResultStreamer
+func (s *jsonlStorage) Count() int {
+	return s.results().Count()
+}
+
+// CountBy implements storage.ResultStreamer
+func (s *jsonlStorage) CountBy(group storage.Grouping) []storage.Counted {
+	return s.results().CountBy(group)
+}
+
+// LastEntries implements storage.ResultStreamer
+func (s *jsonlStorage) LastEntries(n int) storage.ResultStreamer {
+	return s.results().LastEntries(n)
+}
+
+// Location implements storage.ResultStreamer
+func (s *jsonlStorage) Location(location string) storage.ResultStreamer {
+	return s.indexed(func(i int, e *storage.Entry) bool {
+		return string(e.Location) == location
+	})
+}
+
+// Period implements storage.ResultStreamer
+func (s *jsonlStorage) Period(start time.Time, end time.Time) storage.ResultStreamer {
+	return s.indexed(func(i int, e *storage.Entry) bool {
+		return e.Time != nil && !e.Time.Before(start) && !e.Time.After(end)
+	})
+}
+
+// Add implements storage.StorageEngine
+func (s *jsonlStorage) Add(e *storage.Entry) (*storage.Entry, error) {
+	stored, err := s.AddBatch([]*storage.Entry{e})
+	if err != nil {
+		return nil, err
+	}
+	return stored[0], nil
+}
+
+// AddBatch implements storage.StorageEngine, the entries are appended in a single write.
+func (s *jsonlStorage) AddBatch(entries []*storage.Entry) ([]*storage.Entry, error) {
+	now := time.Now()
+	stored := make([]*storage.Entry, 0, len(entries))
+	records := make([]*record, 0, len(entries))
+	for _, e := range entries {
+		t := now
+		if e.Time != nil {
+			t = *e.Time
+		}
+		c := &storage.Entry{}
+		e.Copy(c)
+		c.Time = &t
+		c.Env = nil
+		c.Deleted = nil
+		stored = append(stored, c)
+		records = append(records, &record{Entry: c})
+	}
+	if len(records) == 0 {
+		return stored, nil
+	}
+	if err := s.write(records...); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// Delete implements storage.StorageEngine, the history is compacted so that the deleted
+// lines are gone from the files.
+func (s *jsonlStorage) Delete(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.compact(func(h *history) {
+		h.apply(&record{Op: opDelete, Ids: ids})
+	})
+}
+
+// DeleteMatching implements storage.StorageEngine
+func (s *jsonlStorage) DeleteMatching(filter storage.FilterType) (int, error) {
+	h, err := s.load()
+	if err != nil {
+		return 0, err
+	}
+	ids := storage.Ids(storage.NewResults(h.selectEntries(false)).Filter(filter).Output())
+	return len(ids), s.Delete(ids)
+}
+
+// Update implements storage.UpdateEngine, the environment is not stored. The history is
+// compacted so that the replaced commands are gone from the files.
+func (s *jsonlStorage) Update(entries []*storage.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	return s.compact(func(h *history) {
+		for _, e := range entries {
+			h.apply(&record{Op: opUpdate, Entry: &storage.Entry{Id: e.Id, Command: e.Command, Note: e.Note}})
+		}
+	})
+}
+
+// change appends an operation on an entry that exists, e.g. a tag. Tombstones exist until
+// they are deleted, only entries deleted for good are gone.
+func (s *jsonlStorage) change(op string, e *storage.Entry) error {
+	h, err := s.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := h.byId[e.Id]; !ok || h.gone[e.Id] {
+		return storage.ErrNotFound
+	}
+	return s.write(&record{Op: op, Entry: e})
+}
+
+// SetNote implements storage.NoteEngine
+func (s *jsonlStorage) SetNote(id int64, note string) error {
+	return s.change(opNote, &storage.Entry{Id: id, Note: note})
+}
+
+// AddTags implements storage.TagEngine
+func (s *jsonlStorage) AddTags(id int64, tags []string) error {
+	return s.change(opTag, &storage.Entry{Id: id, Tags: tags})
+}
+
+// RemoveTags implements storage.TagEngine
+func (s *jsonlStorage) RemoveTags(id int64, tags []string) error {
+	return s.change(opUntag, &storage.Entry{Id: id, Tags: tags})
+}
+
+// Tombstone implements storage.TombstoneEngine
+func (s *jsonlStorage) Tombstone(ids []int64, at time.Time) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.write(&record{Op: opTombstone, Ids: ids, At: &at})
+}
+
+// Restore implements storage.TombstoneEngine
+func (s *jsonlStorage) Restore(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.write(&record{Op: opRestore, Ids: ids})
+}
+
+// Tombstones implements storage.TombstoneEngine
+func (s *jsonlStorage) Tombstones() ([]*storage.Entry, error) {
+	h, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	return h.selectEntries(true), nil
+}
+
+func (s *jsonlStorage) Close() error {
+	return nil
+}
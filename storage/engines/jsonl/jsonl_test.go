@@ -0,0 +1,225 @@
+package jsonl
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	for _, index := range []bool{false, true} {
+		index := index
+		t.Run(fmt.Sprintf("index=%v", index), func(t *testing.T) {
+			storagetest.Run(t, func(t *testing.T) storage.StorageStreamer {
+				store, err := NewJsonlStorage(filepath.Join(t.TempDir(), "history.jsonl"), 0, index)
+				assert.Nil(t, err)
+				return store
+			})
+		})
+	}
+}
+
+func TestJsonl(t *testing.T) {
+	for _, index := range []bool{false, true} {
+		t.Run(fmt.Sprintf("index=%v", index), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history.jsonl")
+			store, err := NewJsonlStorage(path, 0, index)
+			assert.Nil(t, err)
+
+			where := storagetest.NewLocation("")
+			mod := storage.NewStorageModule(store, storage.SetLocationGetter(where))
+			start := time.Now()
+			for i, command := range []string{"cd /A", "cd /B", "cd /C", "cd /D"} {
+				where.Set(fmt.Sprintf("/%d", i%2), nil)
+				_, err := mod.Insert(command)
+				assert.Nil(t, err)
+			}
+			end := time.Now()
+
+			entries := mod.LastEntries(3).Output()
+			assert.Equal(t, 3, len(entries))
+			assert.Equal(t, "cd /B", entries[0].Command)
+			assert.Nil(t, entries[0].Env)
+
+			odd := mod.Location("/1").Output()
+			assert.Equal(t, 2, len(odd))
+			assert.Equal(t, "cd /D", odd[1].Command)
+			assert.Equal(t, 4, len(mod.Period(start, end).Output()))
+			assert.Equal(t, 0, len(mod.Period(end.Add(time.Second), end.Add(time.Minute)).Output()))
+
+			// Deleted entries are gone from every query, including the indexed ones.
+			assert.Nil(t, mod.Forget([]int64{odd[0].Id}))
+			assert.Equal(t, 1, len(mod.Location("/1").Output()))
+			assert.Equal(t, 3, len(mod.LastEntries(10).Output()))
+
+			// Reopening reads the same history back.
+			store, err = NewJsonlStorage(path, 0, index)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"cd /A", "cd /C", "cd /D"}, storagetest.Commands(store.LastEntries(10).Output()))
+		})
+	}
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := NewJsonlStorage(path, 200, true)
+	assert.Nil(t, err)
+	mod := storage.NewStorageModule(store, storage.SetLocationGetter(storagetest.NewLocation("/")))
+
+	var ids []int64
+	for i := 0; i < 10; i++ {
+		e, err := mod.Insert(fmt.Sprintf("echo %d", i))
+		assert.Nil(t, err)
+		ids = append(ids, e.Id)
+	}
+	_, err = os.Stat(filepath.Join(filepath.Dir(path), "history.1.jsonl"))
+	assert.Nil(t, err)
+
+	entries := mod.Location("/").Output()
+	assert.Equal(t, ids, storage.Ids(entries))
+	for i, e := range entries {
+		assert.Equal(t, fmt.Sprintf("echo %d", i), e.Command)
+	}
+
+	// A missing index is rebuilt from all segments.
+	assert.Nil(t, os.Remove(path+".idx"))
+	store, err = NewJsonlStorage(path, 200, true)
+	assert.Nil(t, err)
+	assert.Equal(t, ids, storage.Ids(store.Location("/").Output()))
+}
+
+func TestTombstones(t *testing.T) {
+	store, err := NewJsonlStorage(filepath.Join(t.TempDir(), "history.jsonl"), 0, false)
+	assert.Nil(t, err)
+	mod := storage.NewStorageModule(store, storage.SetUndoWindow(time.Hour))
+	for _, command := range []string{"ls", "export TOKEN=secret", "pwd"} {
+		_, err := mod.Insert(command)
+		assert.Nil(t, err)
+	}
+
+	n, err := mod.ForgetMatching(storage.CommandMatches(regexp.MustCompile("secret")))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, []string{"ls", "pwd"}, storagetest.Commands(mod.LastEntries(10).Output()))
+
+	restored, err := mod.Undo(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(restored))
+	assert.Equal(t, 3, len(mod.LastEntries(10).Output()))
+}
+
+func TestCompaction(t *testing.T) {
+	for _, index := range []bool{false, true} {
+		t.Run(fmt.Sprintf("index=%v", index), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "history.jsonl")
+			store, err := NewJsonlStorage(path, 200, index)
+			assert.Nil(t, err)
+			mod := storage.NewStorageModule(store, storage.SetLocationGetter(storagetest.NewLocation("/")))
+
+			var ids []int64
+			for _, command := range []string{"ls", "export TOKEN=secret", "pwd", "make", "git pul", "echo 1", "echo 2"} {
+				e, err := mod.Insert(command)
+				assert.Nil(t, err)
+				ids = append(ids, e.Id)
+			}
+			assert.Nil(t, mod.Tag(ids[0], "keep"))
+			assert.Nil(t, mod.Delete([]int64{ids[1]}))
+			assert.Nil(t, store.(storage.UpdateEngine).Update([]*storage.Entry{{Id: ids[4], Command: "git pull"}}))
+
+			// Deleted and replaced commands are gone from every file.
+			files, err := filepath.Glob(filepath.Join(filepath.Dir(path), "history*"))
+			assert.Nil(t, err)
+			for _, file := range files {
+				data, err := os.ReadFile(file)
+				assert.Nil(t, err)
+				assert.NotContains(t, string(data), "secret", file)
+				assert.NotContains(t, string(data), `"git pul"`, file)
+			}
+
+			// Ids stay the same, and new ones are not handed out twice.
+			live := append([]int64{ids[0]}, ids[2:]...)
+			assert.Equal(t, live, storage.Ids(mod.Location("/").Output()))
+			assert.Equal(t, live, storage.Ids(mod.LastEntries(10).Output()))
+			assert.Equal(t, []string{"keep"}, mod.Location("/").Output()[0].Tags)
+			e, err := mod.Insert("echo 3")
+			assert.Nil(t, err)
+			for _, id := range ids {
+				assert.Less(t, id, e.Id)
+			}
+
+			store, err = NewJsonlStorage(path, 200, index)
+			assert.Nil(t, err)
+			assert.Equal(t, []string{"ls", "pwd", "make", "git pull", "echo 1", "echo 2", "echo 3"},
+				storagetest.Commands(store.Location("/").Output()))
+		})
+	}
+}
+
+func TestPartialLineIsIgnored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := NewJsonlStorage(path, 0, false)
+	assert.Nil(t, err)
+	_, err = storage.NewStorageModule(store).Insert("ls")
+	assert.Nil(t, err)
+	assert.Nil(t, appendTo(path, []byte(`{"id":99,"command":"cut o`)))
+
+	assert.Equal(t, []string{"ls"}, storagetest.Commands(store.LastEntries(10).Output()))
+
+	// The next write starts on a line of its own instead of completing the fragment.
+	_, err = storage.NewStorageModule(store).Insert("pwd")
+	assert.Nil(t, err)
+	results := store.LastEntries(10)
+	assert.Equal(t, []string{"ls", "pwd"}, storagetest.Commands(results.Output()))
+	assert.Nil(t, storage.Err(results))
+}
+
+func TestReadErrorsAreReported(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	store, err := NewJsonlStorage(path, 0, false)
+	assert.Nil(t, err)
+	assert.Nil(t, appendTo(path, []byte("not json\n")))
+
+	results := store.LastEntries(10)
+	assert.Empty(t, results.Output())
+	assert.NotNil(t, storage.Err(results))
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	const writers, inserts = 8, 25
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// Every writer opens the history itself, like separate shells do.
+			store, err := NewJsonlStorage(path, 4096, true)
+			assert.Nil(t, err)
+			mod := storage.NewStorageModule(store)
+			for i := 0; i < inserts; i++ {
+				_, err := mod.Insert(fmt.Sprintf("echo %d %d", w, i))
+				assert.Nil(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	store, err := NewJsonlStorage(path, 4096, true)
+	assert.Nil(t, err)
+	entries := store.LastEntries(writers * inserts).Output()
+	assert.Equal(t, writers*inserts, len(entries))
+	seen := make(map[int64]bool)
+	for _, e := range entries {
+		assert.False(t, seen[e.Id])
+		seen[e.Id] = true
+	}
+}
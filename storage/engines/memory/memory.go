@@ -1,6 +1,8 @@
 package memory
 
 import (
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/svanellewee/xenophon/storage"
@@ -8,6 +10,12 @@ import (
 
 // Testing Mock dependencies...
 
+func init() {
+	storage.Register("memory", func(config storage.EngineConfig) (storage.StorageStreamer, error) {
+		return NewMemoryStore(), nil
+	})
+}
+
 func NewMemoryStore() storage.StorageStreamer {
 	return &memoryStore{
 		entries: make([]*storage.Entry, 0, storage.DefaultCapacity),
@@ -15,64 +23,281 @@ func NewMemoryStore() storage.StorageStreamer {
 }
 
 type memoryStore struct {
-	entries []*storage.Entry
+	mu         sync.RWMutex
+	entries    []*storage.Entry
+	tombstones []*storage.Entry
+	lastId     int64
+}
+
+// results streams over a snapshot of the live entries.
+func (d *memoryStore) results() storage.ResultStreamer {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	snapshot := make([]*storage.Entry, 0, len(d.entries))
+	return storage.NewResults(append(snapshot, d.entries...))
 }
 
 func (d *memoryStore) Output() []*storage.Entry {
-	return d.entries
+	return d.results().Output()
 }
 
 // Filter implements storage.ResultStreamer
 func (d *memoryStore) Filter(flr storage.FilterType) storage.ResultStreamer {
-	return filter(d.entries, flr)
+	return d.results().Filter(flr)
+}
+
+// Dedup implements storage.ResultStreamer
+func (d *memoryStore) Dedup(mode storage.DedupMode) storage.ResultStreamer {
+	return d.results().Dedup(mode)
 }
 
 // LastEntries implements storage.ResultStreamer
 func (d *memoryStore) LastEntries(n int) storage.ResultStreamer {
-	results := make([]*storage.Entry, 0, storage.DefaultCapacity)
-	var index int
-	if len(d.entries) > n {
-		index = len(d.entries) - n
-	}
-	results = append(results, d.entries[index:]...)
-	return &memoryStore{
-		entries: results,
-	}
+	return d.results().LastEntries(n)
 }
 
 // Location implements storage.ResultStreamer
 func (d *memoryStore) Location(location string) storage.ResultStreamer {
-	return filter(d.entries, func(index int, entry *storage.Entry) bool {
-		return string(entry.Location) == location
-	})
+	return d.results().Location(location)
+}
+
+// Tag implements storage.ResultStreamer
+func (d *memoryStore) Tag(name string) storage.ResultStreamer {
+	return d.results().Tag(name)
+}
+
+// Period implements storage.ResultStreamer
+func (d *memoryStore) Period(start time.Time, end time.Time) storage.ResultStreamer {
+	return d.results().Period(start, end)
+}
+
+// Asc implements storage.ResultStreamer
+func (d *memoryStore) Asc() storage.ResultStreamer {
+	return d.results().Asc()
+}
+
+// Desc implements storage.ResultStreamer
+func (d *memoryStore) Desc() storage.ResultStreamer {
+	return d.results().Desc()
+}
+
+// Limit implements storage.ResultStreamer
+func (d *memoryStore) Limit(n int) storage.ResultStreamer {
+	return d.results().Limit(n)
 }
 
-func filter(entries []*storage.Entry, fltr storage.FilterType) *memoryStore {
-	results := make([]*storage.Entry, 0, storage.DefaultCapacity)
+// Offset implements storage.ResultStreamer
+func (d *memoryStore) Offset(n int) storage.ResultStreamer {
+	return d.results().Offset(n)
+}
+
+// After implements storage.ResultStreamer
+func (d *memoryStore) After(id int64) storage.ResultStreamer {
+	return d.results().After(id)
+}
+
+// Count implements storage.ResultStreamer
+func (d *memoryStore) Count() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return len(d.entries)
+}
+
+// CountBy implements storage.ResultStreamer
+func (d *memoryStore) CountBy(group storage.Grouping) []storage.Counted {
+	return d.results().CountBy(group)
+}
+
+func (m *memoryStore) Add(e *storage.Entry) (*storage.Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(e, time.Now())
+	return e, nil
+}
+
+// AddBatch implements storage.StorageEngine
+func (m *memoryStore) AddBatch(entries []*storage.Entry) ([]*storage.Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for _, e := range entries {
+		m.add(e, now)
+	}
+	return entries, nil
+}
+
+// add stores e itself, numbering it, the caller holds the lock.
+func (m *memoryStore) add(e *storage.Entry, now time.Time) {
+	m.lastId++
+	e.Id = m.lastId
+	if e.Time == nil {
+		t := now
+		e.Time = &t
+	}
+	m.entries = append(m.entries, e)
+}
+
+// Import implements storage.ImportEngine
+func (m *memoryStore) Import(entries []*storage.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, e := range entries {
+		stored := &storage.Entry{Id: e.Id, Time: e.Time}
+		e.Copy(stored)
+		stored.Deleted = nil
+		if stored.Time == nil {
+			t := time.Now()
+			stored.Time = &t
+		}
+		m.entries = append(m.entries, stored)
+		if e.Id > m.lastId {
+			m.lastId = e.Id
+		}
+	}
+	sort.SliceStable(m.entries, func(i, j int) bool { return m.entries[i].Id < m.entries[j].Id })
+	return nil
+}
+
+// Update implements storage.UpdateEngine
+func (m *memoryStore) Update(entries []*storage.Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	updates := make(map[int64]*storage.Entry, len(entries))
+	for _, e := range entries {
+		updates[e.Id] = e
+	}
+	for _, stored := range [][]*storage.Entry{m.entries, m.tombstones} {
+		for _, e := range stored {
+			if u, ok := updates[e.Id]; ok {
+				e.Command = u.Command
+				e.Env = u.Env
+				e.Note = u.Note
+			}
+		}
+	}
+	return nil
+}
+
+// retag replaces the tags of the stored entry with id by change of them.
+func (m *memoryStore) retag(id int64, change func(tags []string) []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stored := range [][]*storage.Entry{m.entries, m.tombstones} {
+		for _, e := range stored {
+			if e.Id == id {
+				e.Tags = change(e.Tags)
+				return nil
+			}
+		}
+	}
+	return storage.ErrNotFound
+}
+
+// AddTags implements storage.TagEngine
+func (m *memoryStore) AddTags(id int64, tags []string) error {
+	return m.retag(id, func(current []string) []string { return storage.MergeTags(current, tags) })
+}
+
+// RemoveTags implements storage.TagEngine
+func (m *memoryStore) RemoveTags(id int64, tags []string) error {
+	return m.retag(id, func(current []string) []string { return storage.DropTags(current, tags) })
+}
+
+// SetNote implements storage.NoteEngine
+func (m *memoryStore) SetNote(id int64, note string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, stored := range [][]*storage.Entry{m.entries, m.tombstones} {
+		for _, e := range stored {
+			if e.Id == id {
+				e.Note = note
+				return nil
+			}
+		}
+	}
+	return storage.ErrNotFound
+}
+
+func idSet(ids []int64) map[int64]bool {
+	set := make(map[int64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+// split separates the entries that match from those that don't, keeping their order.
+func split(entries []*storage.Entry, fltr storage.FilterType) (matched, rest []*storage.Entry) {
+	rest = make([]*storage.Entry, 0, len(entries))
 	for i, entry := range entries {
 		if fltr(i, entry) {
-			results = append(results, entry)
+			matched = append(matched, entry)
+		} else {
+			rest = append(rest, entry)
 		}
 	}
-	return &memoryStore{
-		entries: results,
+	return matched, rest
+}
+
+func byId(ids []int64) storage.FilterType {
+	set := idSet(ids)
+	return func(i int, e *storage.Entry) bool {
+		return set[e.Id]
 	}
 }
 
-// Period implements storage.ResultStreamer
-func (d *memoryStore) Period(start time.Time, end time.Time) storage.ResultStreamer {
-	return filter(d.entries, func(i int, entry *storage.Entry) bool {
-		return entry.Time.Before(end) && entry.Time.After(start)
-	})
+// Delete implements storage.StorageEngine
+func (m *memoryStore) Delete(ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, m.entries = split(m.entries, byId(ids))
+	_, m.tombstones = split(m.tombstones, byId(ids))
+	return nil
 }
 
-func (m *memoryStore) Add(e *storage.Entry) (*storage.Entry, error) {
-	index := len(m.entries) + 1
-	e.Id = int64(index)
-	t := time.Now()
-	e.Time = &t
-	m.entries = append(m.entries, e)
-	return e, nil
+// DeleteMatching implements storage.StorageEngine
+func (m *memoryStore) DeleteMatching(fltr storage.FilterType) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched []*storage.Entry
+	matched, m.entries = split(m.entries, fltr)
+	return len(matched), nil
+}
+
+// Tombstone implements storage.TombstoneEngine
+func (m *memoryStore) Tombstone(ids []int64, at time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched []*storage.Entry
+	matched, m.entries = split(m.entries, byId(ids))
+	for _, e := range matched {
+		deleted := at
+		e.Deleted = &deleted
+	}
+	m.tombstones = append(m.tombstones, matched...)
+	return nil
+}
+
+// Restore implements storage.TombstoneEngine
+func (m *memoryStore) Restore(ids []int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var matched []*storage.Entry
+	matched, m.tombstones = split(m.tombstones, byId(ids))
+	for _, e := range matched {
+		e.Deleted = nil
+	}
+	m.entries = append(m.entries, matched...)
+	sort.SliceStable(m.entries, func(i, j int) bool { return m.entries[i].Id < m.entries[j].Id })
+	return nil
+}
+
+// Tombstones implements storage.TombstoneEngine
+func (m *memoryStore) Tombstones() ([]*storage.Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	results := make([]*storage.Entry, 0, len(m.tombstones))
+	return append(results, m.tombstones...), nil
 }
 
 func (m *memoryStore) Close() error {
@@ -8,75 +8,43 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/storagetest"
 )
 
-type location struct {
-	where string
-	err   error
-}
-
-func newTestLocation() *location {
-	return &location{}
-}
-
-func (l *location) Set(where string, err error) {
-	l.where = where
-	l.err = err
-}
-
-func (l *location) Get() (storage.LocationPath, error) {
-	if l.err != nil {
-		return "", l.err
-	}
-	return storage.LocationPath(l.where), nil
-}
-
-type environment struct {
-	env []string
-	err error
-}
-
-func (e *environment) Get() (storage.Environment, error) {
-	return e.env, nil
-}
-
-func (e *environment) Set(env []string, err error) {
-	e.env = env
-	e.err = err
-}
-
-func newTestEnv() *environment {
-	return &environment{}
-}
-
 type testCase struct {
 	TestName    string
-	Location    *location
-	Environment *environment
+	Location    *storagetest.Location
+	Environment *storagetest.Environment
 	Command     string
 }
 
 var testCases = []testCase{
 	{
 		TestName:    "Make directory and change to it",
-		Location:    &location{"/home", nil},
-		Environment: &environment{[]string{"PATH=/bin:/usr/local/bin", "PWD=/home"}, nil},
+		Location:    storagetest.NewLocation("/home"),
+		Environment: storagetest.NewEnvironment("PATH=/bin:/usr/local/bin", "PWD=/home"),
 		Command:     "mkdir hello;cd /home/hello",
 	},
 	{
 		TestName:    "Go to some system directory",
-		Location:    &location{"/home/hello", nil},
-		Environment: &environment{[]string{"PATH=/bin:/usr/local/bin", "PWD=/home/hello"}, nil},
+		Location:    storagetest.NewLocation("/home/hello"),
+		Environment: storagetest.NewEnvironment("PATH=/bin:/usr/local/bin", "PWD=/home/hello"),
 		Command:     "cd /usr/local",
 	},
 	{
 		TestName:    "Echo a friendly message",
-		Location:    &location{"/", nil},
-		Environment: &environment{[]string{"PATH=/bin:/usr/local/bin", "PWD=/usr/local"}, nil},
+		Location:    storagetest.NewLocation("/"),
+		Environment: storagetest.NewEnvironment("PATH=/bin:/usr/local/bin", "PWD=/usr/local"),
 		Command:     "echo \"hello world\"",
 	},
 }
 
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StorageStreamer {
+		return NewMemoryStore()
+	})
+}
+
 func GrepLocationFilter(matchString string) storage.FilterType {
 	return func(i int, e *storage.Entry) bool {
 		matched, err := regexp.Match(matchString, []byte(e.Location))
@@ -114,8 +82,8 @@ func TestGrepPipe(t *testing.T) {
 	}
 	for _, testCase := range testCases {
 		mod = storage.NewStorageModule(store,
-			storage.SetLocationGetter(&location{testCase.location, nil}),
-			storage.SetEnvironmentGetter(&environment{[]string{}, nil}))
+			storage.SetLocationGetter(storagetest.NewLocation(testCase.location)),
+			storage.SetEnvironmentGetter(storagetest.NewEnvironment()))
 
 		mod.Insert(testCase.command)
 	}
@@ -176,8 +144,8 @@ func TestSomething(t *testing.T) {
 	t.Run("some test", func(t *testing.T) {
 		mod := storage.NewStorageModule(
 			NewMemoryStore(),
-			storage.SetLocationGetter(newTestLocation()),
-			storage.SetEnvironmentGetter(newTestEnv()),
+			storage.SetLocationGetter(storagetest.NewLocation("")),
+			storage.SetEnvironmentGetter(storagetest.NewEnvironment()),
 		)
 
 		mod.Insert("cd /")
@@ -212,3 +180,92 @@ func TestSomething(t *testing.T) {
 		}
 	})
 }
+
+func TestForget(t *testing.T) {
+	store := NewMemoryStore()
+	mod := storage.NewStorageModule(store, storage.SetUndoWindow(time.Hour))
+	for _, command := range []string{"ls", "export TOKEN=secret", "cd /", "echo secret"} {
+		_, err := mod.Insert(command)
+		assert.Nil(t, err)
+	}
+
+	n, err := mod.ForgetMatching(storage.CommandMatches(regexp.MustCompile("secret")))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 2, len(mod.LastEntries(10).Output()))
+
+	tombstones, err := store.(storage.TombstoneEngine).Tombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tombstones))
+	assert.NotNil(t, tombstones[0].Deleted)
+
+	restored, err := mod.Undo(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(restored))
+	entries := mod.LastEntries(10).Output()
+	assert.Equal(t, []int64{1, 2, 3, 4}, storage.Ids(entries))
+
+	assert.Nil(t, mod.Forget([]int64{2}))
+	purged, err := mod.PurgeTombstones(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, purged)
+	purged, err = mod.PurgeTombstones(time.Now().Add(2 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	restored, err = mod.Undo(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(restored))
+
+	// Without an undo window entries are deleted right away, and ids are not reused.
+	hard := storage.NewStorageModule(store)
+	assert.Nil(t, hard.Forget([]int64{1}))
+	e, err := hard.Insert("pwd")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(5), e.Id)
+	assert.Equal(t, []int64{3, 4, 5}, storage.Ids(hard.LastEntries(10).Output()))
+}
+
+func TestPruneHook(t *testing.T) {
+	store := NewMemoryStore()
+	mod := storage.NewStorageModule(store)
+	mod.InsertHooks = append(mod.InsertHooks, mod.PruneHook(storage.RetentionPolicy{MaxCount: 2, Every: 3}))
+
+	for _, command := range []string{"a", "b"} {
+		_, err := mod.Insert(command)
+		assert.Nil(t, err)
+	}
+	pruned, err := mod.Prune(storage.RetentionPolicy{MaxCount: 1}, time.Now(), true)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(pruned))
+	assert.Equal(t, 2, len(mod.LastEntries(10).Output()))
+
+	// The third insert triggers the hook, which keeps only the last two entries.
+	_, err = mod.Insert("c")
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 3}, storage.Ids(mod.LastEntries(10).Output()))
+}
+
+func TestInsertEntries(t *testing.T) {
+	var hooked []string
+	mod := storage.NewStorageModule(NewMemoryStore(), storage.AddInsertHook(func(e *storage.Entry) error {
+		hooked = append(hooked, e.Command)
+		if e.Command == "b" {
+			return fmt.Errorf("hook failed")
+		}
+		return nil
+	}))
+
+	stored, err := mod.InsertEntries([]*storage.Entry{
+		{Command: "a", Host: "laptop"},
+		{Command: "b", Host: "laptop"},
+		{Command: "c", Host: "desktop"},
+	})
+	assert.ErrorIs(t, err, storage.ErrInsertHook)
+	assert.Equal(t, []string{"a", "b", "c"}, storagetest.Commands(stored))
+	assert.Equal(t, []string{"a", "b", "c"}, hooked, "hooks run for every entry")
+	assert.Greater(t, stored[1].Seq, stored[0].Seq, "entries of a host are numbered in order")
+	for _, e := range stored {
+		assert.NotEqual(t, "", e.UUID)
+	}
+	assert.Equal(t, 3, len(mod.LastEntries(10).Output()))
+}
@@ -0,0 +1,203 @@
+package remote
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// queue is a local write-ahead queue of the entries the server has not accepted yet.
+// Every shell appends to the same file, sqlite serialises them.
+//
+// A drain claims the queued entries and sends them without holding the write lock, so
+// shells can queue entries meanwhile. Claims are given up after claimTimeout, in case the
+// process that made them died.
+type queue struct {
+	db *sql.DB
+}
+
+const claimTimeout = 5 * time.Minute
+
+// errDraining is returned while another process sends the queue, entries added meanwhile
+// are queued after it so that the server sees them in order.
+var errDraining = errors.New("the queue is being sent by another process")
+
+func openQueue(path string) (*queue, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	// Immediate transactions take the write lock on BEGIN, so only one shell flushes at a time.
+	db, err := sql.Open("sqlite3", "file:"+path+"?_txlock=immediate&_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(`
+	CREATE TABLE IF NOT EXISTS queued (
+		queued_id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queued_entry TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not create queue: %w", err)
+	}
+	if err = migrateQueue(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not upgrade queue: %w", err)
+	}
+	return &queue{db: db}, nil
+}
+
+// migrateQueue adds the claims to queues created before entries were claimed, the
+// user_version records that it is done.
+func migrateQueue(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var version int
+	if err = tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= 1 {
+		return nil
+	}
+	if _, err = tx.Exec(`ALTER TABLE queued ADD COLUMN queued_claimed INTEGER`); err != nil {
+		return err
+	}
+	if _, err = tx.Exec(`PRAGMA user_version = 1`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// push appends e, its id becomes its position in the queue, negated so that it can't be
+// mistaken for the id of an entry on the server.
+func (q *queue) push(e *storage.Entry) (*storage.Entry, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	r, err := q.db.Exec(`INSERT INTO queued(queued_entry) VALUES (?)`, string(data))
+	if err != nil {
+		return nil, err
+	}
+	queued := &storage.Entry{}
+	e.Copy(queued)
+	queued.Time = e.Time
+	position, err := r.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	queued.Id = -position
+	return queued, nil
+}
+
+func scanQueued(rows *sql.Rows) ([]*storage.Entry, error) {
+	defer rows.Close()
+	var entries []*storage.Entry
+	for rows.Next() {
+		var id int64
+		var data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		e := &storage.Entry{}
+		if err := json.Unmarshal([]byte(data), e); err != nil {
+			return nil, fmt.Errorf("bad queued entry %d: %w", id, err)
+		}
+		e.Id = -id
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// entries lists the queued entries, oldest first.
+func (q *queue) entries() ([]*storage.Entry, error) {
+	rows, err := q.db.Query(`SELECT queued_id, queued_entry FROM queued ORDER BY queued_id ASC`)
+	if err != nil {
+		return nil, err
+	}
+	return scanQueued(rows)
+}
+
+// claim marks every queued entry as being sent at claimed and lists them, oldest first.
+// It fails with errDraining while another process has a claim that has not timed out.
+func (q *queue) claim(claimed time.Time) ([]*storage.Entry, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var draining int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM queued WHERE queued_claimed > ?`,
+		claimed.Add(-claimTimeout).UnixNano()).Scan(&draining)
+	if err != nil {
+		return nil, err
+	}
+	if draining > 0 {
+		return nil, errDraining
+	}
+	if _, err = tx.Exec(`UPDATE queued SET queued_claimed = ?`, claimed.UnixNano()); err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(`SELECT queued_id, queued_entry FROM queued WHERE queued_claimed = ? ORDER BY queued_id ASC`,
+		claimed.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanQueued(rows)
+	if err != nil {
+		return nil, err
+	}
+	return entries, tx.Commit()
+}
+
+// drain sends the queued entries, oldest first, and removes those that send accepted. It
+// stops at the first entry that could not be sent, so that the order is kept. The write
+// lock is only held to claim and remove entries, not while they are sent.
+func (q *queue) drain(send func(e *storage.Entry) error) (int, error) {
+	claimed := time.Now()
+	entries, err := q.claim(claimed)
+	if err != nil {
+		return 0, err
+	}
+	// Whatever is left is sent by the next drain.
+	defer q.db.Exec(`UPDATE queued SET queued_claimed = NULL WHERE queued_claimed = ?`, claimed.UnixNano())
+
+	sent := 0
+	for _, e := range entries {
+		position := -e.Id
+		e.Id = 0
+		if err = send(e); err != nil {
+			return sent, err
+		}
+		if _, err = q.db.Exec(`DELETE FROM queued WHERE queued_id = ?`, position); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// remove drops the queued entries with the provisional ids.
+func (q *queue) remove(ids []int64) error {
+	for _, id := range ids {
+		if _, err := q.db.Exec(`DELETE FROM queued WHERE queued_id = ?`, -id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queue) Close() error {
+	return q.db.Close()
+}
@@ -0,0 +1,411 @@
+// Package remote stores history on a xenophon server, see `xenophon serve`, so that
+// several machines share it.
+//
+// Entries the server can't be reached for are kept in a local sqlite write-ahead queue,
+// stamped with the time they were run, and sent in order before the next insert or
+// query. Until then they have provisional ids, their negated position in the queue, and
+// queries show them after the server's results. Entries are sent at least once, an entry whose
+// response was lost is sent again.
+package remote
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/xenophon/server"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// ErrRejected is returned for entries the server refuses, queueing them would not help.
+var ErrRejected = errors.New("server rejected the entry")
+
+func init() {
+	storage.Register("remote", func(config storage.EngineConfig) (storage.StorageStreamer, error) {
+		address := config.String("url", "")
+		if address == "" {
+			return nil, errors.New("remote: url is not set")
+		}
+		client, err := newClient(config.Duration("timeout", 3*time.Second), config.String("cacert", ""))
+		if err != nil {
+			return nil, err
+		}
+		return NewRemoteStorage(
+			address,
+			config.String("token", ""),
+			config.String("queue", filepath.Join(config.Dir, "remote-queue.db")),
+			client)
+	})
+}
+
+// newClient keeps requests short, a shell should not wait long for an unreachable server.
+// With cacert the server's certificate is verified with that CA, e.g. for a self-signed one.
+func newClient(timeout time.Duration, cacert string) (*http.Client, error) {
+	client := &http.Client{Timeout: timeout}
+	if cacert == "" {
+		return client, nil
+	}
+	pem, err := os.ReadFile(cacert)
+	if err != nil {
+		return nil, fmt.Errorf("remote: could not read cacert: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("remote: no certificates in %s", cacert)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, nil
+}
+
+type remoteStorage struct {
+	base   string
+	token  string
+	client *http.Client
+	queue  *queue
+}
+
+// NewRemoteStorage talks to the server at address, e.g. https://history.example.com:8765,
+// authenticating with token. Entries are queued in the sqlite file at queuePath while the
+// server can't be reached.
+func NewRemoteStorage(address, token, queuePath string, client *http.Client) (storage.StorageStreamer, error) {
+	q, err := openQueue(queuePath)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteStorage{
+		base:   strings.TrimSuffix(address, "/"),
+		token:  token,
+		client: client,
+		queue:  q,
+	}, nil
+}
+
+// do sends a request to the endpoint at path and decodes the response into result.
+func (s *remoteStorage) do(method, path string, values url.Values, body interface{}, result interface{}) error {
+	var data bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&data).Encode(body); err != nil {
+			return err
+		}
+	}
+	address := s.base + path
+	if len(values) > 0 {
+		address += "?" + values.Encode()
+	}
+	req, err := http.NewRequest(method, address, &data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := server.Error{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		err = fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		if resp.StatusCode == http.StatusBadRequest {
+			err = fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (s *remoteStorage) post(e *storage.Entry) (*storage.Entry, error) {
+	stored := &storage.Entry{}
+	if err := s.do(http.MethodPost, server.EntriesPath, nil, e, stored); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// flush sends the queued entries. Entries the server rejects are dropped, or they would
+// block the queue forever.
+func (s *remoteStorage) flush() error {
+	_, err := s.queue.drain(func(e *storage.Entry) error {
+		_, err := s.post(e)
+		if errors.Is(err, ErrRejected) {
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+// Add implements storage.StorageEngine
+func (s *remoteStorage) Add(e *storage.Entry) (*storage.Entry, error) {
+	entry := &storage.Entry{}
+	e.Copy(entry)
+	entry.Env = nil
+	entry.Time = e.Time
+	if entry.Time == nil {
+		t := time.Now()
+		entry.Time = &t
+	}
+
+	// Queued entries go first, otherwise the server would see them out of order.
+	if err := s.flush(); err != nil {
+		return s.queue.push(entry)
+	}
+	stored, err := s.post(entry)
+	if errors.Is(err, ErrRejected) {
+		return nil, err
+	}
+	if err != nil {
+		return s.queue.push(entry)
+	}
+	return stored, nil
+}
+
+// AddBatch implements storage.StorageEngine with one request per entry, entries after
+// one the server rejects are not sent.
+func (s *remoteStorage) AddBatch(entries []*storage.Entry) ([]*storage.Entry, error) {
+	stored := make([]*storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		added, err := s.Add(e)
+		if err != nil {
+			return stored, err
+		}
+		stored = append(stored, added)
+	}
+	return stored, nil
+}
+
+// query fetches the entries that match values from the server, followed by the queued
+// entries that match filter. Without a server only the queued entries are returned, and
+// the results report why the others are missing.
+func (s *remoteStorage) query(values url.Values, filter storage.FilterType, last int) storage.ResultStreamer {
+	s.flush()
+
+	var entries []*storage.Entry
+	readErr := s.do(http.MethodGet, server.EntriesPath, values, nil, &entries)
+	if readErr != nil {
+		entries = nil
+	}
+	queued, err := s.queue.entries()
+	if err != nil && readErr == nil {
+		readErr = fmt.Errorf("could not read queue: %w", err)
+	}
+	entries = append(entries, storage.NewResults(queued).Filter(filter).Output()...)
+	if last >= 0 && len(entries) > last {
+		entries = entries[len(entries)-last:]
+	}
+	if readErr != nil {
+		return storage.IncompleteResults(entries, readErr)
+	}
+	return storage.NewResults(entries)
+}
+
+func all(i int, e *storage.Entry) bool {
+	return true
+}
+
+func (s *remoteStorage) all() storage.ResultStreamer {
+	return s.query(nil, all, -1)
+}
+
+// Output implements storage.ResultStreamer
+func (s *remoteStorage) Output() []*storage.Entry {
+	return s.all().Output()
+}
+
+// Filter implements storage.ResultStreamer
+func (s *remoteStorage) Filter(filter storage.FilterType) storage.ResultStreamer {
+	return s.all().Filter(filter)
+}
+
+// Tag implements storage.ResultStreamer
+func (s *remoteStorage) Tag(name string) storage.ResultStreamer {
+	return s.all().Tag(name)
+}
+
+// Dedup implements storage.ResultStreamer
+func (s *remoteStorage) Dedup(mode storage.DedupMode) storage.ResultStreamer {
+	return s.all().Dedup(mode)
+}
+
+// Asc implements storage.ResultStreamer
+func (s *remoteStorage) Asc() storage.ResultStreamer {
+	return s.all().Asc()
+}
+
+// Desc implements storage.ResultStreamer
+func (s *remoteStorage) Desc() storage.ResultStreamer {
+	return s.all().Desc()
+}
+
+// Limit implements storage.ResultStreamer
+func (s *remoteStorage) Limit(n int) storage.ResultStreamer {
+	return s.all().Limit(n)
+}
+
+// Offset implements storage.ResultStreamer
+func (s *remoteStorage) Offset(n int) storage.ResultStreamer {
+	return s.all().Offset(n)
+}
+
+// After implements storage.ResultStreamer
+func (s *remoteStorage) After(id int64) storage.ResultStreamer {
+	return s.all().After(id)
+}
+
+// Count implements storage.ResultStreamer
+func (s *remoteStorage) Count() int {
+	return s.all().Count()
+}
+
+// CountBy implements storage.ResultStreamer
+func (s *remoteStorage) CountBy(group storage.Grouping) []storage.Counted {
+	return s.all().CountBy(group)
+}
+
+// LastEntries implements storage.ResultStreamer
+func (s *remoteStorage) LastEntries(n int) storage.ResultStreamer {
+	if n <= 0 {
+		return storage.NewResults(nil)
+	}
+	return s.query(url.Values{"last": {strconv.Itoa(n)}}, all, n)
+}
+
+// Period implements storage.ResultStreamer
+func (s *remoteStorage) Period(start time.Time, end time.Time) storage.ResultStreamer {
+	if end.Before(start) {
+		return storage.NewResults(nil)
+	}
+	values := url.Values{
+		"start": {start.Format(time.RFC3339Nano)},
+		"end":   {end.Format(time.RFC3339Nano)},
+	}
+	return s.query(values, func(i int, e *storage.Entry) bool {
+		return e.Time != nil && !e.Time.Before(start) && !e.Time.After(end)
+	}, -1)
+}
+
+// Location implements storage.ResultStreamer
+func (s *remoteStorage) Location(location string) storage.ResultStreamer {
+	return s.query(url.Values{"location": {location}}, func(i int, e *storage.Entry) bool {
+		return string(e.Location) == location
+	}, -1)
+}
+
+// maxIdsPerRequest keeps the URLs of deletes short.
+const maxIdsPerRequest = 200
+
+// deleteIds sends a DELETE to the endpoint at path for every chunk of ids.
+func (s *remoteStorage) deleteIds(path string, ids []int64, values url.Values) error {
+	for start := 0; start < len(ids); start += maxIdsPerRequest {
+		end := start + maxIdsPerRequest
+		if end > len(ids) {
+			end = len(ids)
+		}
+		chunk := url.Values{}
+		for name, value := range values {
+			chunk[name] = value
+		}
+		for _, id := range ids[start:end] {
+			chunk.Add("id", strconv.FormatInt(id, 10))
+		}
+		if err := s.do(http.MethodDelete, path, chunk, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provisional splits ids into the provisional ids of queued entries and the server's ids.
+func provisional(ids []int64) (queued []int64, stored []int64) {
+	for _, id := range ids {
+		if id < 0 {
+			queued = append(queued, id)
+		} else {
+			stored = append(stored, id)
+		}
+	}
+	return queued, stored
+}
+
+// Delete implements storage.StorageEngine, queued entries are taken off the queue.
+func (s *remoteStorage) Delete(ids []int64) error {
+	queued, stored := provisional(ids)
+	if err := s.queue.remove(queued); err != nil {
+		return err
+	}
+	return s.deleteIds(server.EntriesPath, stored, url.Values{"hard": {"true"}})
+}
+
+// DeleteMatching implements storage.StorageEngine
+func (s *remoteStorage) DeleteMatching(filter storage.FilterType) (int, error) {
+	if err := s.flush(); err != nil {
+		return 0, err
+	}
+	ids := storage.Ids(s.LastEntries(math.MaxInt32).Filter(filter).Output())
+	return len(ids), s.Delete(ids)
+}
+
+// Tombstone implements storage.TombstoneEngine, servers without soft-deletes delete the
+// entries. Queued entries were never sent, they are taken off the queue for good.
+func (s *remoteStorage) Tombstone(ids []int64, at time.Time) error {
+	queued, stored := provisional(ids)
+	if err := s.queue.remove(queued); err != nil {
+		return err
+	}
+	if len(stored) == 0 {
+		return nil
+	}
+	return s.do(http.MethodPost, server.TombstonesPath, nil, &server.Tombstone{Ids: stored, At: at}, nil)
+}
+
+// Restore implements storage.TombstoneEngine
+func (s *remoteStorage) Restore(ids []int64) error {
+	return s.deleteIds(server.TombstonesPath, ids, nil)
+}
+
+// Tombstones implements storage.TombstoneEngine
+func (s *remoteStorage) Tombstones() ([]*storage.Entry, error) {
+	var entries []*storage.Entry
+	if err := s.do(http.MethodGet, server.TombstonesPath, nil, nil, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// LastSeq implements storage.SequenceEngine with the queued entries only, asking the
+// server would slow down every insert. The sequence numbers of the others come from the clock.
+func (s *remoteStorage) LastSeq(host storage.HostName) (int64, error) {
+	queued, err := s.queue.entries()
+	if err != nil {
+		return 0, err
+	}
+	var last int64
+	for _, e := range queued {
+		if e.Host == host && e.Seq > last {
+			last = e.Seq
+		}
+	}
+	return last, nil
+}
+
+func (s *remoteStorage) Close() error {
+	return s.queue.Close()
+}
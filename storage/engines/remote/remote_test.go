@@ -0,0 +1,212 @@
+package remote
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/svanellewee/xenophon/server"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+const token = "s3cret"
+
+// flaky serves the API unless it is down.
+type flaky struct {
+	down int32
+	api  http.Handler
+}
+
+func (f *flaky) setDown(down bool) {
+	var v int32
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&f.down, v)
+}
+
+func (f *flaky) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&f.down) == 1 {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+		return
+	}
+	f.api.ServeHTTP(w, r)
+}
+
+// newRemote starts a server on a memory store and opens a remote engine for it.
+func newRemote(t *testing.T) (storage.StorageStreamer, storage.StorageStreamer, *flaky) {
+	central := memory.NewMemoryStore()
+	api := &flaky{api: server.New(storage.NewStorageModule(central), server.WithTokens(token))}
+	ts := httptest.NewTLSServer(api)
+	t.Cleanup(ts.Close)
+
+	s, err := NewRemoteStorage(ts.URL, token, filepath.Join(t.TempDir(), "queue.db"), ts.Client())
+	require.Nil(t, err)
+	return s, central, api
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StorageStreamer {
+		s, _, _ := newRemote(t)
+		return s
+	})
+}
+
+func TestOfflineQueue(t *testing.T) {
+	s, central, api := newRemote(t)
+	defer s.Close()
+	where := storagetest.NewLocation("/src")
+	mod := storage.NewStorageModule(s, storage.SetLocationGetter(where))
+
+	_, err := mod.Insert("git pull")
+	assert.Nil(t, err)
+
+	api.setDown(true)
+	ranAt := time.Now()
+	var provisional []int64
+	for _, command := range []string{"make", "make test", "export TOKEN=secret"} {
+		e, err := mod.Insert(command)
+		assert.Nil(t, err, "inserts succeed while offline")
+		assert.True(t, e.Id < 0, "queued entries have ids the server doesn't hand out")
+		provisional = append(provisional, e.Id)
+	}
+	assert.Equal(t, provisional, storage.Ids(s.LastEntries(10).Output()))
+	assert.Nil(t, mod.Forget(provisional[2:]))
+	assert.Equal(t, []string{"git pull"}, storagetest.Commands(central.LastEntries(10).Output()))
+	assert.Equal(t, []string{"make", "make test"}, storagetest.Commands(s.LastEntries(10).Output()), "queued entries are shown offline")
+	assert.Equal(t, []string{"make test"}, storagetest.Commands(s.LastEntries(1).Output()))
+	assert.Equal(t, []string{"make", "make test"}, storagetest.Commands(s.Location("/src").Output()))
+
+	time.Sleep(10 * time.Millisecond)
+	api.setDown(false)
+	_, err = mod.Insert("git push")
+	assert.Nil(t, err)
+
+	// The queue is sent first, in order, with the time the commands ran.
+	stored := central.LastEntries(10).Output()
+	assert.Equal(t, []string{"git pull", "make", "make test", "git push"}, storagetest.Commands(stored))
+	assert.True(t, stored[1].Time.Before(ranAt.Add(10*time.Millisecond)))
+	assert.True(t, stored[3].Time.After(ranAt.Add(10*time.Millisecond)))
+	queued, err := s.(*remoteStorage).queue.entries()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(queued))
+	assert.Equal(t, []string{"git pull", "make", "make test", "git push"}, storagetest.Commands(s.LastEntries(10).Output()))
+}
+
+func TestEnvironmentIsNotSent(t *testing.T) {
+	s, central, api := newRemote(t)
+	defer s.Close()
+	mod := storage.NewStorageModule(s, storage.SetEnvironmentGetter(storagetest.NewEnvironment("AWS_SECRET_ACCESS_KEY=s3cret")))
+
+	_, err := mod.Insert("ls")
+	assert.Nil(t, err)
+	api.setDown(true)
+	_, err = mod.Insert("pwd")
+	assert.Nil(t, err)
+	queued, err := s.(*remoteStorage).queue.entries()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(queued))
+	assert.Nil(t, queued[0].Env)
+
+	api.setDown(false)
+	for _, e := range s.LastEntries(10).Output() {
+		assert.Nil(t, e.Env)
+	}
+	for _, e := range central.LastEntries(10).Output() {
+		assert.Nil(t, e.Env)
+	}
+}
+
+func TestQueriesFlushTheQueue(t *testing.T) {
+	s, central, api := newRemote(t)
+	defer s.Close()
+
+	api.setDown(true)
+	_, err := storage.NewStorageModule(s).Insert("ls")
+	assert.Nil(t, err)
+	api.setDown(false)
+
+	assert.Equal(t, []string{"ls"}, storagetest.Commands(s.LastEntries(10).Output()))
+	assert.Equal(t, []string{"ls"}, storagetest.Commands(central.LastEntries(10).Output()))
+}
+
+func TestRejectedEntries(t *testing.T) {
+	s, central, _ := newRemote(t)
+	defer s.Close()
+
+	_, err := s.Add(&storage.Entry{Command: " "})
+	assert.ErrorIs(t, err, ErrRejected)
+	queued, err := s.(*remoteStorage).queue.entries()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(queued), "entries the server refuses are not queued")
+	assert.Equal(t, 0, len(central.LastEntries(10).Output()))
+}
+
+func TestUnauthorizedIsQueued(t *testing.T) {
+	s, central, _ := newRemote(t)
+	s.(*remoteStorage).token = "wrong"
+
+	_, err := storage.NewStorageModule(s).Insert("ls")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(central.LastEntries(10).Output()))
+
+	// Once the token is fixed the queued entry is sent.
+	s.(*remoteStorage).token = token
+	assert.Equal(t, []string{"ls"}, storagetest.Commands(s.LastEntries(10).Output()))
+	assert.Equal(t, []string{"ls"}, storagetest.Commands(central.LastEntries(10).Output()))
+}
+
+func TestQueryErrorsAreReported(t *testing.T) {
+	s, _, api := newRemote(t)
+	defer s.Close()
+
+	api.setDown(true)
+	_, err := storage.NewStorageModule(s).Insert("ls")
+	assert.Nil(t, err)
+	results := s.LastEntries(10)
+	assert.Equal(t, []string{"ls"}, storagetest.Commands(results.Output()), "queued entries are shown offline")
+	assert.NotNil(t, storage.Err(results), "but the results are incomplete")
+
+	api.setDown(false)
+	assert.Nil(t, storage.Err(s.LastEntries(10)))
+}
+
+func TestDrainDoesNotBlockPushes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.db")
+	q, err := openQueue(path)
+	require.Nil(t, err)
+	defer q.Close()
+	// Another shell, with the same queue file.
+	other, err := openQueue(path)
+	require.Nil(t, err)
+	defer other.Close()
+
+	for _, command := range []string{"ls", "pwd"} {
+		_, err = q.push(&storage.Entry{Command: command})
+		require.Nil(t, err)
+	}
+	var sent []string
+	n, err := q.drain(func(e *storage.Entry) error {
+		// Sending takes no lock that keeps the other shell from queueing or draining.
+		_, err := other.push(&storage.Entry{Command: "echo " + e.Command})
+		assert.Nil(t, err)
+		_, err = other.drain(func(e *storage.Entry) error { return nil })
+		assert.ErrorIs(t, err, errDraining)
+		sent = append(sent, e.Command)
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"ls", "pwd"}, sent)
+
+	queued, err := q.entries()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"echo ls", "echo pwd"}, storagetest.Commands(queued))
+}
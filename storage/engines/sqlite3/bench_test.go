@@ -0,0 +1,45 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	storage "github.com/svanellewee/xenophon/storage"
+)
+
+const benchEntries = 1000
+
+func benchEntriesOf(n int) []*storage.Entry {
+	now := time.Now()
+	entries := make([]*storage.Entry, n)
+	for i := range entries {
+		entries[i] = &storage.Entry{Command: fmt.Sprintf("command %d", i), Location: "/src", Time: &now}
+	}
+	return entries
+}
+
+func BenchmarkAdd(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		s := NewSqliteStorage(filepath.Join(b.TempDir(), "history.db"))
+		for _, e := range benchEntriesOf(benchEntries) {
+			if _, err := s.Add(e); err != nil {
+				b.Fatal(err)
+			}
+		}
+		s.Close()
+	}
+}
+
+func BenchmarkAddBatch(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		s := NewSqliteStorage(filepath.Join(b.TempDir(), "history.db"))
+		if _, err := s.AddBatch(benchEntriesOf(benchEntries)); err != nil {
+			b.Fatal(err)
+		}
+		s.Close()
+	}
+}
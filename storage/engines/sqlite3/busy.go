@@ -0,0 +1,62 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite "github.com/mattn/go-sqlite3"
+)
+
+// busyTimeout is how long sqlite itself waits for another connection's lock.
+const busyTimeout = 5 * time.Second
+
+const (
+	// maxRetries is how often a write is retried after sqlite gave up waiting.
+	maxRetries = 5
+	// firstBackoff is the wait before the first retry, it doubles with every retry.
+	firstBackoff = 20 * time.Millisecond
+)
+
+// dsn adds the connection settings to fileLocation. Files use WAL, so readers don't block
+// the writer, and transactions take the write lock when they begin, so that two of them
+// can't deadlock upgrading their locks.
+func dsn(fileLocation string) string {
+	params := "_busy_timeout=" + strconv.FormatInt(busyTimeout.Milliseconds(), 10) + "&_txlock=immediate"
+	if !isMemory(fileLocation) {
+		params += "&_journal_mode=WAL&_synchronous=NORMAL"
+	}
+	if strings.Contains(fileLocation, "?") {
+		return fileLocation + "&" + params
+	}
+	return fileLocation + "?" + params
+}
+
+// isMemory reports whether fileLocation is an in-memory database, which exists once per
+// connection.
+func isMemory(fileLocation string) bool {
+	return fileLocation == ":memory:" || strings.Contains(fileLocation, "mode=memory")
+}
+
+// isBusy reports whether err means another connection held a lock for too long.
+func isBusy(err error) bool {
+	var sqliteErr sqlite.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite.ErrBusy || sqliteErr.Code == sqlite.ErrLocked)
+}
+
+// retry runs write again, with exponential backoff and jitter, while the database is busy.
+func retry(write func() error) error {
+	backoff := firstBackoff
+	for attempt := 0; ; attempt++ {
+		err := write()
+		if !isBusy(err) || attempt == maxRetries {
+			return err
+		}
+		time.Sleep(backoff + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+}
@@ -0,0 +1,159 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	sqlite "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	storage "github.com/svanellewee/xenophon/storage"
+)
+
+// stressEnv makes the test binary a writer process for TestConcurrentProcesses.
+const stressEnv = "XENOPHON_SQLITE_STRESS"
+
+const perWriter = 25
+
+// insertAll inserts the writer's entries. It returns the first error instead of failing
+// the test, so that it can run outside the test's goroutine.
+func insertAll(s storage.StorageStreamer, writer string) error {
+	mod := storage.NewStorageModule(s)
+	for i := 0; i < perWriter; i++ {
+		if _, err := mod.Insert(fmt.Sprintf("%s command %d", writer, i)); err != nil {
+			return fmt.Errorf("%s: %w", writer, err)
+		}
+	}
+	return nil
+}
+
+// waitAll waits for the writers and asserts on their errors in the test's goroutine.
+func waitAll(t *testing.T, wg *sync.WaitGroup, errs chan error) {
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+}
+
+// checkNoneLost verifies that every writer's entries were stored exactly once.
+func checkNoneLost(t *testing.T, s storage.StorageStreamer, writers int) {
+	entries := s.LastEntries(writers * perWriter * 2).Output()
+	assert.Equal(t, writers*perWriter, len(entries))
+	commands, ids := map[string]bool{}, map[int64]bool{}
+	for _, e := range entries {
+		assert.False(t, commands[e.Command], "%s stored twice", e.Command)
+		assert.False(t, ids[e.Id], "id %d used twice", e.Id)
+		commands[e.Command], ids[e.Id] = true, true
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	const writers = 10
+
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			// A storage per writer, like a shell per terminal.
+			s := NewSqliteStorage(path)
+			defer s.Close()
+			errs <- insertAll(s, fmt.Sprintf("writer %d", w))
+		}(w)
+	}
+	waitAll(t, &wg, errs)
+
+	s := NewSqliteStorage(path)
+	defer s.Close()
+	checkNoneLost(t, s, writers)
+}
+
+func TestConcurrentProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns processes")
+	}
+	path := filepath.Join(t.TempDir(), "history.db")
+	const writers = 8
+
+	cmds := make([]*exec.Cmd, 0, writers)
+	for w := 0; w < writers; w++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestWriterProcess$")
+		cmd.Env = append(os.Environ(), stressEnv+"="+path, stressEnv+"_WRITER="+strconv.Itoa(w))
+		require.Nil(t, cmd.Start())
+		cmds = append(cmds, cmd)
+	}
+	for _, cmd := range cmds {
+		assert.Nil(t, cmd.Wait())
+	}
+
+	s := NewSqliteStorage(path)
+	defer s.Close()
+	checkNoneLost(t, s, writers)
+}
+
+// TestWriterProcess inserts entries when run by TestConcurrentProcesses.
+func TestWriterProcess(t *testing.T) {
+	path := os.Getenv(stressEnv)
+	if path == "" {
+		t.Skip("only run by TestConcurrentProcesses")
+	}
+	s := NewSqliteStorage(path)
+	defer s.Close()
+	require.Nil(t, insertAll(s, "process "+os.Getenv(stressEnv+"_WRITER")))
+}
+
+func TestConcurrentMemory(t *testing.T) {
+	s := NewSqliteStorage(":memory:")
+	defer s.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			errs <- insertAll(s, fmt.Sprintf("writer %d", w))
+		}(w)
+	}
+	waitAll(t, &wg, errs)
+	checkNoneLost(t, s, 4)
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := retry(func() error {
+		calls++
+		if calls < 3 {
+			return sqlite.Error{Code: sqlite.ErrBusy}
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	calls = 0
+	failed := errors.New("constraint failed")
+	assert.Equal(t, failed, retry(func() error {
+		calls++
+		return failed
+	}))
+	assert.Equal(t, 1, calls, "other errors are not retried")
+
+	calls = 0
+	assert.True(t, isBusy(retry(func() error {
+		calls++
+		return sqlite.Error{Code: sqlite.ErrLocked}
+	})))
+	assert.Equal(t, maxRetries+1, calls)
+}
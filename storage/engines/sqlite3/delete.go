@@ -0,0 +1,114 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	storage "github.com/svanellewee/xenophon/storage"
+)
+
+// maxIdsPerStatement keeps `IN (...)` lists below sqlite's limit on bound parameters.
+const maxIdsPerStatement = 500
+
+// execForIds runs every statement, which must end in `IN`, once per chunk of ids in a
+// single transaction that is retried while the database is busy. leading arguments are
+// bound before the ids.
+func (s *sqliteStorage) execForIds(statements []string, ids []int64, leading ...interface{}) error {
+	return retry(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, statement := range statements {
+			for start := 0; start < len(ids); start += maxIdsPerStatement {
+				end := start + maxIdsPerStatement
+				if end > len(ids) {
+					end = len(ids)
+				}
+				chunk := ids[start:end]
+
+				args := make([]interface{}, 0, len(leading)+len(chunk))
+				args = append(args, leading...)
+				for _, id := range chunk {
+					args = append(args, id)
+				}
+				placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(chunk)), ", ")
+				if _, err = tx.Exec(statement+` (`+placeholders+`)`, args...); err != nil {
+					tx.Rollback()
+					return err
+				}
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// byIds reads the entries with ids, tombstones too, ordered by id.
+func (s *sqliteStorage) byIds(ids []int64) ([]*storage.Entry, error) {
+	results := make([]*storage.Entry, 0, len(ids))
+	for start := 0; start < len(ids); start += maxIdsPerStatement {
+		end := start + maxIdsPerStatement
+		if end > len(ids) {
+			end = len(ids)
+		}
+		args := make([]interface{}, 0, end-start)
+		for _, id := range ids[start:end] {
+			args = append(args, id)
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", end-start), ", ")
+		rows, err := s.db.Query(`SELECT `+entryColumns+` FROM entry WHERE entry_id IN (`+placeholders+`) ORDER BY entry_id ASC`, args...)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := scanEntries(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, entries...)
+	}
+	return results, nil
+}
+
+// Delete implements storage.StorageEngine
+func (s *sqliteStorage) Delete(ids []int64) error {
+	return s.execForIds([]string{
+		`DELETE FROM tag WHERE tag_entry_id IN`,
+		`DELETE FROM entry WHERE entry_id IN`,
+	}, ids)
+}
+
+// DeleteMatching implements storage.StorageEngine
+func (s *sqliteStorage) DeleteMatching(filter storage.FilterType) (int, error) {
+	ids := storage.Ids(s.LastEntries(math.MaxInt32).Filter(filter).Output())
+	return len(ids), s.Delete(ids)
+}
+
+// Tombstone implements storage.TombstoneEngine
+func (s *sqliteStorage) Tombstone(ids []int64, at time.Time) error {
+	return s.execForIds([]string{`UPDATE entry SET entry_deleted = ? WHERE entry_deleted IS NULL AND entry_id IN`}, ids, at.Unix())
+}
+
+// Restore implements storage.TombstoneEngine
+func (s *sqliteStorage) Restore(ids []int64) error {
+	return s.execForIds([]string{`UPDATE entry SET entry_deleted = NULL WHERE entry_id IN`}, ids)
+}
+
+// Tombstones implements storage.TombstoneEngine
+func (s *sqliteStorage) Tombstones() ([]*storage.Entry, error) {
+	query := `
+	SELECT ` + entryColumns + `
+	FROM entry
+	WHERE entry_deleted IS NOT NULL
+	ORDER BY entry_id ASC
+	`
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanEntries(rows)
+}
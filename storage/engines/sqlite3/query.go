@@ -0,0 +1,132 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"sync"
+
+	sqlite "github.com/mattn/go-sqlite3"
+	storage "github.com/svanellewee/xenophon/storage"
+)
+
+// driverName is the go-sqlite3 driver with a REGEXP function, which sqlite leaves undefined.
+const driverName = "sqlite3_xenophon"
+
+func init() {
+	sql.Register(driverName, &sqlite.SQLiteDriver{
+		ConnectHook: func(conn *sqlite.SQLiteConn) error {
+			return conn.RegisterFunc("regexp", regexpMatch, true)
+		},
+	})
+}
+
+// patterns caches the compiled patterns of REGEXP, which is called once per row.
+var patterns sync.Map
+
+// regexpMatch implements `value REGEXP pattern` with Go's regular expressions, so that
+// queries match the same entries as storage.Cond.Filter.
+func regexpMatch(pattern, value string) (bool, error) {
+	re, ok := patterns.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		re, _ = patterns.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(value), nil
+}
+
+// textColumns are the columns of the fields compared as text.
+var textColumns = map[string]string{
+	storage.FieldCommand: "entry_command",
+	storage.FieldDir:     "entry_location",
+	storage.FieldHost:    "entry_host",
+	storage.FieldSession: "entry_session",
+}
+
+// sqlOps are the SQL comparisons of the query operators.
+var sqlOps = map[string]string{
+	storage.OpIs: "=",
+	storage.OpEq: "=",
+	storage.OpNe: "!=",
+	storage.OpLt: "<",
+	storage.OpLe: "<=",
+	storage.OpGt: ">",
+	storage.OpGe: ">=",
+}
+
+// queryWhere translates a query expression into a WHERE clause and its arguments.
+// Conditions on exit codes are false for entries without one, as in Go, so that NOT
+// inverts them the same way.
+func queryWhere(expr storage.Expr) (string, []interface{}, error) {
+	switch e := expr.(type) {
+	case *storage.And:
+		return binaryWhere("AND", e.Left, e.Right)
+	case *storage.Or:
+		return binaryWhere("OR", e.Left, e.Right)
+	case *storage.Not:
+		where, args, err := queryWhere(e.Expr)
+		return "NOT " + where, args, err
+	case *storage.Cond:
+		return condWhere(e)
+	default:
+		return "", nil, fmt.Errorf("unknown query expression %T", expr)
+	}
+}
+
+func binaryWhere(op string, left, right storage.Expr) (string, []interface{}, error) {
+	l, args, err := queryWhere(left)
+	if err != nil {
+		return "", nil, err
+	}
+	r, rightArgs, err := queryWhere(right)
+	if err != nil {
+		return "", nil, err
+	}
+	return "(" + l + " " + op + " " + r + ")", append(args, rightArgs...), nil
+}
+
+func condWhere(c *storage.Cond) (string, []interface{}, error) {
+	switch {
+	case c.Field == storage.FieldSince:
+		return "(entry_time >= ?)", []interface{}{c.Time.Unix()}, nil
+	case c.Field == storage.FieldUntil:
+		return "(entry_time < ?)", []interface{}{c.Time.Unix() + 1}, nil
+	case c.Field == storage.FieldExit:
+		return "(entry_exit IS NOT NULL AND entry_exit " + sqlOps[c.Op] + " ?)", []interface{}{c.Number}, nil
+	}
+
+	column, ok := textColumns[c.Field]
+	if !ok {
+		return "", nil, fmt.Errorf("unknown query field %q", c.Field)
+	}
+	switch {
+	case c.Under != "":
+		where, args := underLocation(c.Under)
+		return where, args, nil
+	case c.Pattern != nil && c.Op == storage.OpNotMatch:
+		return "NOT (" + column + " REGEXP ?)", []interface{}{c.Pattern.String()}, nil
+	case c.Pattern != nil:
+		return "(" + column + " REGEXP ?)", []interface{}{c.Pattern.String()}, nil
+	case c.Field == storage.FieldCommand && c.Op == storage.OpIs:
+		return "(instr(" + column + ", ?) > 0)", []interface{}{c.Value}, nil
+	default:
+		return "(" + column + " " + sqlOps[c.Op] + " ?)", []interface{}{c.Value}, nil
+	}
+}
+
+// Query implements storage.QueryEngine
+func (s *sqliteStorage) Query(q *storage.Query) (storage.ResultStreamer, error) {
+	if q.Expr == nil {
+		return s.all(), nil
+	}
+	where, args, err := queryWhere(q.Expr)
+	if err != nil {
+		return nil, err
+	}
+	return s.all().where(where, byId, args...), nil
+}
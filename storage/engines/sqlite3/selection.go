@@ -0,0 +1,250 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	storage "github.com/svanellewee/xenophon/storage"
+)
+
+// Orders of selections, ascending and descending.
+var (
+	byId   = []string{"entry_id"}
+	byTime = []string{"entry_time", "entry_id"}
+)
+
+// selection is a chain of ResultStreamer calls compiled into a single query, which runs
+// on Output. Every step selects from the previous one as a subquery, so that steps apply
+// to the results before them, e.g. Location of LastEntries picks among the last entries.
+// The entry_count column carries Entry.Count, it is NULL until entries are deduplicated.
+// Desc reverses the order of the selection and of the steps after it.
+type selection struct {
+	db    *sql.DB
+	from  string
+	args  []interface{}
+	order []string
+	desc  bool
+	// err is why the last Output failed.
+	err error
+}
+
+// all selects the live entries.
+func (s *sqliteStorage) all() *selection {
+	return &selection{
+		db:    s.db,
+		from:  `SELECT ` + entryColumns + `, NULL AS entry_count FROM entry WHERE entry_deleted IS NULL`,
+		order: byId,
+	}
+}
+
+// orderBy lists the columns of order, descending if desc is set.
+func orderBy(order []string, desc bool) string {
+	direction := " ASC"
+	if desc {
+		direction = " DESC"
+	}
+	return strings.Join(order, direction+", ") + direction
+}
+
+// then selects from s with query, in which %s is the subquery of s.
+func (s *selection) then(query string, order []string, args ...interface{}) *selection {
+	return &selection{
+		db:    s.db,
+		from:  strings.Replace(query, "%s", "("+s.from+")", 1),
+		args:  append(append([]interface{}{}, s.args...), args...),
+		order: order,
+		desc:  s.desc,
+	}
+}
+
+// where selects the entries of s that match clause.
+func (s *selection) where(clause string, order []string, args ...interface{}) *selection {
+	return s.then(`SELECT * FROM %s WHERE `+clause, order, args...)
+}
+
+// LastEntries implements storage.ResultStreamer
+func (s *selection) LastEntries(n int) storage.ResultStreamer {
+	return s.then(`SELECT * FROM %s ORDER BY `+orderBy(byTime, true)+` LIMIT ?`, byId, n)
+}
+
+// Period implements storage.ResultStreamer
+func (s *selection) Period(start time.Time, end time.Time) storage.ResultStreamer {
+	return s.where(`entry_time >= ? AND entry_time <= ?`, byTime, start.UnixMilli()/1000, end.UnixMilli()/1000)
+}
+
+// Location implements storage.ResultStreamer
+func (s *selection) Location(location string) storage.ResultStreamer {
+	return s.where(`entry_location = ?`, byTime, location)
+}
+
+// Tag implements storage.ResultStreamer
+func (s *selection) Tag(name string) storage.ResultStreamer {
+	return s.where(`entry_id IN (SELECT tag_entry_id FROM tag WHERE tag_name = ?)`, s.order, name)
+}
+
+// Filter implements storage.ResultStreamer, filters run in Go on the selected entries.
+func (s *selection) Filter(filter storage.FilterType) storage.ResultStreamer {
+	if s.desc {
+		asc := s.Asc()
+		entries := asc.Output()
+		return storage.IncompleteResults(entries, storage.Err(asc)).Desc().Filter(filter)
+	}
+	entries := s.Output()
+	return storage.IncompleteResults(entries, s.err).Filter(filter)
+}
+
+// Dedup implements storage.ResultStreamer with window functions, like storage.Dedup.
+func (s *selection) Dedup(mode storage.DedupMode) storage.ResultStreamer {
+	ascending, descending := orderBy(s.order, false), orderBy(s.order, true)
+	switch mode {
+	case storage.DedupConsecutive:
+		// A run starts wherever the command changes, the runs are numbered by summing the
+		// starts and the last entry of every run is kept.
+		return s.then(`
+		SELECT `+entryColumns+`, run_count AS entry_count FROM (
+			SELECT *,
+				SUM(IFNULL(entry_count, 1)) OVER (PARTITION BY run) AS run_count,
+				ROW_NUMBER() OVER (PARTITION BY run ORDER BY position DESC) AS run_rank
+			FROM (
+				SELECT *, SUM(starts) OVER (ORDER BY position) AS run FROM (
+					SELECT *,
+						ROW_NUMBER() OVER (ORDER BY `+ascending+`) AS position,
+						entry_command IS NOT LAG(entry_command) OVER (ORDER BY `+ascending+`) AS starts
+					FROM %s
+				)
+			)
+		) WHERE run_rank = 1`, s.order)
+	case storage.DedupUnique:
+		return s.then(`
+		SELECT `+entryColumns+`, command_count AS entry_count FROM (
+			SELECT *,
+				SUM(IFNULL(entry_count, 1)) OVER (PARTITION BY entry_command) AS command_count,
+				ROW_NUMBER() OVER (PARTITION BY entry_command ORDER BY `+descending+`) AS recency
+			FROM %s
+		) WHERE recency = 1`, s.order)
+	default:
+		return s
+	}
+}
+
+// Asc implements storage.ResultStreamer
+func (s *selection) Asc() storage.ResultStreamer {
+	asc := *s
+	asc.desc = false
+	return &asc
+}
+
+// Desc implements storage.ResultStreamer
+func (s *selection) Desc() storage.ResultStreamer {
+	desc := *s
+	desc.desc = true
+	return &desc
+}
+
+// Limit implements storage.ResultStreamer
+func (s *selection) Limit(n int) storage.ResultStreamer {
+	if n < 0 {
+		// A negative LIMIT is no limit to sqlite.
+		n = 0
+	}
+	return s.then(`SELECT * FROM %s ORDER BY `+orderBy(s.order, s.desc)+` LIMIT ?`, s.order, n)
+}
+
+// Offset implements storage.ResultStreamer
+func (s *selection) Offset(n int) storage.ResultStreamer {
+	if n < 0 {
+		n = 0
+	}
+	return s.then(`SELECT * FROM %s ORDER BY `+orderBy(s.order, s.desc)+` LIMIT -1 OFFSET ?`, s.order, n)
+}
+
+// After implements storage.ResultStreamer by comparing the columns of the order with
+// those of the entry, so that it uses the indexes instead of counting rows like Offset.
+// Ids are compared once the entry was deleted for good, like the memory engine does.
+func (s *selection) After(id int64) storage.ResultStreamer {
+	op := ">"
+	if s.desc {
+		op = "<"
+	}
+	if len(s.order) == 1 {
+		return s.where(`entry_id `+op+` ?`, s.order, id)
+	}
+	columns := strings.Join(s.order, ", ")
+	return s.where(`CASE WHEN EXISTS (SELECT 1 FROM entry WHERE entry_id = ?)
+		THEN (`+columns+`) `+op+` (SELECT `+columns+` FROM entry WHERE entry_id = ?)
+		ELSE entry_id `+op+` ? END`, s.order, id, id, id)
+}
+
+// Count implements storage.ResultStreamer
+func (s *selection) Count() int {
+	var count int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM (`+s.from+`)`, s.args...).Scan(&count); err != nil {
+		return 0
+	}
+	return count
+}
+
+// groupExprs are the SQL equivalents of storage.Grouping.Key.
+var groupExprs = map[storage.Grouping]string{
+	storage.GroupCommand:  `entry_command`,
+	storage.GroupLocation: `entry_location`,
+	storage.GroupDay:      `date(entry_time, 'unixepoch', 'localtime')`,
+}
+
+// CountBy implements storage.ResultStreamer, ordered like storage.CountBy.
+func (s *selection) CountBy(group storage.Grouping) []storage.Counted {
+	rows, err := s.db.Query(`
+	SELECT `+groupExprs[group]+` AS counted_key, COUNT(*) AS counted
+	FROM (`+s.from+`)
+	GROUP BY counted_key
+	ORDER BY counted DESC, counted_key ASC`, s.args...)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	results := make([]storage.Counted, 0, storage.DefaultCapacity)
+	for rows.Next() {
+		var c storage.Counted
+		if err = rows.Scan(&c.Key, &c.Count); err != nil {
+			return nil
+		}
+		results = append(results, c)
+	}
+	if rows.Err() != nil {
+		return nil
+	}
+	return results
+}
+
+// Output implements storage.ResultStreamer, without entries if the query fails.
+func (s *selection) Output() []*storage.Entry {
+	rows, err := s.db.Query(`SELECT *, `+tagsColumn+` FROM (`+s.from+`) ORDER BY `+orderBy(s.order, s.desc), s.args...)
+	if s.err = err; err != nil {
+		return nil
+	}
+	defer rows.Close()
+	results := make([]*storage.Entry, 0, storage.DefaultCapacity)
+	for rows.Next() {
+		var count sql.NullInt64
+		var tags sql.NullString
+		e, err := scanEntry(rows, &count, &tags)
+		if s.err = err; err != nil {
+			return nil
+		}
+		e.Count = int(count.Int64)
+		e.Tags = splitTags(tags)
+		results = append(results, e)
+	}
+	if s.err = rows.Err(); s.err != nil {
+		return nil
+	}
+	return results
+}
+
+// Err reports why the last Output failed, see storage.Err.
+func (s *selection) Err() error {
+	return s.err
+}
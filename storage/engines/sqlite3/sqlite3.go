@@ -1,7 +1,11 @@
+//go:build cgo
+
 package sqlite3
 
 import (
 	"database/sql"
+	"fmt"
+	"path/filepath"
 	"time"
 
 	storage "github.com/svanellewee/xenophon/storage"
@@ -10,141 +14,341 @@ import (
 )
 
 type sqliteStorage struct {
-	db      *sql.DB
-	entries []*storage.Entry
-	err     error
+	db  *sql.DB
+	err error
 }
 
 // Filter implements storage.StorageStreamer
-func (sq *sqliteStorage) Filter(filter storage.FilterType) storage.ResultStreamer {
-	var err error
-	results := make([]*storage.Entry, 0, storage.DefaultCapacity)
-	for i, entry := range sq.entries {
-		if filter(i, entry) {
-			results = append(results, entry)
-		}
-	}
-	return &sqliteStorage{
-		db:      sq.db,
-		entries: results,
-		err:     err,
-	}
+func (s *sqliteStorage) Filter(filter storage.FilterType) storage.ResultStreamer {
+	return s.all().Filter(filter)
+}
+
+// Tag implements storage.StorageStreamer
+func (s *sqliteStorage) Tag(name string) storage.ResultStreamer {
+	return s.all().Tag(name)
+}
+
+// Dedup implements storage.StorageStreamer
+func (s *sqliteStorage) Dedup(mode storage.DedupMode) storage.ResultStreamer {
+	return s.all().Dedup(mode)
+}
+
+// Asc implements storage.StorageStreamer
+func (s *sqliteStorage) Asc() storage.ResultStreamer {
+	return s.all().Asc()
+}
+
+// Desc implements storage.StorageStreamer
+func (s *sqliteStorage) Desc() storage.ResultStreamer {
+	return s.all().Desc()
+}
+
+// Limit implements storage.StorageStreamer
+func (s *sqliteStorage) Limit(n int) storage.ResultStreamer {
+	return s.all().Limit(n)
+}
+
+// Offset implements storage.StorageStreamer
+func (s *sqliteStorage) Offset(n int) storage.ResultStreamer {
+	return s.all().Offset(n)
+}
+
+// After implements storage.StorageStreamer
+func (s *sqliteStorage) After(id int64) storage.ResultStreamer {
+	return s.all().After(id)
+}
+
+// Count implements storage.StorageStreamer
+func (s *sqliteStorage) Count() int {
+	return s.all().Count()
+}
+
+// CountBy implements storage.StorageStreamer
+func (s *sqliteStorage) CountBy(group storage.Grouping) []storage.Counted {
+	return s.all().CountBy(group)
 }
 
 // Output implements storage.StorageStreamer
-func (db *sqliteStorage) Output() []*storage.Entry {
-	return db.entries
+func (s *sqliteStorage) Output() []*storage.Entry {
+	return s.all().Output()
 }
 
-// Add implements StorageEngine
+// entryColumns are selected, in order, by every query that is read with scanEntry.
+const entryColumns = `entry_id, entry_command, entry_location, entry_time, entry_session, entry_host, entry_exit, entry_deleted, entry_uuid, entry_seq, entry_note`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanEntry reads the entryColumns of row, and any columns after them into extra.
+func scanEntry(row scanner, extra ...interface{}) (*storage.Entry, error) {
+	e := &storage.Entry{}
+	var session, host string
+	var exit, seq sql.NullInt64
+	var uuid, note sql.NullString
+	dest := append([]interface{}{&e.Id, &e.Command, &e.Location, &e.Time, &session, &host, &exit, &e.Deleted, &uuid, &seq, &note}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	e.Session = storage.SessionID(session)
+	e.Host = storage.HostName(host)
+	if exit.Valid {
+		code := int(exit.Int64)
+		e.ExitCode = &code
+	}
+	e.UUID = uuid.String
+	e.Seq = seq.Int64
+	e.Note = note.String
+	return e, nil
+}
+
+// Add implements StorageEngine, the entry and its tags are inserted together.
 func (s *sqliteStorage) Add(e *storage.Entry) (*storage.Entry, error) {
-	insertQuery := `
-	INSERT INTO entry(entry_command, entry_location)
-	VALUES (?, ?)
-	`
-	r, err := s.db.Exec(insertQuery, e.Command, e.Location)
+	stored, err := s.AddBatch([]*storage.Entry{e})
 	if err != nil {
 		return nil, err
 	}
+	if len(stored) == 0 {
+		// Deleted by another shell right away.
+		return nil, storage.ErrNotFound
+	}
+	return stored[0], nil
+}
 
-	id, err := r.LastInsertId()
+// AddBatch implements storage.StorageEngine with a prepared statement in one transaction,
+// which is retried as a whole while the database is busy.
+func (s *sqliteStorage) AddBatch(entries []*storage.Entry) ([]*storage.Entry, error) {
+	if len(entries) == 0 {
+		return []*storage.Entry{}, nil
+	}
+	var ids []int64
+	err := retry(func() error {
+		ids = make([]int64, 0, len(entries))
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(`
+		INSERT INTO entry(entry_command, entry_location, entry_time, entry_session, entry_host, entry_exit, entry_uuid, entry_seq, entry_note)
+		VALUES (?, ?, COALESCE(?, strftime('%s','now')), ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''))
+		`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, e := range entries {
+			var at interface{}
+			if e.Time != nil {
+				at = e.Time.Unix()
+			}
+			r, err := stmt.Exec(e.Command, e.Location, at, e.Session, e.Host, e.ExitCode, e.UUID, e.Seq, e.Note)
+			if err != nil {
+				return err
+			}
+			id, err := r.LastInsertId()
+			if err != nil {
+				return err
+			}
+			if err = insertTags(tx, id, e.Tags); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		return tx.Commit()
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	query := `
-	SELECT entry_id, entry_command, entry_location, entry_time
-	FROM entry WHERE entry_id = ?
-	`
-	row := s.db.QueryRow(query, id)
-
-	entryResult := &storage.Entry{}
-	err = row.Scan(&entryResult.Id, &entryResult.Command, &entryResult.Location, &entryResult.Time)
+	stored, err := s.byIds(ids)
 	if err != nil {
 		return nil, err
 	}
-	return entryResult, nil
+	for i, e := range stored {
+		if i < len(entries) && len(entries[i].Tags) > 0 {
+			e.Tags = storage.MergeTags(entries[i].Tags, nil)
+		}
+	}
+	return stored, nil
+}
+
+// Import implements storage.ImportEngine, AUTOINCREMENT numbers later entries after them.
+// The transaction is retried as a whole while the database is busy.
+func (s *sqliteStorage) Import(entries []*storage.Entry) error {
+	return retry(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(`
+		INSERT INTO entry(entry_id, entry_command, entry_location, entry_time, entry_session, entry_host, entry_exit, entry_uuid, entry_seq, entry_note)
+		VALUES (?, ?, ?, COALESCE(?, strftime('%s','now')), ?, ?, ?, NULLIF(?, ''), NULLIF(?, 0), NULLIF(?, ''))
+		`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, e := range entries {
+			var at interface{}
+			if e.Time != nil {
+				at = e.Time.Unix()
+			}
+			if _, err = stmt.Exec(e.Id, e.Command, e.Location, at, e.Session, e.Host, e.ExitCode, e.UUID, e.Seq, e.Note); err != nil {
+				return err
+			}
+			if err = insertTags(tx, e.Id, e.Tags); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// Update implements storage.UpdateEngine, the environment is not stored. The transaction
+// is retried as a whole while the database is busy.
+func (s *sqliteStorage) Update(entries []*storage.Entry) error {
+	return retry(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		stmt, err := tx.Prepare(`UPDATE entry SET entry_command = ?, entry_note = NULLIF(?, '') WHERE entry_id = ?`)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+		for _, e := range entries {
+			if _, err = stmt.Exec(e.Command, e.Note, e.Id); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
+
+// SetNote implements storage.NoteEngine
+func (s *sqliteStorage) SetNote(id int64, note string) error {
+	if err := s.exists(id); err != nil {
+		return err
+	}
+	return retry(func() error {
+		_, err := s.db.Exec(`UPDATE entry SET entry_note = NULLIF(?, '') WHERE entry_id = ?`, note, id)
+		return err
+	})
+}
+
+// LastSeq implements storage.SequenceEngine, tombstones count too.
+func (s *sqliteStorage) LastSeq(host storage.HostName) (int64, error) {
+	var seq sql.NullInt64
+	err := s.db.QueryRow(`SELECT MAX(entry_seq) FROM entry WHERE entry_host = ?`, host).Scan(&seq)
+	return seq.Int64, err
 }
 
-func resultsFromRows(db *sql.DB, rows *sql.Rows, err error) storage.ResultStreamer {
+func scanEntries(rows *sql.Rows) ([]*storage.Entry, error) {
 	results := make([]*storage.Entry, 0, storage.DefaultCapacity)
 	for rows.Next() {
-		e := &storage.Entry{}
-		if err = rows.Scan(&e.Id, &e.Command, &e.Location, &e.Time); err != nil {
-			return nil
+		e, err := scanEntry(rows)
+		if err != nil {
+			return nil, err
 		}
 		results = append(results, e)
 	}
-	if err = rows.Err(); err != nil {
-		return nil
-	}
-	return &sqliteStorage{
-		db:      db,
-		entries: results,
-		err:     err,
-	}
+	return results, rows.Err()
 }
 
-// ForTime implements StorageEngine
+// Period implements storage.ResultStreamer
 func (s *sqliteStorage) Period(start time.Time, end time.Time) storage.ResultStreamer {
-	query := `
-	SELECT entry_id, entry_command, entry_location, entry_time
-	FROM entry
-	WHERE entry_time >= ? AND entry_time <= ?
-	ORDER BY entry_time ASC
-	`
-	rows, err := s.db.Query(query, start.UnixMilli()/1000, end.UnixMilli()/1000)
-	if err != nil {
-		return nil
-	}
-	defer rows.Close()
-	return resultsFromRows(s.db, rows, err)
+	return s.all().Period(start, end)
 }
 
-// ForLocation finds all entries of the specified Location
+// Location implements storage.ResultStreamer
 func (s *sqliteStorage) Location(location string) storage.ResultStreamer {
-	query := `
-	SELECT entry_id, entry_command, entry_location, entry_time
-	FROM entry
-	WHERE entry_location = ?
-	ORDER BY entry_time ASC
-	`
-	rows, err := s.db.Query(query, location)
-	if err != nil {
-		return nil
-	}
-	defer rows.Close()
-	return resultsFromRows(s.db, rows, err)
+	return s.all().Location(location)
 }
 
-// LastN implements StorageEngine
+// LastEntries implements storage.ResultStreamer
 func (s *sqliteStorage) LastEntries(n int) storage.ResultStreamer {
-	query := `
-	WITH bw_results AS (
-		SELECT * 
-		FROM entry
-		ORDER BY entry_time DESC
-		LIMIT ?
-	) 
-	SELECT entry_id, entry_command, entry_location, entry_time
-	FROM bw_results ORDER BY bw_results.entry_id ASC;
-	`
-	rows, err := s.db.Query(query, n)
-	if err != nil {
-		return nil
-	}
-	defer rows.Close()
-	return resultsFromRows(s.db, rows, err)
+	return s.all().LastEntries(n)
 }
 
 func (s *sqliteStorage) Close() error {
 	return s.db.Close()
 }
 
-func NewSqliteStorage(fileLocation string) storage.StorageStreamer {
-	db, err := sql.Open("sqlite3", fileLocation)
+// migrations upgrade the schema created by NewSqliteStorage, the database's user_version
+// records how many of them have been applied. Only ever append to this list.
+var migrations = []string{
+	`ALTER TABLE entry ADD COLUMN entry_session VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE entry ADD COLUMN entry_host VARCHAR NOT NULL DEFAULT ''`,
+	`ALTER TABLE entry ADD COLUMN entry_exit INTEGER`,
+	`ALTER TABLE entry ADD COLUMN entry_deleted TIMESTAMP`,
+	`ALTER TABLE entry ADD COLUMN entry_uuid VARCHAR`,
+	`ALTER TABLE entry ADD COLUMN entry_seq INTEGER`,
+	`CREATE INDEX IF NOT EXISTS entry_host_seq_index ON entry (entry_host, entry_seq)`,
+	`CREATE TABLE IF NOT EXISTS tag (
+		tag_entry_id INTEGER NOT NULL,
+		tag_name VARCHAR NOT NULL,
+		PRIMARY KEY (tag_entry_id, tag_name)
+	)`,
+	`CREATE INDEX IF NOT EXISTS tag_name_index ON tag (tag_name)`,
+	`ALTER TABLE entry ADD COLUMN entry_note VARCHAR`,
+}
+
+// migrate applies one migration per transaction. The version is read inside it, so that
+// shells opening the database at the same time don't apply a migration twice.
+func migrate(db *sql.DB) error {
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		var version int
+		if err = tx.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if version >= len(migrations) {
+			return tx.Rollback()
+		}
+		if _, err = tx.Exec(migrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d failed: %w", version+1, err)
+		}
+		if _, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+}
+
+func init() {
+	storage.Register("sqlite3", func(config storage.EngineConfig) (storage.StorageStreamer, error) {
+		s, err := open(config.String("path", filepath.Join(config.Dir, "history.db")))
+		if err != nil {
+			if s != nil {
+				s.Close()
+			}
+			return nil, err
+		}
+		return s, nil
+	})
+}
+
+// open creates the database at fileLocation if needed and migrates its schema. If that
+// fails the storage is still returned, with the error recorded.
+func open(fileLocation string) (*sqliteStorage, error) {
+	db, err := sql.Open(driverName, dsn(fileLocation))
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	if isMemory(fileLocation) {
+		// Every connection would see its own, empty, database.
+		db.SetMaxOpenConns(1)
 	}
 
 	creationStatement := `
@@ -156,10 +360,23 @@ func NewSqliteStorage(fileLocation string) storage.StorageStreamer {
 	);
 	CREATE INDEX IF NOT EXISTS entry_location_index ON entry (entry_location);
 	`
-	_, err = db.Exec(creationStatement)
+	// Writers opening a new database together create and migrate it at once.
+	err = retry(func() error {
+		if _, err := db.Exec(creationStatement); err != nil {
+			return err
+		}
+		return migrate(db)
+	})
 	return &sqliteStorage{
-		db:      db,
-		entries: make([]*storage.Entry, 0, storage.DefaultCapacity),
-		err:     err,
+		db:  db,
+		err: err,
+	}, err
+}
+
+func NewSqliteStorage(fileLocation string) storage.StorageStreamer {
+	s, err := open(fileLocation)
+	if s == nil {
+		panic(err)
 	}
+	return s
 }
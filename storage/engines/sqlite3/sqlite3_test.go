@@ -1,14 +1,25 @@
+//go:build cgo
+
 package sqlite3
 
 import (
 	"fmt"
+	"path/filepath"
+	"regexp"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	storage "github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/storagetest"
 )
 
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.StorageStreamer {
+		return NewSqliteStorage(filepath.Join(t.TempDir(), "history.db"))
+	})
+}
+
 func TestSqlite(t *testing.T) {
 	sqliteDB := NewSqliteStorage(":memory:")
 
@@ -67,45 +78,6 @@ func TestSqlite(t *testing.T) {
 	}
 }
 
-type location struct {
-	where string
-	err   error
-}
-
-func newTestLocation() *location {
-	return &location{}
-}
-
-func (l *location) Set(where string, err error) {
-	l.where = where
-	l.err = err
-}
-
-func (l *location) Get() (storage.LocationPath, error) {
-	if l.err != nil {
-		return "", l.err
-	}
-	return storage.LocationPath(l.where), nil
-}
-
-type environment struct {
-	env []string
-	err error
-}
-
-func (e *environment) Get() (storage.Environment, error) {
-	return e.env, nil
-}
-
-func (e *environment) Set(env []string, err error) {
-	e.env = env
-	e.err = err
-}
-
-func newTestEnv() *environment {
-	return &environment{}
-}
-
 func TestLocationFind(t *testing.T) {
 	sqliteDB := NewSqliteStorage(":memory:")
 
@@ -125,8 +97,8 @@ func TestLocationFind(t *testing.T) {
 	}
 	for _, testCase := range testCases {
 		mod = storage.NewStorageModule(sqliteDB,
-			storage.SetLocationGetter(&location{testCase.location, nil}),
-			storage.SetEnvironmentGetter(&environment{[]string{}, nil}))
+			storage.SetLocationGetter(storagetest.NewLocation(testCase.location)),
+			storage.SetEnvironmentGetter(storagetest.NewEnvironment()))
 
 		mod.Insert(testCase.command)
 	}
@@ -138,3 +110,58 @@ func TestLocationFind(t *testing.T) {
 		fmt.Println("Location found ->", e)
 	}
 }
+
+func TestSessionSurvivesReopen(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "history.db")
+	sqliteDB := NewSqliteStorage(dbFile)
+	mod := storage.NewStorageModule(sqliteDB, storage.SetSessionGetter(storagetest.NewSession("tty1")))
+	e, err := mod.Insert("ls")
+	assert.Nil(t, err)
+	assert.Equal(t, storage.SessionID("tty1"), e.Session)
+	assert.Nil(t, sqliteDB.Close())
+
+	// Reopening must not re-run migrations that were already applied.
+	sqliteDB = NewSqliteStorage(dbFile)
+	defer sqliteDB.Close()
+	entries := sqliteDB.LastEntries(10).Output()
+	assert.Equal(t, 1, len(entries))
+	assert.Equal(t, storage.SessionID("tty1"), entries[0].Session)
+}
+
+func TestForget(t *testing.T) {
+	sqliteDB := NewSqliteStorage(":memory:")
+	defer sqliteDB.Close()
+
+	mod := storage.NewStorageModule(sqliteDB, storage.SetUndoWindow(time.Hour))
+	for _, command := range []string{"ls", "export TOKEN=secret", "cd /", "echo secret"} {
+		_, err := mod.Insert(command)
+		assert.Nil(t, err)
+	}
+
+	n, err := mod.ForgetMatching(storage.CommandMatches(regexp.MustCompile("secret")))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []int64{1, 3}, storage.Ids(mod.LastEntries(10).Output()))
+	assert.Equal(t, 0, len(mod.Location("").Output()))
+	stats, err := mod.Stats(storage.StatsQuery{})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, stats.Total)
+
+	restored, err := mod.Undo(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 4}, storage.Ids(restored))
+	assert.Equal(t, []int64{1, 2, 3, 4}, storage.Ids(mod.LastEntries(10).Output()))
+
+	assert.Nil(t, mod.Forget([]int64{2}))
+	purged, err := mod.PurgeTombstones(time.Now().Add(2 * time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, purged)
+	tombstones, err := sqliteDB.(storage.TombstoneEngine).Tombstones()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(tombstones))
+
+	n, err = storage.NewStorageModule(sqliteDB).ForgetMatching(func(i int, e *storage.Entry) bool { return true })
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Equal(t, 0, len(mod.LastEntries(10).Output()))
+}
@@ -0,0 +1,194 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	storage "github.com/svanellewee/xenophon/storage"
+)
+
+// programExpr is the SQL equivalent of storage.Program.
+const programExpr = `
+	CASE WHEN instr(trim(entry_command, ' '), ' ') > 0
+	THEN substr(trim(entry_command, ' '), 1, instr(trim(entry_command, ' '), ' ') - 1)
+	ELSE trim(entry_command, ' ') END`
+
+// underLocation is the SQL equivalent of storage.UnderLocation. It compares the prefix
+// with substr rather than LIKE, which ignores the case of ASCII letters.
+func underLocation(root string) (string, []interface{}) {
+	prefix := strings.TrimSuffix(root, "/") + "/"
+	return `(entry_location = ? OR substr(entry_location, 1, ?) = ?)`,
+		[]interface{}{root, utf8.RuneCountInString(prefix), prefix}
+}
+
+// statsWhere translates the query into a WHERE clause and its arguments.
+func statsWhere(q storage.StatsQuery) (string, []interface{}) {
+	clauses := []string{"entry_deleted IS NULL"}
+	args := []interface{}{}
+	if !q.Since.IsZero() {
+		clauses = append(clauses, "entry_time >= ?")
+		args = append(args, q.Since.Unix())
+	}
+	if !q.Until.IsZero() {
+		clauses = append(clauses, "entry_time <= ?")
+		args = append(args, q.Until.Unix())
+	}
+	if q.Location != "" {
+		clause, locationArgs := underLocation(q.Location)
+		clauses = append(clauses, clause)
+		args = append(args, locationArgs...)
+	}
+	if q.Host != "" {
+		clauses = append(clauses, "entry_host = ?")
+		args = append(args, q.Host)
+	}
+	return strings.Join(clauses, " AND "), args
+}
+
+func (s *sqliteStorage) topCounted(expr string, where string, args []interface{}, top int) ([]storage.Counted, error) {
+	query := `
+	SELECT ` + expr + ` AS counted_key, COUNT(*) AS counted
+	FROM entry
+	WHERE ` + where + `
+	GROUP BY counted_key
+	ORDER BY counted DESC, counted_key ASC
+	LIMIT ?
+	`
+	rows, err := s.db.Query(query, append(append([]interface{}{}, args...), top)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := make([]storage.Counted, 0, top)
+	for rows.Next() {
+		var c storage.Counted
+		if err = rows.Scan(&c.Key, &c.Count); err != nil {
+			return nil, err
+		}
+		results = append(results, c)
+	}
+	return results, rows.Err()
+}
+
+// histogram counts entries per value of a strftime format, e.g. '%H'.
+func (s *sqliteStorage) histogram(format string, where string, args []interface{}, buckets []int) error {
+	query := `
+	SELECT CAST(strftime('` + format + `', entry_time, 'unixepoch', 'localtime') AS INTEGER) AS bucket, COUNT(*)
+	FROM entry
+	WHERE ` + where + `
+	GROUP BY bucket
+	`
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var bucket sql.NullInt64
+		var count int
+		if err = rows.Scan(&bucket, &count); err != nil {
+			return err
+		}
+		if bucket.Valid && bucket.Int64 >= 0 && int(bucket.Int64) < len(buckets) {
+			buckets[bucket.Int64] += count
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStorage) failures(where string, args []interface{}) ([]storage.FailureRate, error) {
+	query := `
+	SELECT ` + programExpr + ` AS program, COUNT(*), SUM(entry_exit != 0)
+	FROM entry
+	WHERE ` + where + ` AND entry_exit IS NOT NULL
+	GROUP BY program
+	`
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var results []storage.FailureRate
+	for rows.Next() {
+		var f storage.FailureRate
+		if err = rows.Scan(&f.Program, &f.Runs, &f.Failed); err != nil {
+			return nil, err
+		}
+		results = append(results, f)
+	}
+	storage.SortFailures(results)
+	return results, rows.Err()
+}
+
+func (s *sqliteStorage) activeDays(where string, args []interface{}) ([]string, error) {
+	query := `
+	SELECT DISTINCT date(entry_time, 'unixepoch', 'localtime') AS day
+	FROM entry
+	WHERE ` + where + `
+	ORDER BY day ASC
+	`
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var days []string
+	for rows.Next() {
+		var day sql.NullString
+		if err = rows.Scan(&day); err != nil {
+			return nil, err
+		}
+		if day.Valid {
+			days = append(days, day.String)
+		}
+	}
+	return days, rows.Err()
+}
+
+// Stats implements storage.StatsEngine
+func (s *sqliteStorage) Stats(q storage.StatsQuery) (*storage.Stats, error) {
+	where, args := statsWhere(q)
+	top := q.Top
+	if top <= 0 {
+		top = storage.DefaultStatsTop
+	}
+
+	stats := &storage.Stats{}
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM entry WHERE `+where, args...).Scan(&stats.Total)
+	if err != nil {
+		return nil, err
+	}
+	if stats.TopCommands, err = s.topCounted("entry_command", where, args, top); err != nil {
+		return nil, err
+	}
+	if stats.TopPrograms, err = s.topCounted(programExpr, where, args, top); err != nil {
+		return nil, err
+	}
+	if stats.TopLocations, err = s.topCounted("entry_location", where, args, top); err != nil {
+		return nil, err
+	}
+	if err = s.histogram("%H", where, args, stats.ByHour[:]); err != nil {
+		return nil, err
+	}
+	if err = s.histogram("%w", where, args, stats.ByWeekday[:]); err != nil {
+		return nil, err
+	}
+	if stats.Failures, err = s.failures(where, args); err != nil {
+		return nil, err
+	}
+
+	days, err := s.activeDays(where, args)
+	if err != nil {
+		return nil, err
+	}
+	stats.CurrentStreak, stats.LongestStreak = storage.Streaks(days, time.Now())
+	return stats, nil
+}
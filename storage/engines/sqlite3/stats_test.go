@@ -0,0 +1,73 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	storage "github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+func TestStatsMatchGoFallback(t *testing.T) {
+	sqliteDB := NewSqliteStorage(":memory:")
+	defer sqliteDB.Close()
+	memoryDB := memory.NewMemoryStore()
+
+	testCases := []struct {
+		command  string
+		location string
+		host     string
+		exit     int
+	}{
+		{"git status", "/src/app", "laptop", 0},
+		{"git push", "/src/app", "laptop", 1},
+		{"git push", "/src/app/web", "laptop", 0},
+		{"make test", "/src/app", "desktop", 2},
+		{"  make test", "/src/app_old", "desktop", 0},
+		{"ls", "/", "desktop", 0},
+		{"ls", "/SRC/App/web", "laptop", 0},
+	}
+	where := storagetest.NewLocation("")
+	which := storagetest.NewHost("")
+	modules := []*storage.DatabaseModule{
+		storage.NewStorageModule(sqliteDB, storage.SetLocationGetter(where), storage.SetHostGetter(which)),
+		storage.NewStorageModule(memoryDB, storage.SetLocationGetter(where), storage.SetHostGetter(which)),
+	}
+	for _, testCase := range testCases {
+		where.Set(testCase.location, nil)
+		which.Set(testCase.host, nil)
+		for _, mod := range modules {
+			_, err := mod.Insert(testCase.command, storage.WithExitCode(testCase.exit))
+			assert.Nil(t, err)
+		}
+	}
+
+	for _, q := range []storage.StatsQuery{
+		{},
+		{Top: 2},
+		{Location: "/src/app"},
+		{Location: "/SRC"},
+		{Host: "desktop"},
+		{Since: time.Now().Add(-time.Hour)},
+		{Since: time.Now().Add(time.Hour)},
+		{Until: time.Now().Add(-time.Hour)},
+		{Since: time.Now().Add(-time.Hour), Until: time.Now().Add(time.Hour)},
+	} {
+		expected, err := modules[1].Stats(q)
+		assert.Nil(t, err)
+		actual, err := modules[0].Stats(q)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, actual, "query %+v", q)
+	}
+
+	stats, err := modules[0].Stats(storage.StatsQuery{Location: "/src/app"})
+	assert.Nil(t, err)
+	assert.Equal(t, 4, stats.Total)
+	assert.Equal(t, storage.Counted{Key: "git", Count: 3}, stats.TopPrograms[0])
+	assert.Equal(t, storage.FailureRate{Program: "make", Runs: 1, Failed: 1}, stats.Failures[0])
+	assert.Equal(t, 1, stats.CurrentStreak)
+}
@@ -0,0 +1,87 @@
+//go:build cgo
+
+package sqlite3
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+
+	storage "github.com/svanellewee/xenophon/storage"
+)
+
+// tagsColumn selects the tags of every entry as a list separated by spaces, which tags
+// don't contain, after the columns of a selection.
+const tagsColumn = `(SELECT group_concat(tag_name, ' ') FROM tag WHERE tag_entry_id = entry_id) AS entry_tags`
+
+// splitTags reads tagsColumn into sorted tags.
+func splitTags(column sql.NullString) []string {
+	if !column.Valid {
+		return nil
+	}
+	tags := strings.Fields(column.String)
+	sort.Strings(tags)
+	return tags
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// insertTags tags the entry with id, tags it already has are kept once.
+func insertTags(db execer, id int64, tags []string) error {
+	for _, tag := range tags {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO tag(tag_entry_id, tag_name) VALUES (?, ?)`, id, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exists reports whether there is an entry with id, tombstones included.
+func (s *sqliteStorage) exists(id int64) error {
+	var found int64
+	err := s.db.QueryRow(`SELECT entry_id FROM entry WHERE entry_id = ?`, id).Scan(&found)
+	if err == sql.ErrNoRows {
+		return storage.ErrNotFound
+	}
+	return err
+}
+
+// AddTags implements storage.TagEngine
+func (s *sqliteStorage) AddTags(id int64, tags []string) error {
+	if err := s.exists(id); err != nil {
+		return err
+	}
+	return retry(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		if err = insertTags(tx, id, tags); err != nil {
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+// RemoveTags implements storage.TagEngine
+func (s *sqliteStorage) RemoveTags(id int64, tags []string) error {
+	if err := s.exists(id); err != nil {
+		return err
+	}
+	return retry(func() error {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		for _, tag := range tags {
+			if _, err = tx.Exec(`DELETE FROM tag WHERE tag_entry_id = ? AND tag_name = ?`, id, tag); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	})
+}
@@ -3,15 +3,32 @@ package storage
 import "time"
 
 type Entry struct {
-	Id       int64
-	Time     *time.Time
-	Location LocationPath
-	Command  string
-	Env      Environment
+	Id       int64        `json:"id"`
+	Time     *time.Time   `json:"time,omitempty"`
+	Location LocationPath `json:"location"`
+	Command  string       `json:"command"`
+	Env      Environment  `json:"env,omitempty"`
+	Session  SessionID    `json:"session,omitempty"`
+	Host     HostName     `json:"host,omitempty"`
+	ExitCode *int         `json:"exit,omitempty"`
+	Deleted  *time.Time   `json:"deleted,omitempty"` // set on tombstones, entries that were soft-deleted
+	UUID     string       `json:"uuid,omitempty"`    // the same in every synced copy of the entry
+	Seq      int64        `json:"seq,omitempty"`     // increases with every entry of Host, see NextSeq
+	Count    int          `json:"count,omitempty"`   // how many entries a deduplicated entry stands for, see Dedup
+	Tags     []string     `json:"tags,omitempty"`    // sorted, see TagEngine
+	Note     string       `json:"note,omitempty"`    // free text about the entry, see NoteEngine
 }
 
 func (source *Entry) Copy(dest *Entry) {
 	dest.Location = source.Location
 	dest.Command = source.Command
 	dest.Env = source.Env
+	dest.Session = source.Session
+	dest.Host = source.Host
+	dest.ExitCode = source.ExitCode
+	dest.Deleted = source.Deleted
+	dest.UUID = source.UUID
+	dest.Seq = source.Seq
+	dest.Tags = source.Tags
+	dest.Note = source.Note
 }
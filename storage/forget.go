@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+)
+
+var ErrNoTombstones = errors.New("engine does not support soft-delete")
+
+var ErrForgetHook = errors.New("entries forgotten but a forget hook failed")
+
+// TombstoneEngine is implemented by engines that can soft-delete entries. Tombstones are
+// hidden from every query but keep their id and deletion time, so that deletions can be
+// propagated to synced copies and undone until they are purged with Delete.
+type TombstoneEngine interface {
+	Tombstone(ids []int64, at time.Time) error
+	Restore(ids []int64) error
+	Tombstones() ([]*Entry, error)
+}
+
+// CommandMatches matches entries whose command matches re.
+func CommandMatches(re *regexp.Regexp) FilterType {
+	return func(i int, e *Entry) bool {
+		return re.MatchString(e.Command)
+	}
+}
+
+// Ids lists the ids of entries, in order.
+func Ids(entries []*Entry) []int64 {
+	ids := make([]int64, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+// softDelete reports whether Forget should keep tombstones.
+func (d *DatabaseModule) softDelete() (TombstoneEngine, bool) {
+	engine, ok := d.Storage.(TombstoneEngine)
+	return engine, ok && d.UndoWindow > 0
+}
+
+// forgotten runs the forget hooks for ids.
+func (d *DatabaseModule) forgotten(ids []int64) error {
+	for _, hook := range d.ForgetHooks {
+		if err := hook(ids); err != nil {
+			return fmt.Errorf("%w: %v", ErrForgetHook, err)
+		}
+	}
+	return nil
+}
+
+// Delete removes entries by id for good, without the undo window.
+func (d *DatabaseModule) Delete(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if err := d.Storage.Delete(ids); err != nil {
+		return err
+	}
+	return d.forgotten(ids)
+}
+
+// Forget removes entries by id. With an undo window they are soft-deleted and can be
+// restored with Undo until PurgeTombstones removes them for good.
+func (d *DatabaseModule) Forget(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	engine, ok := d.softDelete()
+	if !ok {
+		return d.Delete(ids)
+	}
+	if err := engine.Tombstone(ids, time.Now()); err != nil {
+		return err
+	}
+	return d.forgotten(ids)
+}
+
+// ForgetMatching removes every entry filter matches, like Forget, and returns how many.
+func (d *DatabaseModule) ForgetMatching(filter FilterType) (int, error) {
+	ids := Ids(d.Storage.LastEntries(math.MaxInt32).Filter(filter).Output())
+	return len(ids), d.Forget(ids)
+}
+
+// Undo restores the entries removed by the most recent Forget that is still within the undo window.
+func (d *DatabaseModule) Undo(now time.Time) ([]*Entry, error) {
+	engine, ok := d.Storage.(TombstoneEngine)
+	if !ok {
+		return nil, ErrNoTombstones
+	}
+	tombstones, err := engine.Tombstones()
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *time.Time
+	for _, e := range tombstones {
+		if e.Deleted != nil && now.Sub(*e.Deleted) <= d.UndoWindow && (latest == nil || e.Deleted.After(*latest)) {
+			latest = e.Deleted
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+
+	restored := make([]*Entry, 0, len(tombstones))
+	for _, e := range tombstones {
+		if e.Deleted != nil && e.Deleted.Equal(*latest) {
+			restored = append(restored, e)
+		}
+	}
+	if err = engine.Restore(Ids(restored)); err != nil {
+		return nil, err
+	}
+	for _, e := range restored {
+		e.Deleted = nil
+	}
+	return restored, nil
+}
+
+// PurgeTombstones deletes the tombstones that are older than the undo window and returns how many.
+func (d *DatabaseModule) PurgeTombstones(now time.Time) (int, error) {
+	engine, ok := d.Storage.(TombstoneEngine)
+	if !ok {
+		return 0, nil
+	}
+	tombstones, err := engine.Tombstones()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := make([]int64, 0, len(tombstones))
+	for _, e := range tombstones {
+		if e.Deleted == nil || now.Sub(*e.Deleted) > d.UndoWindow {
+			expired = append(expired, e.Id)
+		}
+	}
+	if len(expired) == 0 {
+		return 0, nil
+	}
+	return len(expired), d.Storage.Delete(expired)
+}
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// SequenceEngine is implemented by engines that can find the highest sequence number of
+// a host without reading its recent entries, see NextSeq.
+type SequenceEngine interface {
+	LastSeq(host HostName) (int64, error)
+}
+
+// seqWindow is how many recent entries NextSeq reads on engines without LastSeq.
+const seqWindow = 100
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// NewUUID returns a random version 4 UUID.
+func NewUUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// EntryUUID is the UUID of e. Entries stored before UUIDs were assigned get one derived
+// from their host, session, time, location and command, so that every copy of them agrees.
+func EntryUUID(e *Entry) string {
+	if e.UUID != "" {
+		return e.UUID
+	}
+	var seconds int64
+	if e.Time != nil {
+		seconds = e.Time.Unix()
+	}
+	h := sha256.New()
+	for _, part := range []string{string(e.Host), string(e.Session), strconv.FormatInt(seconds, 10), string(e.Location), e.Command} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	b := h.Sum(nil)
+	b[6] = b[6]&0x0f | 0x80
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// NextSeq is the sequence number of a new entry of host. It is the current time in
+// nanoseconds, unless the host already has an entry at or after that, so it keeps
+// increasing when entries are deleted and, within reason, when the clock goes back.
+func (d *DatabaseModule) NextSeq(host HostName, now time.Time) (int64, error) {
+	var last int64
+	if engine, ok := d.Storage.(SequenceEngine); ok {
+		var err error
+		if last, err = engine.LastSeq(host); err != nil {
+			return 0, err
+		}
+	} else {
+		for _, e := range d.Storage.LastEntries(seqWindow).Output() {
+			if e.Host == host && e.Seq > last {
+				last = e.Seq
+			}
+		}
+	}
+	seq := now.UnixNano()
+	if seq <= last {
+		seq = last + 1
+	}
+	return seq, nil
+}
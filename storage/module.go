@@ -1,5 +1,7 @@
 package storage
 
+import "time"
+
 type ModuleOpt func(db *DatabaseModule)
 
 func SetStorage(s StorageStreamer) ModuleOpt {
@@ -20,10 +22,45 @@ func SetEnvironmentGetter(e EnvironmentGetter) ModuleOpt {
 	}
 }
 
+func SetSessionGetter(s SessionGetter) ModuleOpt {
+	return func(db *DatabaseModule) {
+		db.Session = s
+	}
+}
+
+func SetHostGetter(h HostGetter) ModuleOpt {
+	return func(db *DatabaseModule) {
+		db.Host = h
+	}
+}
+
+// SetUndoWindow makes Forget soft-delete entries, so they can be restored for the given duration.
+func SetUndoWindow(window time.Duration) ModuleOpt {
+	return func(db *DatabaseModule) {
+		db.UndoWindow = window
+	}
+}
+
+// AddInsertHook registers a hook that runs after every successful Insert.
+func AddInsertHook(h InsertHook) ModuleOpt {
+	return func(db *DatabaseModule) {
+		db.InsertHooks = append(db.InsertHooks, h)
+	}
+}
+
+// AddForgetHook registers a hook that runs after entries were forgotten, deleted or pruned.
+func AddForgetHook(h ForgetHook) ModuleOpt {
+	return func(db *DatabaseModule) {
+		db.ForgetHooks = append(db.ForgetHooks, h)
+	}
+}
+
 func NewStorageModule(s StorageStreamer, moduleOpts ...ModuleOpt) *DatabaseModule {
 	d := &DatabaseModule{
 		Locator:     &DefaultLocation{},
 		Environment: &DefaultEnvironment{},
+		Session:     &DefaultSession{},
+		Host:        &DefaultHost{},
 		Storage:     s,
 	}
 
@@ -0,0 +1,22 @@
+package storage
+
+import "errors"
+
+// NoteEngine is implemented by engines that can annotate stored entries with a note, e.g.
+// what a command fixed. Tombstones can be annotated too, and keep their note when they are
+// restored. SetNote replaces the note of the entry with id, an empty note removes it, and
+// fails with ErrNotFound for unknown ids and entries that were deleted for good.
+type NoteEngine interface {
+	SetNote(id int64, note string) error
+}
+
+var ErrNoNotes = errors.New("engine does not support notes on entries")
+
+// Note replaces the note of the entry with id, if the engine supports it.
+func (d *DatabaseModule) Note(id int64, note string) error {
+	engine, ok := d.Storage.(NoteEngine)
+	if !ok {
+		return ErrNoNotes
+	}
+	return engine.SetNote(id, note)
+}
@@ -0,0 +1,363 @@
+// Package predict learns which command usually follows which from the stored history.
+//
+// The model counts n-grams of consecutive commands per session, once scoped to the
+// location the command ran in and once globally. Observe updates it one entry at a
+// time so it can be kept current from a storage.InsertHook instead of rescanning. The
+// hook only appends the entry to a log next to the model, Load folds the log in and
+// Compact saves the result.
+package predict
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/svanellewee/xenophon/internal/flock"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// DefaultOrder is the longest run of previous commands used as context.
+const DefaultOrder = 3
+
+// SessionTimeout drops the context of sessions that have been idle this long.
+const SessionTimeout = 24 * time.Hour
+
+// anyLocation scopes counts that are shared by all locations.
+const anyLocation = ""
+
+// keySeparator joins the location and context commands into a single map key.
+const keySeparator = "\x1f"
+
+// Candidate is a command that may follow the given context.
+type Candidate struct {
+	Command    string
+	Count      int
+	Confidence float64
+}
+
+type sessionState struct {
+	Recent []string  `json:"recent"`
+	Seen   time.Time `json:"seen"`
+}
+
+// Model holds the n-gram counts. The zero value is not usable, use NewModel or Load.
+type Model struct {
+	Order    int                                 `json:"order"`
+	LastId   int64                               `json:"last_id"`
+	Counts   map[string]map[string]int           `json:"counts"`
+	Sessions map[storage.SessionID]*sessionState `json:"sessions"`
+}
+
+func NewModel(order int) *Model {
+	if order <= 0 {
+		order = DefaultOrder
+	}
+	return &Model{
+		Order:    order,
+		Counts:   make(map[string]map[string]int),
+		Sessions: make(map[storage.SessionID]*sessionState),
+	}
+}
+
+// Train builds a model from entries, which are observed in id order.
+func Train(entries []*storage.Entry, order int) *Model {
+	sorted := make([]*storage.Entry, len(entries))
+	copy(sorted, entries)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+
+	m := NewModel(order)
+	for _, e := range sorted {
+		m.Observe(e)
+	}
+	return m
+}
+
+func key(location storage.LocationPath, context []string) string {
+	return string(location) + keySeparator + strings.Join(context, keySeparator)
+}
+
+func (m *Model) count(k, command string) {
+	next, ok := m.Counts[k]
+	if !ok {
+		next = make(map[string]int)
+		m.Counts[k] = next
+	}
+	next[command]++
+}
+
+// Observe adds a single entry to the model. Entries that were already observed are ignored.
+func (m *Model) Observe(e *storage.Entry) {
+	command := strings.TrimSpace(e.Command)
+	if command == "" || (e.Id > 0 && e.Id <= m.LastId) {
+		return
+	}
+	if e.Id > 0 {
+		m.LastId = e.Id
+	}
+
+	seen := time.Now()
+	if e.Time != nil {
+		seen = *e.Time
+	}
+	state, ok := m.Sessions[e.Session]
+	if !ok || seen.Sub(state.Seen) > SessionTimeout {
+		state = &sessionState{}
+		m.Sessions[e.Session] = state
+	}
+
+	for n := 1; n <= len(state.Recent); n++ {
+		context := state.Recent[len(state.Recent)-n:]
+		m.count(key(e.Location, context), command)
+		m.count(key(anyLocation, context), command)
+	}
+
+	state.Recent = append(state.Recent, command)
+	if len(state.Recent) > m.Order {
+		state.Recent = state.Recent[len(state.Recent)-m.Order:]
+	}
+	state.Seen = seen
+}
+
+// Recent returns the last commands observed in session, the most recent last.
+func (m *Model) Recent(session storage.SessionID) []string {
+	state, ok := m.Sessions[session]
+	if !ok {
+		return nil
+	}
+	return state.Recent
+}
+
+// Predict ranks the commands that followed after, the most recent command last. Longer
+// contexts and the given location are preferred, shorter and global contexts back off
+// with a lower weight. Confidence is the weighted share of a candidate, in [0, 1].
+func (m *Model) Predict(location storage.LocationPath, after []string) []*Candidate {
+	if len(after) > m.Order {
+		after = after[len(after)-m.Order:]
+	}
+
+	scores := make(map[string]float64)
+	counts := make(map[string]int)
+	var total float64
+	weight := 1.0
+	for n := len(after); n >= 1; n-- {
+		context := after[len(after)-n:]
+		for _, scope := range []storage.LocationPath{location, anyLocation} {
+			next := m.Counts[key(scope, context)]
+			sum := 0
+			for _, c := range next {
+				sum += c
+			}
+			if sum == 0 {
+				continue
+			}
+			for command, c := range next {
+				scores[command] += weight * float64(c) / float64(sum)
+				if c > counts[command] {
+					counts[command] = c
+				}
+			}
+			total += weight
+			weight /= 2
+		}
+	}
+
+	candidates := make([]*Candidate, 0, len(scores))
+	for command, score := range scores {
+		candidates = append(candidates, &Candidate{
+			Command:    command,
+			Count:      counts[command],
+			Confidence: score / total,
+		})
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].Confidence != candidates[j].Confidence {
+			return candidates[i].Confidence > candidates[j].Confidence
+		}
+		return candidates[i].Command < candidates[j].Command
+	})
+	return candidates
+}
+
+// expire forgets the context of sessions that have not been seen for SessionTimeout.
+func (m *Model) expire(now time.Time) {
+	for id, state := range m.Sessions {
+		if now.Sub(state.Seen) > SessionTimeout {
+			delete(m.Sessions, id)
+		}
+	}
+}
+
+// logPath is where Hook appends observations until Compact folds them into the model.
+func logPath(fileLocation string) string {
+	return fileLocation + ".log"
+}
+
+// locked runs fn holding a lock next to the model at fileLocation, exclusive for writers,
+// so that shells logging observations don't race a compaction.
+func locked(fileLocation string, exclusive bool, fn func() error) error {
+	f, err := os.OpenFile(fileLocation+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err = flock.Lock(f, exclusive); err != nil {
+		return fmt.Errorf("could not lock model: %w", err)
+	}
+	defer flock.Unlock(f)
+	return fn()
+}
+
+// Load reads a model saved with Save, with the observations logged since. A missing
+// file returns an error wrapping os.ErrNotExist.
+func Load(fileLocation string) (*Model, error) {
+	var m *Model
+	err := locked(fileLocation, false, func() error {
+		var err error
+		m, err = load(fileLocation)
+		return err
+	})
+	return m, err
+}
+
+// load reads the model and folds in the log, the caller holds the lock.
+func load(fileLocation string) (*Model, error) {
+	f, err := os.Open(fileLocation)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	m := NewModel(DefaultOrder)
+	if err = json.NewDecoder(f).Decode(m); err != nil {
+		return nil, fmt.Errorf("could not decode model: %w", err)
+	}
+
+	log, err := os.Open(logPath(fileLocation))
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer log.Close()
+	r := bufio.NewReader(log)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// A line that doesn't decode was cut off, observations are best effort.
+		e := &storage.Entry{}
+		if json.Unmarshal(line, e) == nil {
+			m.Observe(e)
+		}
+	}
+}
+
+// Save writes the model atomically, replacing the file at fileLocation.
+func (m *Model) Save(fileLocation string) error {
+	m.expire(time.Now())
+
+	tmp, err := os.CreateTemp(filepath.Dir(fileLocation), filepath.Base(fileLocation)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = json.NewEncoder(tmp).Encode(m); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not encode model: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileLocation)
+}
+
+// replace saves m and drops the log it includes, the caller holds the exclusive lock.
+func (m *Model) replace(fileLocation string) error {
+	if err := m.Save(fileLocation); err != nil {
+		return err
+	}
+	if err := os.Remove(logPath(fileLocation)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Compact folds the logged observations into the model saved at fileLocation and returns it.
+func Compact(fileLocation string) (*Model, error) {
+	var m *Model
+	err := locked(fileLocation, true, func() error {
+		var err error
+		if m, err = load(fileLocation); err != nil {
+			return err
+		}
+		return m.replace(fileLocation)
+	})
+	return m, err
+}
+
+// Rebuild trains a new model on entries and saves it at fileLocation, replacing the log.
+func Rebuild(fileLocation string, entries []*storage.Entry, order int) (*Model, error) {
+	m := Train(entries, order)
+	err := locked(fileLocation, true, func() error {
+		return m.replace(fileLocation)
+	})
+	return m, err
+}
+
+// Hook returns an InsertHook that logs every entry next to the model saved at
+// fileLocation, a single short append however large the model is. It does nothing until
+// the model was first built, e.g. by `xenophon predict`.
+func Hook(fileLocation string) storage.InsertHook {
+	return func(e *storage.Entry) error {
+		if _, err := os.Stat(fileLocation); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		line, err := json.Marshal(&storage.Entry{
+			Id:       e.Id,
+			Time:     e.Time,
+			Location: e.Location,
+			Command:  e.Command,
+			Session:  e.Session,
+		})
+		if err != nil {
+			return err
+		}
+		return locked(fileLocation, true, func() error {
+			log, err := os.OpenFile(logPath(fileLocation), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			if _, err = log.Write(append(line, '\n')); err != nil {
+				log.Close()
+				return err
+			}
+			return log.Close()
+		})
+	}
+}
+
+// ForgetHook returns a ForgetHook that rebuilds the model saved at fileLocation from
+// history, so that forgotten commands are no longer predicted. Like Hook it does nothing
+// until the model was first built.
+func ForgetHook(fileLocation string, history func() []*storage.Entry) storage.ForgetHook {
+	return func(ids []int64) error {
+		if _, err := os.Stat(fileLocation); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		_, err := Rebuild(fileLocation, history(), DefaultOrder)
+		return err
+	}
+}
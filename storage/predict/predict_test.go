@@ -0,0 +1,179 @@
+package predict
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+func TestPredict(t *testing.T) {
+	store := memory.NewMemoryStore()
+	where := storagetest.NewLocation("/src/app")
+	who := storagetest.NewSession("one")
+	mod := storage.NewStorageModule(store,
+		storage.SetLocationGetter(where),
+		storage.SetSessionGetter(who))
+
+	for i := 0; i < 3; i++ {
+		mod.Insert("git add .")
+		mod.Insert("git commit")
+		mod.Insert("git push")
+	}
+	// A different session must not make "git add ." follow "make" in session one.
+	who.Set("two", nil)
+	mod.Insert("make")
+	who.Set("one", nil)
+	mod.Insert("git add .")
+	mod.Insert("git status")
+
+	m := Train(store.LastEntries(100).Output(), DefaultOrder)
+
+	candidates := m.Predict("/src/app", []string{"git add ."})
+	assert.Equal(t, "git commit", candidates[0].Command)
+	assert.Equal(t, 3, candidates[0].Count)
+	assert.Equal(t, "git status", candidates[1].Command)
+	assert.True(t, candidates[0].Confidence > candidates[1].Confidence)
+
+	candidates = m.Predict("/elsewhere", []string{"git commit"})
+	assert.Equal(t, 1, len(candidates))
+	assert.Equal(t, "git push", candidates[0].Command)
+	assert.InDelta(t, 1.0, candidates[0].Confidence, 0.0001)
+
+	assert.Equal(t, 0, len(m.Predict("/src/app", []string{"make"})))
+	assert.Equal(t, []string{"git push", "git add .", "git status"}, m.Recent("one"))
+}
+
+func TestHookUpdatesModel(t *testing.T) {
+	modelFile := filepath.Join(t.TempDir(), "predict.json")
+	store := memory.NewMemoryStore()
+	mod := storage.NewStorageModule(store,
+		storage.SetLocationGetter(storagetest.NewLocation("/")),
+		storage.SetSessionGetter(storagetest.NewSession("one")),
+		storage.AddInsertHook(Hook(modelFile)))
+
+	// Without a model the hook does nothing.
+	_, err := mod.Insert("ls")
+	assert.Nil(t, err)
+
+	assert.Nil(t, Train(store.LastEntries(100).Output(), DefaultOrder).Save(modelFile))
+	_, err = mod.Insert("cd /tmp")
+	assert.Nil(t, err)
+
+	m, err := Load(modelFile)
+	assert.Nil(t, err)
+	candidates := m.Predict("/", []string{"ls"})
+	assert.Equal(t, 1, len(candidates))
+	assert.Equal(t, "cd /tmp", candidates[0].Command)
+
+	// Observing an entry that is already part of the model changes nothing.
+	for _, e := range store.LastEntries(100).Output() {
+		m.Observe(e)
+	}
+	assert.Equal(t, 1, m.Predict("/", []string{"ls"})[0].Count)
+}
+
+func TestConcurrentHooks(t *testing.T) {
+	modelFile := filepath.Join(t.TempDir(), "predict.json")
+	_, err := Rebuild(modelFile, nil, DefaultOrder)
+	assert.Nil(t, err)
+
+	const shells = 8
+	now := time.Now()
+	errs := make(chan error, shells)
+	var wg sync.WaitGroup
+	for i := 0; i < shells; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			hook := Hook(modelFile)
+			for _, command := range []string{"git pull", "make"} {
+				err := hook(&storage.Entry{
+					Time:     &now,
+					Command:  command,
+					Location: "/",
+					Session:  storage.SessionID(fmt.Sprint(i)),
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.Nil(t, err)
+	}
+
+	m, err := Load(modelFile)
+	assert.Nil(t, err)
+	candidates := m.Predict("/", []string{"git pull"})
+	assert.Equal(t, 1, len(candidates))
+	assert.Equal(t, shells, candidates[0].Count)
+}
+
+func TestForgetHookDropsCommands(t *testing.T) {
+	modelFile := filepath.Join(t.TempDir(), "predict.json")
+	store := memory.NewMemoryStore()
+	var mod *storage.DatabaseModule
+	mod = storage.NewStorageModule(store,
+		storage.SetLocationGetter(storagetest.NewLocation("/")),
+		storage.SetSessionGetter(storagetest.NewSession("one")),
+		storage.AddInsertHook(Hook(modelFile)),
+		storage.AddForgetHook(ForgetHook(modelFile, func() []*storage.Entry {
+			return mod.LastEntries(100).Output()
+		})))
+
+	_, err := Rebuild(modelFile, nil, DefaultOrder)
+	assert.Nil(t, err)
+	_, err = mod.Insert("ls")
+	assert.Nil(t, err)
+	secret, err := mod.Insert("export TOKEN=secret")
+	assert.Nil(t, err)
+
+	m, err := Load(modelFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(m.Predict("/", []string{"ls"})))
+
+	assert.Nil(t, mod.Forget([]int64{secret.Id}))
+	m, err = Load(modelFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(m.Predict("/", []string{"ls"})))
+}
+
+func TestHookOnlyAppends(t *testing.T) {
+	modelFile := filepath.Join(t.TempDir(), "predict.json")
+	_, err := Rebuild(modelFile, nil, DefaultOrder)
+	assert.Nil(t, err)
+	saved, err := os.ReadFile(modelFile)
+	assert.Nil(t, err)
+
+	now := time.Now()
+	hook := Hook(modelFile)
+	for i, command := range []string{"git pull", "make"} {
+		assert.Nil(t, hook(&storage.Entry{Id: int64(i + 1), Time: &now, Command: command, Location: "/", Session: "one"}))
+	}
+	unchanged, err := os.ReadFile(modelFile)
+	assert.Nil(t, err)
+	assert.Equal(t, saved, unchanged, "the model is not rewritten on insert")
+
+	m, err := Compact(modelFile)
+	assert.Nil(t, err)
+	assert.Equal(t, "make", m.Predict("/", []string{"git pull"})[0].Command)
+	_, err = os.Stat(modelFile + ".log")
+	assert.True(t, errors.Is(err, os.ErrNotExist), "the log is folded into the model")
+	m, err = Load(modelFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, m.Predict("/", []string{"git pull"})[0].Count)
+}
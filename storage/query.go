@@ -0,0 +1,596 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Query fields.
+const (
+	FieldCommand = "cmd"
+	FieldDir     = "dir"
+	FieldHost    = "host"
+	FieldSession = "session"
+	FieldExit    = "exit"
+	FieldSince   = "since"
+	FieldUntil   = "until"
+)
+
+// Query operators. OpIs is a substring for commands, a glob for directories and equality
+// otherwise, OpMatch and OpNotMatch take regular expressions.
+const (
+	OpIs       = ":"
+	OpEq       = "="
+	OpNe       = "!="
+	OpMatch    = "~"
+	OpNotMatch = "!~"
+	OpLt       = "<"
+	OpLe       = "<="
+	OpGt       = ">"
+	OpGe       = ">="
+)
+
+// queryOps are the operators, longest first, so that "!=" isn't read as "!".
+var queryOps = []string{OpNe, OpNotMatch, OpLe, OpGe, OpIs, OpEq, OpMatch, OpLt, OpGt}
+
+// fieldOps lists the operators every field accepts.
+var fieldOps = map[string][]string{
+	FieldCommand: {OpIs, OpEq, OpNe, OpMatch, OpNotMatch},
+	FieldDir:     {OpIs, OpEq, OpNe, OpMatch, OpNotMatch},
+	FieldHost:    {OpIs, OpEq, OpNe, OpMatch, OpNotMatch},
+	FieldSession: {OpIs, OpEq, OpNe, OpMatch, OpNotMatch},
+	FieldExit:    {OpIs, OpEq, OpNe, OpLt, OpLe, OpGt, OpGe},
+	FieldSince:   {OpIs},
+	FieldUntil:   {OpIs},
+}
+
+// Expr is a node of a parsed query: And, Or, Not or Cond.
+type Expr interface {
+	Filter() FilterType
+}
+
+// And matches entries both sides match.
+type And struct {
+	Left, Right Expr
+}
+
+// Or matches entries either side matches.
+type Or struct {
+	Left, Right Expr
+}
+
+// Not matches entries Expr doesn't.
+type Not struct {
+	Expr Expr
+}
+
+// Cond compares a field of entries, e.g. exit!=0. Its value is resolved when the query is
+// parsed: directories are absolute, times are relative to the time of parsing.
+type Cond struct {
+	Field string
+	Op    string
+	Value string
+	// Pattern is set for OpMatch and OpNotMatch, and for directory globs that don't
+	// select a whole tree.
+	Pattern *regexp.Regexp
+	// Under is set for directory globs ending in /**, the tree is Under and everything below it.
+	Under  string
+	Number int       // exit codes
+	Time   time.Time // since and until, to the second
+}
+
+func (a *And) Filter() FilterType {
+	left, right := a.Left.Filter(), a.Right.Filter()
+	return func(i int, e *Entry) bool {
+		return left(i, e) && right(i, e)
+	}
+}
+
+func (o *Or) Filter() FilterType {
+	left, right := o.Left.Filter(), o.Right.Filter()
+	return func(i int, e *Entry) bool {
+		return left(i, e) || right(i, e)
+	}
+}
+
+func (n *Not) Filter() FilterType {
+	filter := n.Expr.Filter()
+	return func(i int, e *Entry) bool {
+		return !filter(i, e)
+	}
+}
+
+// text is the field of e a condition on text compares.
+func (c *Cond) text(e *Entry) string {
+	switch c.Field {
+	case FieldCommand:
+		return e.Command
+	case FieldDir:
+		return string(e.Location)
+	case FieldHost:
+		return string(e.Host)
+	default:
+		return string(e.Session)
+	}
+}
+
+func (c *Cond) Filter() FilterType {
+	switch {
+	case c.Field == FieldSince:
+		return func(i int, e *Entry) bool {
+			return e.Time != nil && !e.Time.Before(c.Time)
+		}
+	case c.Field == FieldUntil:
+		// Until includes the whole second, which is all some engines keep.
+		end := c.Time.Add(time.Second)
+		return func(i int, e *Entry) bool {
+			return e.Time != nil && e.Time.Before(end)
+		}
+	case c.Field == FieldExit:
+		return func(i int, e *Entry) bool {
+			return e.ExitCode != nil && compareInts(*e.ExitCode, c.Op, c.Number)
+		}
+	case c.Under != "":
+		return UnderLocation(c.Under)
+	case c.Pattern != nil:
+		negate := c.Op == OpNotMatch
+		return func(i int, e *Entry) bool {
+			return c.Pattern.MatchString(c.text(e)) != negate
+		}
+	case c.Field == FieldCommand && c.Op == OpIs:
+		return func(i int, e *Entry) bool {
+			return strings.Contains(e.Command, c.Value)
+		}
+	default:
+		negate := c.Op == OpNe
+		return func(i int, e *Entry) bool {
+			return (c.text(e) == c.Value) != negate
+		}
+	}
+}
+
+func compareInts(a int, op string, b int) bool {
+	switch op {
+	case OpNe:
+		return a != b
+	case OpLt:
+		return a < b
+	case OpLe:
+		return a <= b
+	case OpGt:
+		return a > b
+	case OpGe:
+		return a >= b
+	default:
+		return a == b
+	}
+}
+
+// Query selects entries with an expression like
+//
+//	cmd~"^git" and dir:~/src/** and since:2d and exit!=0 and host:laptop
+//
+// Conditions are combined with and, or, not and parentheses, and binds tighter than or
+// and is implied between conditions. A word without a field matches commands that
+// contain it. An empty query matches every entry.
+type Query struct {
+	Expr Expr
+}
+
+// QueryEngine is implemented by engines that can evaluate queries natively. Engines
+// without it fall back to the query's filters.
+type QueryEngine interface {
+	Query(q *Query) (ResultStreamer, error)
+}
+
+// Filter returns the FilterType equivalent of the query.
+func (q *Query) Filter() FilterType {
+	if q.Expr == nil {
+		return func(i int, e *Entry) bool { return true }
+	}
+	return q.Expr.Filter()
+}
+
+// Filters splits the query at its outermost ands, applying them in turn with
+// ResultStreamer.Filter selects the same entries as the query.
+func (q *Query) Filters() []FilterType {
+	if q.Expr == nil {
+		return nil
+	}
+	var filters []FilterType
+	var split func(e Expr)
+	split = func(e Expr) {
+		if and, ok := e.(*And); ok {
+			split(and.Left)
+			split(and.Right)
+			return
+		}
+		filters = append(filters, e.Filter())
+	}
+	split(q.Expr)
+	return filters
+}
+
+// Query returns the live entries q selects, oldest first, natively if the engine supports it.
+func (d *DatabaseModule) Query(q *Query) (ResultStreamer, error) {
+	if engine, ok := d.Storage.(QueryEngine); ok {
+		return engine.Query(q)
+	}
+	results := d.Storage.LastEntries(math.MaxInt32)
+	for _, filter := range q.Filters() {
+		results = results.Filter(filter)
+	}
+	return results, nil
+}
+
+// ParseQuery parses a query, since and until are relative to now.
+func ParseQuery(input string, now time.Time) (*Query, error) {
+	p := &queryParser{lexer: queryLexer{input: input}, now: now}
+	if err := p.advance(); err != nil {
+		return nil, err
+	}
+	if p.token.kind == tokenEnd {
+		return &Query{}, nil
+	}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.token.kind != tokenEnd {
+		return nil, p.errorf("unexpected %s", p.token)
+	}
+	return &Query{Expr: expr}, nil
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenOpen
+	tokenClose
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenWord // a command substring
+	tokenCond
+)
+
+type queryToken struct {
+	kind      tokenKind
+	pos       int
+	field, op string
+	value     string
+	valuePos  int // where the value starts, for errors
+	quoted    bool
+}
+
+func (t queryToken) String() string {
+	switch t.kind {
+	case tokenEnd:
+		return "end of query"
+	case tokenOpen:
+		return `"("`
+	case tokenClose:
+		return `")"`
+	case tokenCond:
+		return strconv.Quote(t.field + t.op + t.value)
+	default:
+		return strconv.Quote(t.value)
+	}
+}
+
+type queryLexer struct {
+	input string
+	pos   int
+}
+
+func (l *queryLexer) errorf(pos int, format string, args ...interface{}) error {
+	return fmt.Errorf("invalid query at column %d: %s", pos+1, fmt.Sprintf(format, args...))
+}
+
+func (l *queryLexer) next() (queryToken, error) {
+	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) {
+		l.pos++
+	}
+	start := l.pos
+	if l.pos == len(l.input) {
+		return queryToken{kind: tokenEnd, pos: start}, nil
+	}
+	switch l.input[l.pos] {
+	case '(':
+		l.pos++
+		return queryToken{kind: tokenOpen, pos: start}, nil
+	case ')':
+		l.pos++
+		return queryToken{kind: tokenClose, pos: start}, nil
+	case '"':
+		value, err := l.quoted()
+		return queryToken{kind: tokenWord, pos: start, value: value, quoted: true}, err
+	}
+
+	name := l.pos
+	for name < len(l.input) && unicode.IsLetter(rune(l.input[name])) {
+		name++
+	}
+	if name > l.pos {
+		for _, op := range queryOps {
+			if !strings.HasPrefix(l.input[name:], op) {
+				continue
+			}
+			field := strings.ToLower(l.input[l.pos:name])
+			if _, ok := fieldOps[field]; !ok {
+				return queryToken{}, l.errorf(start, "unknown field %q", l.input[l.pos:name])
+			}
+			l.pos = name + len(op)
+			t := queryToken{kind: tokenCond, pos: start, field: field, op: op, valuePos: l.pos}
+			var err error
+			if l.pos < len(l.input) && l.input[l.pos] == '"' {
+				t.value, err = l.quoted()
+			} else {
+				t.value = l.bare()
+			}
+			return t, err
+		}
+	}
+
+	word := l.bare()
+	switch strings.ToLower(word) {
+	case "and":
+		return queryToken{kind: tokenAnd, pos: start, value: word}, nil
+	case "or":
+		return queryToken{kind: tokenOr, pos: start, value: word}, nil
+	case "not":
+		return queryToken{kind: tokenNot, pos: start, value: word}, nil
+	}
+	return queryToken{kind: tokenWord, pos: start, value: word}, nil
+}
+
+// bare reads a value up to a space or a closing parenthesis it didn't open.
+func (l *queryLexer) bare() string {
+	start, depth := l.pos, 0
+	for ; l.pos < len(l.input); l.pos++ {
+		c := l.input[l.pos]
+		if unicode.IsSpace(rune(c)) || (c == ')' && depth == 0) {
+			break
+		}
+		if c == '(' {
+			depth++
+		} else if c == ')' {
+			depth--
+		}
+	}
+	return l.input[start:l.pos]
+}
+
+// quoted reads a double-quoted value. Only \" and \\ are escapes, so that regular
+// expressions keep their backslashes.
+func (l *queryLexer) quoted() (string, error) {
+	start := l.pos
+	var value strings.Builder
+	for l.pos++; l.pos < len(l.input); l.pos++ {
+		c := l.input[l.pos]
+		switch {
+		case c == '"':
+			l.pos++
+			return value.String(), nil
+		case c == '\\' && l.pos+1 < len(l.input) && (l.input[l.pos+1] == '"' || l.input[l.pos+1] == '\\'):
+			l.pos++
+			value.WriteByte(l.input[l.pos])
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", l.errorf(start, "unterminated string")
+}
+
+// queryParser parses, from loosest to tightest binding:
+//
+//	or   = and { "or" and }
+//	and  = not { ["and"] not }
+//	not  = "not" not | "(" or ")" | condition | word
+type queryParser struct {
+	lexer queryLexer
+	token queryToken
+	now   time.Time
+}
+
+func (p *queryParser) advance() error {
+	t, err := p.lexer.next()
+	p.token = t
+	return err
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return p.lexer.errorf(p.token.pos, format, args...)
+}
+
+func (p *queryParser) or() (Expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.token.kind == tokenOr {
+		if err = p.advance(); err != nil {
+			return nil, err
+		}
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = &Or{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *queryParser) and() (Expr, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch p.token.kind {
+		case tokenAnd:
+			if err = p.advance(); err != nil {
+				return nil, err
+			}
+		case tokenNot, tokenOpen, tokenCond, tokenWord:
+		default:
+			return left, nil
+		}
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = &And{Left: left, Right: right}
+	}
+}
+
+func (p *queryParser) not() (Expr, error) {
+	t := p.token
+	switch t.kind {
+	case tokenNot:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		expr, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return &Not{Expr: expr}, nil
+	case tokenOpen:
+		if err := p.advance(); err != nil {
+			return nil, err
+		}
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.token.kind != tokenClose {
+			return nil, p.errorf("expected \")\" instead of %s", p.token)
+		}
+		return expr, p.advance()
+	case tokenWord:
+		if t.value == "" {
+			return nil, p.errorf("empty string")
+		}
+		return &Cond{Field: FieldCommand, Op: OpIs, Value: t.value}, p.advance()
+	case tokenCond:
+		cond, err := p.cond(t)
+		if err != nil {
+			return nil, err
+		}
+		return cond, p.advance()
+	default:
+		return nil, p.errorf("unexpected %s", t)
+	}
+}
+
+// cond resolves the value of a condition.
+func (p *queryParser) cond(t queryToken) (*Cond, error) {
+	fail := func(format string, args ...interface{}) (*Cond, error) {
+		return nil, p.lexer.errorf(t.valuePos, format, args...)
+	}
+	if !containsString(fieldOps[t.field], t.op) {
+		return fail("%s can't be compared with %s", t.field, t.op)
+	}
+	c := &Cond{Field: t.field, Op: t.op, Value: t.value}
+	if t.value == "" && !t.quoted {
+		return fail("%s%s needs a value", t.field, t.op)
+	}
+
+	var err error
+	switch {
+	case t.field == FieldExit:
+		if c.Number, err = strconv.Atoi(t.value); err != nil {
+			return fail("exit code %q is not a number", t.value)
+		}
+	case t.field == FieldSince:
+		if c.Time, err = ParseSince(t.value, p.now); err != nil {
+			return fail("%v", err)
+		}
+		c.Time = c.Time.Truncate(time.Second)
+	case t.field == FieldUntil:
+		if c.Time, err = ParseUntil(t.value, p.now); err != nil {
+			return fail("%v", err)
+		}
+		c.Time = c.Time.Truncate(time.Second)
+	case t.op == OpMatch || t.op == OpNotMatch:
+		if c.Pattern, err = regexp.Compile(t.value); err != nil {
+			return fail("invalid regular expression: %v", err)
+		}
+	case t.field == FieldDir:
+		if c.Value, err = absPath(t.value); err != nil {
+			return fail("%v", err)
+		}
+		if t.op == OpIs {
+			c.Under, c.Pattern = dirGlob(c.Value)
+		}
+	}
+	return c, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// absPath expands ~ in path and makes it absolute.
+func absPath(path string) (string, error) {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = home + path[1:]
+	}
+	return filepath.Abs(path)
+}
+
+// dirGlob compiles a directory glob: * matches within a directory name, ** any number of
+// them and ? a single character. A glob that is a directory followed by /** selects its
+// tree, one without wildcards is compared as it is.
+func dirGlob(glob string) (under string, pattern *regexp.Regexp) {
+	if root := strings.TrimSuffix(glob, "/**"); root != glob && !strings.ContainsAny(root, "*?") {
+		if root == "" {
+			root = "/"
+		}
+		return root, nil
+	}
+	if !strings.ContainsAny(glob, "*?") {
+		return "", nil
+	}
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "/**/"):
+			expr.WriteString("/(.*/)?")
+			i += 3
+		case glob[i:] == "/**":
+			expr.WriteString("(/.*)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			expr.WriteString("[^/]*")
+		case glob[i] == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return "", regexp.MustCompile(expr.String())
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseQuery(t *testing.T) {
+	t.Setenv("HOME", "/home/me")
+	now := time.Date(2021, time.March, 10, 12, 0, 0, 500, time.UTC)
+
+	q, err := ParseQuery(`cmd~"^git \"x\"\d" and dir:~/src/** since:2d or not exit!=0`, now)
+	require.Nil(t, err)
+	or, ok := q.Expr.(*Or)
+	require.True(t, ok, "or binds loosest")
+	and, ok := or.Left.(*And)
+	require.True(t, ok)
+	inner, ok := and.Left.(*And)
+	require.True(t, ok, "and is implied between conditions")
+	assert.Equal(t, `^git "x"\d`, inner.Left.(*Cond).Pattern.String(), "only quotes and backslashes are escaped")
+	assert.Equal(t, "/home/me/src", inner.Right.(*Cond).Under)
+	assert.Equal(t, now.Add(-48*time.Hour).Truncate(time.Second), and.Right.(*Cond).Time)
+	not, ok := or.Right.(*Not)
+	require.True(t, ok)
+	assert.Equal(t, &Cond{Field: FieldExit, Op: OpNe, Value: "0"}, not.Expr)
+
+	q, err = ParseQuery(`make (exit:1 OR exit:2)`, now)
+	require.Nil(t, err)
+	assert.Equal(t, &And{
+		Left:  &Cond{Field: FieldCommand, Op: OpIs, Value: "make"},
+		Right: &Or{Left: &Cond{Field: FieldExit, Op: OpIs, Value: "1", Number: 1}, Right: &Cond{Field: FieldExit, Op: OpIs, Value: "2", Number: 2}},
+	}, q.Expr)
+
+	q, err = ParseQuery(`cmd~(a|b)`, now)
+	require.Nil(t, err)
+	assert.Equal(t, "(a|b)", q.Expr.(*Cond).Pattern.String(), "parentheses in values are balanced")
+
+	q, err = ParseQuery("  ", now)
+	require.Nil(t, err)
+	assert.Nil(t, q.Expr)
+	assert.Nil(t, q.Filters())
+	assert.True(t, q.Filter()(0, &Entry{}))
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for query, message := range map[string]string{
+		`hots:laptop`:         `column 1: unknown field "hots"`,
+		`exit~1`:              `column 6: exit can't be compared with ~`,
+		`exit:one`:            `exit code "one" is not a number`,
+		`cmd~"(`:              `column 5: unterminated string`,
+		`cmd~(`:               `invalid regular expression`,
+		`since:soon`:          `can't tell when "soon" is`,
+		`host:`:               `host: needs a value`,
+		`(git`:                `expected ")" instead of end of query`,
+		`git)`:                `column 4: unexpected ")"`,
+		`git and`:             `unexpected end of query`,
+		`not or git`:          `unexpected "or"`,
+		`cmd:a or or cmd:b`:   `unexpected "or"`,
+		`until:2021-02-30`:    `can't tell when`,
+		`since:5y`:            `can't tell when`,
+		`session>s1`:          `session can't be compared with >`,
+		`""`:                  `empty string`,
+		`dir:/src and cmd!~[`: `invalid regular expression`,
+	} {
+		_, err := ParseQuery(query, time.Now())
+		if assert.Error(t, err, query) {
+			assert.Contains(t, err.Error(), message, query)
+		}
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	q, err := ParseQuery(`git and (host:a or host:b) exit=0`, time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, 3, len(q.Filters()), "split at the outermost ands")
+
+	q, err = ParseQuery(`git or make`, time.Now())
+	require.Nil(t, err)
+	assert.Equal(t, 1, len(q.Filters()))
+}
+
+func TestDirGlob(t *testing.T) {
+	for glob, expected := range map[string]struct {
+		under   string
+		matches []string
+		misses  []string
+	}{
+		"/src/**":      {under: "/src"},
+		"/**":          {under: "/"},
+		"/src":         {},
+		"/src/*":       {matches: []string{"/src/a"}, misses: []string{"/src", "/src/a/b"}},
+		"/src/*/test":  {matches: []string{"/src/a/test"}, misses: []string{"/src/test", "/src/a/b/test"}},
+		"/src/**/test": {matches: []string{"/src/test", "/src/a/b/test"}, misses: []string{"/src/atest"}},
+		"/s?c/**":      {matches: []string{"/src", "/sac/x/y"}, misses: []string{"/s/c", "/srcx"}},
+		"/a.b/*":       {matches: []string{"/a.b/c"}, misses: []string{"/axb/c"}},
+		"/src/x**":     {matches: []string{"/src/x", "/src/xy/z"}, misses: []string{"/src/y"}},
+	} {
+		under, pattern := dirGlob(glob)
+		assert.Equal(t, expected.under, under, glob)
+		if expected.matches == nil && expected.misses == nil {
+			assert.Nil(t, pattern, glob)
+			continue
+		}
+		require.NotNil(t, pattern, glob)
+		for _, dir := range expected.matches {
+			assert.True(t, pattern.MatchString(dir), "%s matches %s", glob, dir)
+		}
+		for _, dir := range expected.misses {
+			assert.False(t, pattern.MatchString(dir), "%s doesn't match %s", glob, dir)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cast"
+)
+
+var ErrUnknownEngine = errors.New("unknown storage engine")
+
+// EngineConfig is what an engine factory is opened with.
+type EngineConfig struct {
+	Dir    string                 // directory for the engine's files when its section names none
+	Values map[string]interface{} // the engine's own config section, e.g. `sqlite3:` in config.yaml
+}
+
+// EngineFactory opens an engine from its config.
+type EngineFactory func(config EngineConfig) (StorageStreamer, error)
+
+var (
+	enginesMu sync.RWMutex
+	engines   = make(map[string]EngineFactory)
+)
+
+// Register makes an engine available by name, typically from the engine package's init.
+// Like database/sql.Register it panics when a name is registered twice.
+func Register(name string, factory EngineFactory) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	if factory == nil {
+		panic("storage: Register factory is nil")
+	}
+	if _, dup := engines[name]; dup {
+		panic("storage: Register called twice for engine " + name)
+	}
+	engines[name] = factory
+}
+
+// Engines lists the registered engine names, sorted.
+func Engines() []string {
+	enginesMu.RLock()
+	defer enginesMu.RUnlock()
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open creates the engine registered under name.
+func Open(name string, config EngineConfig) (StorageStreamer, error) {
+	enginesMu.RLock()
+	factory, ok := engines[name]
+	enginesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q, known engines: %s", ErrUnknownEngine, name, strings.Join(Engines(), ", "))
+	}
+	return factory(config)
+}
+
+func (c EngineConfig) value(key string) (interface{}, bool) {
+	v, ok := c.Values[strings.ToLower(key)]
+	return v, ok && v != nil
+}
+
+func (c EngineConfig) String(key string, fallback string) string {
+	if v, ok := c.value(key); ok {
+		return cast.ToString(v)
+	}
+	return fallback
+}
+
+// Path reads a file name, with ~ expanded and made absolute.
+func (c EngineConfig) Path(key string, fallback string) (string, error) {
+	return absPath(c.String(key, fallback))
+}
+
+func (c EngineConfig) Int(key string, fallback int) int {
+	if v, ok := c.value(key); ok {
+		return cast.ToInt(v)
+	}
+	return fallback
+}
+
+func (c EngineConfig) Bool(key string, fallback bool) bool {
+	if v, ok := c.value(key); ok {
+		return cast.ToBool(v)
+	}
+	return fallback
+}
+
+func (c EngineConfig) Duration(key string, fallback time.Duration) time.Duration {
+	if v, ok := c.value(key); ok {
+		return cast.ToDuration(v)
+	}
+	return fallback
+}
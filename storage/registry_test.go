@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	var opened EngineConfig
+	Register("registry-test", func(config EngineConfig) (StorageStreamer, error) {
+		opened = config
+		return nil, nil
+	})
+	assert.Panics(t, func() {
+		Register("registry-test", func(config EngineConfig) (StorageStreamer, error) { return nil, nil })
+	})
+	assert.Contains(t, Engines(), "registry-test")
+
+	_, err := Open("registry-test", EngineConfig{
+		Dir: "/home/me/.xenophon",
+		Values: map[string]interface{}{
+			"path":    "/tmp/history",
+			"size":    "42",
+			"sync":    true,
+			"timeout": "5s",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/home/me/.xenophon", opened.Dir)
+	assert.Equal(t, "/tmp/history", opened.String("path", ""))
+	assert.Equal(t, "fallback", opened.String("missing", "fallback"))
+	assert.Equal(t, 42, opened.Int("size", 0))
+	assert.True(t, opened.Bool("sync", false))
+	assert.Equal(t, 5*time.Second, opened.Duration("timeout", time.Second))
+
+	_, err = Open("no-such-engine", EngineConfig{})
+	assert.True(t, errors.Is(err, ErrUnknownEngine))
+}
@@ -0,0 +1,168 @@
+package replica
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// ErrNotEmpty is returned when the history merged into already has entries.
+var ErrNotEmpty = errors.New("merge target is not empty")
+
+// mergeKey identifies the same command in different histories. Times are compared to
+// the second, which is all some engines keep.
+type mergeKey struct {
+	host    storage.HostName
+	session storage.SessionID
+	time    int64
+	command string
+}
+
+func keyOf(e *storage.Entry) mergeKey {
+	k := mergeKey{host: e.Host, session: e.Session, command: e.Command}
+	if e.Time != nil {
+		k.time = e.Time.Unix()
+	}
+	return k
+}
+
+// Conflict is an entry that was skipped as a duplicate of a kept one although their
+// details differ.
+type Conflict struct {
+	Kept    *storage.Entry `json:"kept"`
+	Skipped *storage.Entry `json:"skipped"`
+	Source  int            `json:"source"` // which of the other histories Skipped is from
+	Fields  []string       `json:"fields"`
+}
+
+// differences names the details in which duplicates a and b disagree.
+func differences(a, b *storage.Entry) []string {
+	var fields []string
+	if a.Location != b.Location {
+		fields = append(fields, "location")
+	}
+	if (a.ExitCode == nil) != (b.ExitCode == nil) || (a.ExitCode != nil && *a.ExitCode != *b.ExitCode) {
+		fields = append(fields, "exit")
+	}
+	if a.UUID != "" && b.UUID != "" && a.UUID != b.UUID {
+		fields = append(fields, "uuid")
+	}
+	return fields
+}
+
+// MergeReport is what Merge did.
+type MergeReport struct {
+	Primary    int        `json:"primary"`    // entries copied from the primary
+	Renumbered bool       `json:"renumbered"` // whether the primary's ids could not be kept
+	Added      []int      `json:"added"`      // entries added from each of the other histories
+	Duplicates int        `json:"duplicates"` // entries skipped because an equal one was kept
+	Conflicts  []Conflict `json:"conflicts"`
+}
+
+// Merge copies the live entries of primary, and those of others that primary doesn't
+// have, into the empty history out. Entries are the same if they have the same host,
+// session, time and command, the first one is kept and differences are reported as
+// conflicts. Out keeps the primary's ids if it implements storage.ImportEngine, the other
+// entries are numbered after them in the order they ran.
+func Merge(out storage.StorageStreamer, primary storage.StorageStreamer, others ...storage.StorageStreamer) (*MergeReport, error) {
+	if len(out.LastEntries(1).Output()) > 0 {
+		return nil, ErrNotEmpty
+	}
+	report := &MergeReport{Added: make([]int, len(others))}
+	kept := map[mergeKey]*storage.Entry{}
+
+	entries, err := storage.ReadAll(primary)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the primary history: %w", err)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Id < entries[j].Id })
+	for _, e := range entries {
+		if _, ok := kept[keyOf(e)]; !ok {
+			kept[keyOf(e)] = e
+		}
+	}
+	if err := copyPrimary(out, entries); errors.Is(err, storage.ErrNoImport) {
+		report.Renumbered = true
+	} else if err != nil {
+		return nil, fmt.Errorf("could not copy the primary history: %w", err)
+	}
+	report.Primary = len(entries)
+
+	type added struct {
+		entry  *storage.Entry
+		source int
+	}
+	var adds []added
+	for source, other := range others {
+		entries, err := storage.ReadAll(other)
+		if err != nil {
+			return nil, fmt.Errorf("could not read history %d: %w", source+1, err)
+		}
+		for _, e := range entries {
+			k := keyOf(e)
+			if first, ok := kept[k]; ok {
+				report.Duplicates++
+				if fields := differences(first, e); len(fields) > 0 {
+					report.Conflicts = append(report.Conflicts, Conflict{Kept: first, Skipped: e, Source: source, Fields: fields})
+				}
+				continue
+			}
+			kept[k] = e
+			adds = append(adds, added{entry: e, source: source})
+		}
+	}
+	// Entries without a time go first, ties are broken by history and id.
+	sort.SliceStable(adds, func(i, j int) bool {
+		a, b := adds[i].entry, adds[j].entry
+		if (a.Time == nil) != (b.Time == nil) {
+			return a.Time == nil
+		}
+		if a.Time != nil && !a.Time.Equal(*b.Time) {
+			return a.Time.Before(*b.Time)
+		}
+		if adds[i].source != adds[j].source {
+			return adds[i].source < adds[j].source
+		}
+		return a.Id < b.Id
+	})
+	copies := make([]*storage.Entry, 0, len(adds))
+	for _, a := range adds {
+		copies = append(copies, copyOf(a.entry))
+	}
+	if _, err := out.AddBatch(copies); err != nil {
+		return report, fmt.Errorf("could not add the other histories: %w", err)
+	}
+	for _, a := range adds {
+		report.Added[a.source]++
+	}
+	return report, nil
+}
+
+// copyOf is e without its id, keeping its time, UUID and sequence number.
+func copyOf(e *storage.Entry) *storage.Entry {
+	c := &storage.Entry{Time: e.Time}
+	e.Copy(c)
+	c.Deleted = nil
+	return c
+}
+
+// copyPrimary imports entries with their ids, or adds them in order if out can't keep
+// ids, returning storage.ErrNoImport once they are added.
+func copyPrimary(out storage.StorageStreamer, entries []*storage.Entry) error {
+	if engine, ok := out.(storage.ImportEngine); ok {
+		err := engine.Import(entries)
+		if !errors.Is(err, storage.ErrNoImport) {
+			return err
+		}
+	}
+	copies := make([]*storage.Entry, 0, len(entries))
+	for _, e := range entries {
+		copies = append(copies, copyOf(e))
+	}
+	if _, err := out.AddBatch(copies); err != nil {
+		return err
+	}
+	return storage.ErrNoImport
+}
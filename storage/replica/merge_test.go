@@ -0,0 +1,97 @@
+package replica
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/jsonl"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+// history adds entries of commands run a minute apart, from the hour at.
+func history(t *testing.T, at time.Time, host string, location string, commands ...string) storage.StorageStreamer {
+	s := memory.NewMemoryStore()
+	for i, command := range commands {
+		ran := at.Add(time.Duration(i) * time.Minute)
+		_, err := s.Add(&storage.Entry{Command: command, Location: storage.LocationPath(location), Host: storage.HostName(host), Session: "1", Time: &ran})
+		require.Nil(t, err)
+	}
+	return s
+}
+
+func TestMerge(t *testing.T) {
+	at := time.Date(2022, time.January, 2, 10, 0, 0, 0, time.UTC)
+	primary := history(t, at, "old", "/src", "git clone", "rm -rf /tmp/x", "make", "make test")
+	require.Nil(t, primary.Delete([]int64{2}))
+	// The same commands from a copy of the old history, and commands from a newer machine.
+	other := history(t, at, "old", "/src", "git clone", "rm -rf /tmp/x")
+	exit, ran := 2, at.Add(2*time.Minute)
+	_, err := other.Add(&storage.Entry{Command: "make", Location: "/src", Host: "old", Session: "1", Time: &ran, ExitCode: &exit})
+	require.Nil(t, err)
+	newer := history(t, at.Add(30*time.Second), "new", "/home", "ls", "pwd")
+
+	out := memory.NewMemoryStore()
+	report, err := Merge(out, primary, other, newer)
+	require.Nil(t, err)
+	assert.Equal(t, 3, report.Primary)
+	assert.False(t, report.Renumbered)
+	assert.Equal(t, []int{1, 2}, report.Added, "the entry the primary deleted comes back from the copy")
+	assert.Equal(t, 2, report.Duplicates)
+	require.Equal(t, 1, len(report.Conflicts))
+	assert.Equal(t, "make", report.Conflicts[0].Kept.Command)
+	assert.Equal(t, []string{"exit"}, report.Conflicts[0].Fields)
+
+	entries := out.LastEntries(10).Output()
+	assert.Equal(t, []string{"git clone", "make", "make test", "ls", "rm -rf /tmp/x", "pwd"}, storagetest.Commands(entries))
+	assert.Equal(t, []int64{1, 3, 4}, storage.Ids(entries[:3]), "the primary's ids are kept")
+	assert.Greater(t, entries[3].Id, int64(4))
+	assert.Nil(t, entries[1].ExitCode, "the primary's details win")
+
+	_, err = Merge(out, primary)
+	assert.ErrorIs(t, err, ErrNotEmpty)
+}
+
+func TestMergeRenumbers(t *testing.T) {
+	at := time.Date(2022, time.January, 2, 10, 0, 0, 0, time.UTC)
+	primary := history(t, at, "old", "/src", "a", "b", "c")
+	require.Nil(t, primary.Delete([]int64{1}))
+
+	// jsonl numbers entries by their position in the file.
+	out, err := jsonl.NewJsonlStorage(filepath.Join(t.TempDir(), "merged.jsonl"), 0, false)
+	require.Nil(t, err)
+	defer out.Close()
+	report, err := Merge(out, primary)
+	require.Nil(t, err)
+	assert.True(t, report.Renumbered)
+	assert.Equal(t, []string{"b", "c"}, storagetest.Commands(out.LastEntries(10).Output()))
+}
+
+// untimed lists entries like an old history that did not record when commands ran.
+type untimed struct {
+	storage.StorageStreamer
+	entries []*storage.Entry
+}
+
+func (u untimed) LastEntries(n int) storage.ResultStreamer {
+	return storage.NewResults(u.entries).LastEntries(n)
+}
+
+func TestMergeOrdersEntriesWithoutTime(t *testing.T) {
+	at := time.Date(2022, time.January, 2, 10, 0, 0, 0, time.UTC)
+	timed := history(t, at, "new", "/src", "ls", "pwd")
+	old := untimed{memory.NewMemoryStore(), []*storage.Entry{
+		{Id: 1, Command: "cd", Host: "old"}, {Id: 2, Command: "vim", Host: "old"},
+	}}
+	older := untimed{memory.NewMemoryStore(), []*storage.Entry{{Id: 1, Command: "make", Host: "older"}}}
+
+	out := memory.NewMemoryStore()
+	_, err := Merge(out, memory.NewMemoryStore(), timed, older, old)
+	require.Nil(t, err)
+	assert.Equal(t, []string{"make", "cd", "vim", "ls", "pwd"}, storagetest.Commands(out.LastEntries(10).Output()),
+		"entries without time go first, by history and id")
+}
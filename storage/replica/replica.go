@@ -0,0 +1,258 @@
+// Package replica reconciles two histories, e.g. those of two laptops, so that both end
+// up with the same entries however they were edited in between.
+//
+// Entries are matched by their UUID, which every copy of an entry keeps. Each host numbers
+// its entries with increasing sequence numbers, and the State of a pair of replicas records
+// the highest number of every host that both had seen when they were last synced. An entry
+// that only one side has is new if its number is above that, and was deleted on the other
+// side otherwise, even after that side purged its tombstone. Soft-deletes are copied with
+// their deletion time and deletion wins over an entry that is still live.
+//
+// Entries stored before sequence numbers were assigned are always treated as new, so a
+// purged deletion of one of them is undone by a sync with a replica that still has it.
+//
+// Merge combines histories that were never synced, e.g. the files of old installs, into
+// a new one, recognising entries by their details instead.
+package replica
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// State maps every host to the highest sequence number of its entries that both replicas
+// had when they were last synced.
+type State map[storage.HostName]int64
+
+// known reports whether both replicas had e when they were last synced.
+func (s State) known(e *storage.Entry) bool {
+	return e.Seq > 0 && e.Seq <= s[e.Host]
+}
+
+// LoadState reads a state saved with Save, a missing file is an empty state, as before the
+// first sync.
+func LoadState(fileLocation string) (State, error) {
+	data, err := os.ReadFile(fileLocation)
+	if errors.Is(err, os.ErrNotExist) {
+		return State{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := State{}
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("could not decode sync state: %w", err)
+	}
+	return state, nil
+}
+
+// Save writes the state atomically, replacing the file at fileLocation.
+func (s State) Save(fileLocation string) error {
+	if err := os.MkdirAll(filepath.Dir(fileLocation), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(fileLocation), filepath.Base(fileLocation)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err = json.NewEncoder(tmp).Encode(s); err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not encode sync state: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileLocation)
+}
+
+// Changes counts what a sync changed on one replica.
+type Changes struct {
+	Added   int `json:"added"`
+	Deleted int `json:"deleted"`
+}
+
+// Report is what a sync changed on both replicas.
+type Report struct {
+	Local Changes `json:"local"`
+	Peer  Changes `json:"peer"`
+}
+
+// side is a replica as it was when the sync started.
+type side struct {
+	storage.StorageStreamer
+	tombstones storage.TombstoneEngine
+	entries    map[string]*storage.Entry
+	changes    *Changes
+	added      []*storage.Entry // copies waiting for flush
+	deleted    []*time.Time     // when each of added was deleted, if it was
+}
+
+func open(s storage.StorageStreamer, changes *Changes) (*side, error) {
+	r := &side{StorageStreamer: s, entries: map[string]*storage.Entry{}, changes: changes}
+	// Entries that could not be read would be taken for deleted.
+	all, err := storage.ReadAll(s)
+	if err != nil {
+		return nil, err
+	}
+	if engine, ok := s.(storage.TombstoneEngine); ok {
+		r.tombstones = engine
+		tombstones, err := engine.Tombstones()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, tombstones...)
+	}
+	// Live entries come first, they win if an entry was stored twice.
+	for _, e := range all {
+		uuid := storage.EntryUUID(e)
+		if _, ok := r.entries[uuid]; !ok {
+			r.entries[uuid] = e
+		}
+	}
+	return r, nil
+}
+
+// remove deletes e, soft-deleting it at the given time if the replica keeps tombstones.
+func (r *side) remove(e *storage.Entry, at time.Time) error {
+	var err error
+	if r.tombstones != nil {
+		err = r.tombstones.Tombstone([]int64{e.Id}, at)
+	} else {
+		err = r.Delete([]int64{e.Id})
+	}
+	if err != nil {
+		return err
+	}
+	r.changes.Deleted++
+	return nil
+}
+
+// add queues a copy of e, and its tombstone, keeping its UUID, sequence number and time.
+// Tombstones are not copied to replicas that can't keep them.
+func (r *side) add(e *storage.Entry) {
+	if e.Deleted != nil && r.tombstones == nil {
+		return
+	}
+	c := &storage.Entry{}
+	e.Copy(c)
+	c.Time = e.Time
+	c.UUID = storage.EntryUUID(e)
+	c.Deleted = nil
+	r.added = append(r.added, c)
+	r.deleted = append(r.deleted, e.Deleted)
+}
+
+// flush stores the queued copies with one AddBatch, then their tombstones.
+func (r *side) flush() error {
+	if len(r.added) == 0 {
+		return nil
+	}
+	stored, err := r.AddBatch(r.added)
+	if err != nil {
+		return err
+	}
+	for i, at := range r.deleted {
+		if at == nil {
+			continue
+		}
+		if err = r.tombstones.Tombstone([]int64{stored[i].Id}, *at); err != nil {
+			return err
+		}
+	}
+	r.changes.Added += len(stored)
+	r.added, r.deleted = nil, nil
+	return nil
+}
+
+// reconcile handles an entry that only from has.
+func reconcile(e *storage.Entry, from, to *side, state State, now time.Time) error {
+	if !state.known(e) {
+		to.add(e)
+		return nil
+	}
+	// The other side deleted it since the last sync.
+	if e.Deleted == nil {
+		return from.remove(e, now)
+	}
+	return nil
+}
+
+// Sync reconciles local and peer, state is that of their last sync and the state to keep
+// for the next one is returned. Entries are deleted at now when the deletion's time is unknown.
+func Sync(local, peer storage.StorageStreamer, state State, now time.Time) (State, *Report, error) {
+	report := &Report{}
+	l, err := open(local, &report.Local)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read local history: %w", err)
+	}
+	p, err := open(peer, &report.Peer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read peer history: %w", err)
+	}
+
+	uuids := make([]string, 0, len(l.entries)+len(p.entries))
+	for uuid := range l.entries {
+		uuids = append(uuids, uuid)
+	}
+	for uuid := range p.entries {
+		if _, ok := l.entries[uuid]; !ok {
+			uuids = append(uuids, uuid)
+		}
+	}
+	// Entries are copied in the order they ran, so ids follow time.
+	entry := func(uuid string) *storage.Entry {
+		if e, ok := l.entries[uuid]; ok {
+			return e
+		}
+		return p.entries[uuid]
+	}
+	sort.SliceStable(uuids, func(i, j int) bool {
+		a, b := entry(uuids[i]), entry(uuids[j])
+		if a.Time != nil && b.Time != nil && !a.Time.Equal(*b.Time) {
+			return a.Time.Before(*b.Time)
+		}
+		if a.Seq != b.Seq {
+			return a.Seq < b.Seq
+		}
+		return uuids[i] < uuids[j]
+	})
+
+	next := State{}
+	for host, seq := range state {
+		next[host] = seq
+	}
+	for _, uuid := range uuids {
+		a, b := l.entries[uuid], p.entries[uuid]
+		switch {
+		case b == nil:
+			err = reconcile(a, l, p, state, now)
+		case a == nil:
+			err = reconcile(b, p, l, state, now)
+		case a.Deleted != nil && b.Deleted == nil:
+			err = p.remove(b, *a.Deleted)
+		case b.Deleted != nil && a.Deleted == nil:
+			err = l.remove(a, *b.Deleted)
+		}
+		if err != nil {
+			return nil, report, err
+		}
+		if e := entry(uuid); e.Seq > next[e.Host] {
+			next[e.Host] = e.Seq
+		}
+	}
+	for _, r := range []*side{l, p} {
+		if err = r.flush(); err != nil {
+			return nil, report, err
+		}
+	}
+	return next, report, nil
+}
@@ -0,0 +1,288 @@
+package replica
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/svanellewee/xenophon/storage"
+	"github.com/svanellewee/xenophon/storage/engines/memory"
+	"github.com/svanellewee/xenophon/storage/storagetest"
+)
+
+func newLaptop(host string) *storage.DatabaseModule {
+	return storage.NewStorageModule(memory.NewMemoryStore(),
+		storage.SetLocationGetter(storagetest.NewLocation("/src")),
+		storage.SetEnvironmentGetter(storagetest.NewEnvironment()),
+		storage.SetSessionGetter(storagetest.NewSession(host+"-1")),
+		storage.SetHostGetter(storagetest.NewHost(host)),
+		storage.SetUndoWindow(time.Hour))
+}
+
+func insert(t *testing.T, db *storage.DatabaseModule, commands ...string) []*storage.Entry {
+	entries := make([]*storage.Entry, 0, len(commands))
+	for _, command := range commands {
+		e, err := db.Insert(command)
+		require.Nil(t, err)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func commands(db *storage.DatabaseModule) []string {
+	return storagetest.Commands(db.LastEntries(100).Output())
+}
+
+func sync(t *testing.T, a, b *storage.DatabaseModule, state State) (State, *Report) {
+	next, report, err := Sync(a.Storage, b.Storage, state, time.Now())
+	require.Nil(t, err)
+	return next, report
+}
+
+func TestSyncOfflineEdits(t *testing.T) {
+	home, work := newLaptop("home"), newLaptop("work")
+	shared := insert(t, home, "git clone", "make")
+	state, report := sync(t, home, work, State{})
+	assert.Equal(t, Report{Peer: Changes{Added: 2}}, *report)
+	assert.Equal(t, []string{"git clone", "make"}, commands(work))
+
+	// Both laptops are used offline, and each forgets an entry.
+	require.Nil(t, home.Forget([]int64{shared[0].Id}))
+	require.Nil(t, work.Forget(storage.Ids(work.LastEntries(1).Output())))
+	insert(t, home, "vim README")
+	insert(t, work, "go test ./...")
+
+	state, report = sync(t, home, work, state)
+	assert.Equal(t, Report{Local: Changes{Added: 1, Deleted: 1}, Peer: Changes{Added: 1, Deleted: 1}}, *report)
+	assert.Equal(t, []string{"vim README", "go test ./..."}, commands(home))
+	assert.ElementsMatch(t, commands(home), commands(work), "the memory engine lists entries in the order they were added")
+
+	// Syncing again changes nothing.
+	_, report = sync(t, home, work, state)
+	assert.Equal(t, Report{}, *report)
+}
+
+// unreachable is a peer whose entries can't be read, like a server that is down.
+type unreachable struct {
+	storage.StorageStreamer
+}
+
+func (u unreachable) LastEntries(n int) storage.ResultStreamer {
+	return storage.IncompleteResults(nil, errors.New("connection refused"))
+}
+
+func TestSyncAbortsWhenUnreadable(t *testing.T) {
+	home, work := newLaptop("home"), newLaptop("work")
+	insert(t, home, "git clone", "make")
+	state, _ := sync(t, home, work, State{})
+
+	// Entries that could not be read are not taken for deleted on the other side.
+	_, _, err := Sync(home.Storage, unreachable{work.Storage}, state, time.Now())
+	assert.ErrorContains(t, err, "connection refused")
+	_, _, err = Sync(unreachable{home.Storage}, work.Storage, state, time.Now())
+	assert.ErrorContains(t, err, "connection refused")
+	assert.Equal(t, []string{"git clone", "make"}, commands(home))
+	assert.Equal(t, []string{"git clone", "make"}, commands(work))
+}
+
+func TestSyncPurgedDeletes(t *testing.T) {
+	home, work := newLaptop("home"), newLaptop("work")
+	insert(t, home, "ls", "pwd")
+	state, _ := sync(t, home, work, State{})
+
+	// A deletion is still propagated once its tombstone has been purged.
+	require.Nil(t, home.Forget(storage.Ids(home.LastEntries(1).Output())))
+	_, err := home.PurgeTombstones(time.Now().Add(2 * time.Hour))
+	require.Nil(t, err)
+	_, report := sync(t, home, work, state)
+	assert.Equal(t, Report{Peer: Changes{Deleted: 1}}, *report)
+	assert.Equal(t, []string{"ls"}, commands(work))
+}
+
+func TestSyncEntriesWithoutUUID(t *testing.T) {
+	at := time.Date(2021, time.March, 4, 5, 6, 7, 0, time.UTC)
+	old := storage.Entry{Command: "make", Location: "/src", Host: "home", Session: "1", Time: &at}
+	home, work := memory.NewMemoryStore(), memory.NewMemoryStore()
+	for _, s := range []storage.StorageStreamer{home, work} {
+		e := old
+		_, err := s.Add(&e)
+		require.Nil(t, err)
+	}
+
+	_, report, err := Sync(home, work, State{}, time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, Report{}, *report, "copies of an old entry are recognised")
+	assert.Equal(t, 1, len(work.LastEntries(10).Output()))
+}
+
+func TestState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sync", "peer.json")
+	state, err := LoadState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, State{}, state)
+
+	assert.Nil(t, State{"home": 12, "work": 7}.Save(path))
+	state, err = LoadState(path)
+	assert.Nil(t, err)
+	assert.Equal(t, State{"home": 12, "work": 7}, state)
+}
+
+const (
+	opInsert = iota
+	opForget
+	opPurge
+	opSync
+	opKinds
+)
+
+type op struct {
+	kind, replica, other, pick int
+}
+
+// scenario is a random sequence of edits and syncs of a number of replicas.
+type scenario struct {
+	replicas int
+	purge    bool
+	ops      []op
+}
+
+func (s scenario) String() string {
+	return fmt.Sprintf("%d replicas, purge %v: %v", s.replicas, s.purge, s.ops)
+}
+
+func generate(replicas int, purge bool) func(values []reflect.Value, r *rand.Rand) {
+	return func(values []reflect.Value, r *rand.Rand) {
+		s := scenario{replicas: replicas, purge: purge}
+		for i := r.Intn(60); i >= 0; i-- {
+			o := op{kind: r.Intn(opKinds), replica: r.Intn(replicas), other: r.Intn(replicas), pick: r.Intn(1000)}
+			if o.kind == opPurge && !purge {
+				o.kind = opInsert
+			}
+			s.ops = append(s.ops, o)
+		}
+		values[0] = reflect.ValueOf(s)
+	}
+}
+
+type pair struct{ a, b int }
+
+// run applies the scenario, then syncs the replicas in a chain twice, and checks that
+// they converged on every entry that was inserted and never forgotten.
+func run(t *testing.T, s scenario) bool {
+	dbs := make([]*storage.DatabaseModule, s.replicas)
+	for i := range dbs {
+		dbs[i] = newLaptop(fmt.Sprintf("laptop-%d", i))
+	}
+	states := map[pair]State{}
+	syncPair := func(a, b int) error {
+		if a > b {
+			a, b = b, a
+		}
+		next, _, err := Sync(dbs[a].Storage, dbs[b].Storage, states[pair{a, b}], time.Now())
+		if err == nil {
+			states[pair{a, b}] = next
+		}
+		return err
+	}
+
+	inserted, forgotten := map[string]bool{}, map[string]bool{}
+	for i, o := range s.ops {
+		db := dbs[o.replica]
+		switch o.kind {
+		case opInsert:
+			e, err := db.Insert(fmt.Sprintf("command %d", i))
+			if err != nil {
+				t.Log(err)
+				return false
+			}
+			inserted[e.UUID] = true
+		case opForget:
+			live := db.LastEntries(1000).Output()
+			if len(live) == 0 {
+				continue
+			}
+			e := live[o.pick%len(live)]
+			if err := db.Forget([]int64{e.Id}); err != nil {
+				t.Log(err)
+				return false
+			}
+			forgotten[e.UUID] = true
+		case opPurge:
+			if _, err := db.PurgeTombstones(time.Now().Add(2 * time.Hour)); err != nil {
+				t.Log(err)
+				return false
+			}
+		case opSync:
+			if o.replica == o.other {
+				continue
+			}
+			if err := syncPair(o.replica, o.other); err != nil {
+				t.Log(err)
+				return false
+			}
+		}
+	}
+	for round := 0; round < 2; round++ {
+		for i := 0; i+1 < len(dbs); i++ {
+			if err := syncPair(i, i+1); err != nil {
+				t.Log(err)
+				return false
+			}
+		}
+	}
+
+	var want []string
+	for uuid := range inserted {
+		if !forgotten[uuid] {
+			want = append(want, uuid)
+		}
+	}
+	sort.Strings(want)
+	for i, db := range dbs {
+		var live []string
+		for _, e := range db.LastEntries(1000).Output() {
+			live = append(live, e.UUID)
+		}
+		sort.Strings(live)
+		if !reflect.DeepEqual(want, live) {
+			t.Logf("replica %d has %v, want %v", i, live, want)
+			return false
+		}
+		tombstones, _ := db.Storage.(storage.TombstoneEngine).Tombstones()
+		seen := map[string]bool{}
+		for _, e := range append(db.LastEntries(1000).Output(), tombstones...) {
+			if seen[e.UUID] {
+				t.Logf("replica %d has %s twice", i, e.UUID)
+				return false
+			}
+			seen[e.UUID] = true
+		}
+	}
+	return true
+}
+
+func TestSyncConverges(t *testing.T) {
+	for _, c := range []struct {
+		replicas int
+		purge    bool
+	}{
+		{2, false},
+		{2, true},
+		{3, false},
+	} {
+		c := c
+		t.Run(fmt.Sprintf("%d replicas, purge %v", c.replicas, c.purge), func(t *testing.T) {
+			property := func(s scenario) bool { return run(t, s) }
+			config := &quick.Config{MaxCount: 200, Values: generate(c.replicas, c.purge)}
+			assert.Nil(t, quick.Check(property, config))
+		})
+	}
+}
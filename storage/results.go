@@ -0,0 +1,170 @@
+package storage
+
+import "time"
+
+// results streams over entries that are already in memory, e.g. loaded by a file based
+// engine or left over from a query that could not be done natively.
+type results struct {
+	entries []*Entry
+	// desc is set when entries run newest first.
+	desc bool
+	// err is why entries are incomplete, kept by every step that follows.
+	err error
+}
+
+// NewResults streams over entries, oldest first.
+func NewResults(entries []*Entry) ResultStreamer {
+	return &results{entries: entries}
+}
+
+// IncompleteResults streams over the entries that could be read, oldest first, while Err
+// reports err for them and the results of every step that follows.
+func IncompleteResults(entries []*Entry, err error) ResultStreamer {
+	return &results{entries: entries, err: err}
+}
+
+// derive streams over entries in the order of r.
+func (r *results) derive(entries []*Entry) *results {
+	return &results{entries: entries, desc: r.desc, err: r.err}
+}
+
+// Err reports why the results are incomplete, see Err.
+func (r *results) Err() error {
+	return r.err
+}
+
+// Output implements ResultStreamer
+func (r *results) Output() []*Entry {
+	return r.entries
+}
+
+// filter keeps the entries that match fltr.
+func (r *results) filter(fltr FilterType) *results {
+	matched := make([]*Entry, 0, DefaultCapacity)
+	for i, entry := range r.entries {
+		if fltr(i, entry) {
+			matched = append(matched, entry)
+		}
+	}
+	return r.derive(matched)
+}
+
+// Filter implements ResultStreamer
+func (r *results) Filter(fltr FilterType) ResultStreamer {
+	return r.filter(fltr)
+}
+
+// Dedup implements ResultStreamer
+func (r *results) Dedup(mode DedupMode) ResultStreamer {
+	if r.desc {
+		// The last entry of a run is the newest one, whichever way the results run.
+		return r.derive(reverse(Dedup(reverse(r.entries), mode)))
+	}
+	return r.derive(Dedup(r.entries, mode))
+}
+
+// LastEntries implements ResultStreamer
+func (r *results) LastEntries(n int) ResultStreamer {
+	if n < 0 {
+		n = 0
+	}
+	if n > len(r.entries) {
+		n = len(r.entries)
+	}
+	last := make([]*Entry, 0, DefaultCapacity)
+	if r.desc {
+		last = append(last, r.entries[:n]...)
+	} else {
+		last = append(last, r.entries[len(r.entries)-n:]...)
+	}
+	return r.derive(last)
+}
+
+// Location implements ResultStreamer
+func (r *results) Location(location string) ResultStreamer {
+	return r.filter(func(index int, entry *Entry) bool {
+		return string(entry.Location) == location
+	})
+}
+
+// Tag implements ResultStreamer
+func (r *results) Tag(name string) ResultStreamer {
+	return r.filter(Tagged(name))
+}
+
+// Period implements ResultStreamer
+func (r *results) Period(start time.Time, end time.Time) ResultStreamer {
+	return r.filter(func(i int, entry *Entry) bool {
+		return !entry.Time.Before(start) && !entry.Time.After(end)
+	})
+}
+
+// reverse returns a reversed copy of entries.
+func reverse(entries []*Entry) []*Entry {
+	reversed := make([]*Entry, len(entries))
+	for i, e := range entries {
+		reversed[len(entries)-1-i] = e
+	}
+	return reversed
+}
+
+// Asc implements ResultStreamer
+func (r *results) Asc() ResultStreamer {
+	if !r.desc {
+		return r.derive(r.entries)
+	}
+	return &results{entries: reverse(r.entries), err: r.err}
+}
+
+// Desc implements ResultStreamer
+func (r *results) Desc() ResultStreamer {
+	if r.desc {
+		return r.derive(r.entries)
+	}
+	return &results{entries: reverse(r.entries), desc: true, err: r.err}
+}
+
+// Limit implements ResultStreamer
+func (r *results) Limit(n int) ResultStreamer {
+	if n < 0 {
+		n = 0
+	}
+	if n > len(r.entries) {
+		n = len(r.entries)
+	}
+	return r.derive(r.entries[:n:n])
+}
+
+// Offset implements ResultStreamer
+func (r *results) Offset(n int) ResultStreamer {
+	if n < 0 {
+		n = 0
+	}
+	if n > len(r.entries) {
+		n = len(r.entries)
+	}
+	return r.derive(r.entries[n:])
+}
+
+// After implements ResultStreamer
+func (r *results) After(id int64) ResultStreamer {
+	for i, e := range r.entries {
+		if e.Id == id {
+			return r.derive(r.entries[i+1:])
+		}
+	}
+	// The entry is not among the results, so compare ids.
+	return r.filter(func(i int, e *Entry) bool {
+		return (!r.desc && e.Id > id) || (r.desc && e.Id < id)
+	})
+}
+
+// Count implements ResultStreamer
+func (r *results) Count() int {
+	return len(r.entries)
+}
+
+// CountBy implements ResultStreamer
+func (r *results) CountBy(group Grouping) []Counted {
+	return CountBy(r.entries, group)
+}
@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"time"
+)
+
+// RetentionRule overrides the maximum age of entries run below Location and/or whose
+// command matches Pattern. Empty fields match everything.
+type RetentionRule struct {
+	Location string        `mapstructure:"location"`
+	Pattern  string        `mapstructure:"pattern"`
+	MaxAge   time.Duration `mapstructure:"maxage"`
+}
+
+// RetentionPolicy decides which entries are pruned. Zero durations and counts are unlimited.
+type RetentionPolicy struct {
+	MaxAge       time.Duration   `mapstructure:"maxage"`
+	MaxCount     int             `mapstructure:"maxcount"`
+	FailedMaxAge time.Duration   `mapstructure:"failedmaxage"` // for commands with a non-zero exit code
+	KeepUnique   bool            `mapstructure:"keepunique"`   // never prune the last run of a command
+	Overrides    []RetentionRule `mapstructure:"overrides"`    // the first matching rule wins
+	Every        int             `mapstructure:"every"`        // prune after every n-th insert, 0 never
+}
+
+// Pruned is an entry removed by a retention policy, and why.
+type Pruned struct {
+	Entry  *Entry
+	Reason string
+}
+
+type compiledRule struct {
+	under   FilterType
+	pattern *regexp.Regexp
+	maxAge  time.Duration
+}
+
+func (p RetentionPolicy) compile() ([]compiledRule, error) {
+	rules := make([]compiledRule, 0, len(p.Overrides))
+	for _, rule := range p.Overrides {
+		c := compiledRule{maxAge: rule.MaxAge}
+		if rule.Location != "" {
+			c.under = UnderLocation(rule.Location)
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid retention pattern %q: %w", rule.Pattern, err)
+			}
+			c.pattern = re
+		}
+		rules = append(rules, c)
+	}
+	return rules, nil
+}
+
+func (c compiledRule) matches(e *Entry) bool {
+	if c.under != nil && !c.under(0, e) {
+		return false
+	}
+	return c.pattern == nil || c.pattern.MatchString(e.Command)
+}
+
+// maxAge is the age after which e expires and the rule that set it, zero if never.
+func (p RetentionPolicy) maxAge(rules []compiledRule, e *Entry) (time.Duration, string) {
+	maxAge, reason := p.MaxAge, "older than maxage"
+	for i, rule := range rules {
+		if rule.matches(e) {
+			maxAge, reason = rule.maxAge, fmt.Sprintf("older than override %d", i+1)
+			break
+		}
+	}
+	failed := e.ExitCode != nil && *e.ExitCode != 0
+	if failed && p.FailedMaxAge > 0 && (maxAge == 0 || p.FailedMaxAge < maxAge) {
+		maxAge, reason = p.FailedMaxAge, "failed and older than failedmaxage"
+	}
+	return maxAge, reason
+}
+
+// Expired returns the entries, given oldest first, that the policy removes at now.
+func (p RetentionPolicy) Expired(entries []*Entry, now time.Time) ([]*Pruned, error) {
+	rules, err := p.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	protected := make(map[int64]bool)
+	if p.KeepUnique {
+		last := make(map[string]int64)
+		for _, e := range entries {
+			last[e.Command] = e.Id
+		}
+		for _, id := range last {
+			protected[id] = true
+		}
+	}
+
+	var pruned []*Pruned
+	kept := make([]*Entry, 0, len(entries))
+	for _, e := range entries {
+		maxAge, reason := p.maxAge(rules, e)
+		if !protected[e.Id] && maxAge > 0 && e.Time != nil && now.Sub(*e.Time) > maxAge {
+			pruned = append(pruned, &Pruned{Entry: e, Reason: reason})
+		} else {
+			kept = append(kept, e)
+		}
+	}
+
+	if p.MaxCount > 0 {
+		excess := len(kept) - p.MaxCount
+		for _, e := range kept {
+			if excess <= 0 {
+				break
+			}
+			if protected[e.Id] {
+				continue
+			}
+			pruned = append(pruned, &Pruned{Entry: e, Reason: "more than maxcount"})
+			excess--
+		}
+	}
+	return pruned, nil
+}
+
+// Prune removes the entries that the policy expires, all or nothing, and reports them.
+// With dryRun nothing is removed.
+func (d *DatabaseModule) Prune(policy RetentionPolicy, now time.Time, dryRun bool) ([]*Pruned, error) {
+	pruned, err := policy.Expired(d.Storage.LastEntries(math.MaxInt32).Output(), now)
+	if err != nil || dryRun || len(pruned) == 0 {
+		return pruned, err
+	}
+
+	ids := make([]int64, 0, len(pruned))
+	for _, p := range pruned {
+		ids = append(ids, p.Entry.Id)
+	}
+	if err = d.Delete(ids); err != nil {
+		return nil, err
+	}
+	return pruned, nil
+}
+
+// PruneHook prunes with policy after every policy.Every-th entry that is inserted.
+func (d *DatabaseModule) PruneHook(policy RetentionPolicy) InsertHook {
+	return func(e *Entry) error {
+		if policy.Every <= 0 || e.Id%int64(policy.Every) != 0 {
+			return nil
+		}
+		_, err := d.Prune(policy, time.Now(), false)
+		return err
+	}
+}
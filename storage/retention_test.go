@@ -0,0 +1,66 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	failed := 1
+	entry := func(id int64, age time.Duration, location, command string, exit *int) *Entry {
+		at := now.Add(-age)
+		return &Entry{Id: id, Time: &at, Location: LocationPath(location), Command: command, ExitCode: exit}
+	}
+	entries := []*Entry{
+		entry(1, 40*day, "/src", "make", nil),
+		entry(2, 40*day, "/src", "rare command", nil),
+		entry(3, 3*day, "/tmp/x", "ls", nil),
+		entry(4, 3*day, "/src", "make", &failed),
+		entry(5, 2*day, "/src", "ls", nil),
+		entry(6, time.Hour, "/src", "make", nil),
+	}
+
+	expiredIds := func(pruned []*Pruned) []int64 {
+		ids := make([]int64, 0, len(pruned))
+		for _, p := range pruned {
+			ids = append(ids, p.Entry.Id)
+		}
+		return ids
+	}
+
+	pruned, err := RetentionPolicy{}.Expired(entries, now)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(pruned))
+
+	pruned, err = RetentionPolicy{MaxAge: 30 * day}.Expired(entries, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2}, expiredIds(pruned))
+
+	pruned, err = RetentionPolicy{MaxAge: 30 * day, KeepUnique: true}.Expired(entries, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1}, expiredIds(pruned))
+
+	pruned, err = RetentionPolicy{
+		MaxAge:       30 * day,
+		FailedMaxAge: day,
+		Overrides: []RetentionRule{
+			{Location: "/tmp", MaxAge: day},
+			{Pattern: "^ls$", MaxAge: 0},
+		},
+	}.Expired(entries, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2, 3, 4}, expiredIds(pruned))
+	assert.Equal(t, "older than override 1", pruned[2].Reason)
+	assert.Equal(t, "failed and older than failedmaxage", pruned[3].Reason)
+
+	pruned, err = RetentionPolicy{MaxCount: 2, KeepUnique: true}.Expired(entries, now)
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 3, 4}, expiredIds(pruned))
+
+	_, err = RetentionPolicy{Overrides: []RetentionRule{{Pattern: "("}}}.Expired(entries, now)
+	assert.NotNil(t, err)
+}
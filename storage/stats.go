@@ -0,0 +1,221 @@
+package storage
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultStatsTop is the number of rows reported per ranking when StatsQuery.Top is unset.
+const DefaultStatsTop = 10
+
+// StatsQuery selects the entries that statistics are computed over. Zero fields select everything.
+type StatsQuery struct {
+	Since    time.Time
+	Until    time.Time
+	Location string // this directory and everything below it
+	Host     HostName
+	Top      int
+}
+
+// Counted is a key, e.g. a command or a directory, with the number of entries that have it.
+type Counted struct {
+	Key   string
+	Count int
+}
+
+// FailureRate is how often runs of a program with a known exit code failed.
+type FailureRate struct {
+	Program string
+	Runs    int
+	Failed  int
+}
+
+func (f FailureRate) Rate() float64 {
+	if f.Runs == 0 {
+		return 0
+	}
+	return float64(f.Failed) / float64(f.Runs)
+}
+
+type Stats struct {
+	Total         int
+	TopCommands   []Counted
+	TopPrograms   []Counted
+	TopLocations  []Counted
+	ByHour        [24]int
+	ByWeekday     [7]int
+	Failures      []FailureRate
+	CurrentStreak int // consecutive days with activity, ending today or yesterday
+	LongestStreak int
+}
+
+// StatsEngine is implemented by engines that can aggregate statistics natively.
+// Engines without it fall back to ComputeStats.
+type StatsEngine interface {
+	Stats(q StatsQuery) (*Stats, error)
+}
+
+func (q StatsQuery) top() int {
+	if q.Top <= 0 {
+		return DefaultStatsTop
+	}
+	return q.Top
+}
+
+// Filter returns the FilterType equivalent of the query.
+func (q StatsQuery) Filter() FilterType {
+	var under FilterType
+	if q.Location != "" {
+		under = UnderLocation(q.Location)
+	}
+	return func(i int, e *Entry) bool {
+		if !q.Since.IsZero() && (e.Time == nil || e.Time.Before(q.Since)) {
+			return false
+		}
+		if !q.Until.IsZero() && (e.Time == nil || e.Time.After(q.Until)) {
+			return false
+		}
+		if q.Host != "" && e.Host != q.Host {
+			return false
+		}
+		return under == nil || under(i, e)
+	}
+}
+
+// Program is the first word of a command.
+func Program(command string) string {
+	command = strings.Trim(command, " ")
+	if i := strings.Index(command, " "); i >= 0 {
+		return command[:i]
+	}
+	return command
+}
+
+// Stats computes statistics over the entries selected by q, natively if the engine supports it.
+func (d *DatabaseModule) Stats(q StatsQuery) (*Stats, error) {
+	if engine, ok := d.Storage.(StatsEngine); ok {
+		return engine.Stats(q)
+	}
+	entries := d.Storage.LastEntries(math.MaxInt32).Filter(q.Filter()).Output()
+	return ComputeStats(entries, q.Top, time.Now()), nil
+}
+
+// ComputeStats aggregates entries in Go, with the top rows of every ranking.
+func ComputeStats(entries []*Entry, top int, now time.Time) *Stats {
+	commands := make(map[string]int)
+	programs := make(map[string]int)
+	locations := make(map[string]int)
+	failures := make(map[string]*FailureRate)
+	days := make(map[string]bool)
+
+	stats := &Stats{Total: len(entries)}
+	for _, e := range entries {
+		commands[e.Command]++
+		program := Program(e.Command)
+		programs[program]++
+		locations[string(e.Location)]++
+
+		if e.ExitCode != nil {
+			f, ok := failures[program]
+			if !ok {
+				f = &FailureRate{Program: program}
+				failures[program] = f
+			}
+			f.Runs++
+			if *e.ExitCode != 0 {
+				f.Failed++
+			}
+		}
+
+		if e.Time != nil {
+			local := e.Time.Local()
+			stats.ByHour[local.Hour()]++
+			stats.ByWeekday[local.Weekday()]++
+			days[local.Format(DayLayout)] = true
+		}
+	}
+
+	top = StatsQuery{Top: top}.top()
+	stats.TopCommands = TopCounted(commands, top)
+	stats.TopPrograms = TopCounted(programs, top)
+	stats.TopLocations = TopCounted(locations, top)
+	for _, f := range failures {
+		stats.Failures = append(stats.Failures, *f)
+	}
+	SortFailures(stats.Failures)
+
+	activeDays := make([]string, 0, len(days))
+	for day := range days {
+		activeDays = append(activeDays, day)
+	}
+	sort.Strings(activeDays)
+	stats.CurrentStreak, stats.LongestStreak = Streaks(activeDays, now)
+	return stats
+}
+
+// TopCounted ranks counts by count, then key, and keeps the first n.
+func TopCounted(counts map[string]int, n int) []Counted {
+	results := make([]Counted, 0, len(counts))
+	for k, c := range counts {
+		results = append(results, Counted{Key: k, Count: c})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Count != results[j].Count {
+			return results[i].Count > results[j].Count
+		}
+		return results[i].Key < results[j].Key
+	})
+	if len(results) > n {
+		results = results[:n]
+	}
+	return results
+}
+
+// SortFailures orders failure rates from most to least failing.
+func SortFailures(failures []FailureRate) {
+	sort.Slice(failures, func(i, j int) bool {
+		if failures[i].Rate() != failures[j].Rate() {
+			return failures[i].Rate() > failures[j].Rate()
+		}
+		if failures[i].Runs != failures[j].Runs {
+			return failures[i].Runs > failures[j].Runs
+		}
+		return failures[i].Program < failures[j].Program
+	})
+}
+
+// DayLayout formats the local calendar day of an entry.
+const DayLayout = "2006-01-02"
+
+// Streaks returns the current and the longest run of consecutive days in the sorted
+// days (formatted with DayLayout). The current streak counts if it ends today or yesterday.
+func Streaks(days []string, now time.Time) (current, longest int) {
+	var previous time.Time
+	run := 0
+	for _, day := range days {
+		t, err := time.ParseInLocation(DayLayout, day, time.Local)
+		if err != nil {
+			continue
+		}
+		if !previous.IsZero() && t.Equal(previous.AddDate(0, 0, 1)) {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		previous = t
+	}
+
+	if previous.IsZero() {
+		return 0, longest
+	}
+	today, _ := time.ParseInLocation(DayLayout, now.Local().Format(DayLayout), time.Local)
+	if previous.Equal(today) || previous.Equal(today.AddDate(0, 0, -1)) {
+		current = run
+	}
+	return current, longest
+}
@@ -10,6 +10,8 @@ import (
 type EntryCount int
 type LocationPath string
 type Environment []string // encrypted bytestring ?
+type SessionID string
+type HostName string
 
 type StorageStreamer interface {
 	ResultStreamer
@@ -17,10 +19,31 @@ type StorageStreamer interface {
 }
 
 type StorageEngine interface {
+	// Add stores a new entry and assigns its id. The entry's time is kept when it is set,
+	// e.g. for entries that were queued or synced, and is the current time otherwise.
 	Add(*Entry) (*Entry, error)
+	// AddBatch stores entries like Add, all or none of them, and returns them in order
+	// with their ids and times.
+	AddBatch(entries []*Entry) ([]*Entry, error)
+	Delete(ids []int64) error
+	DeleteMatching(filter FilterType) (int, error)
 	Close() error
 }
 
+// UpdateEngine is implemented by engines that can rewrite stored entries in place. Update
+// replaces the command, environment and note of the stored entries with the same ids,
+// their ids, times, locations, tags and tombstones are kept. Unknown ids are ignored.
+type UpdateEngine interface {
+	Update(entries []*Entry) error
+}
+
+// ImportEngine is implemented by engines that can store entries under the ids they
+// already have, e.g. to copy a history without renumbering it. Entries added later are
+// numbered after them. Import fails with ErrNoImport if the engine can't keep ids after all.
+type ImportEngine interface {
+	Import(entries []*Entry) error
+}
+
 type LocationGetter interface {
 	Get() (LocationPath, error)
 }
@@ -29,10 +52,29 @@ type EnvironmentGetter interface {
 	Get() (Environment, error)
 }
 
+type SessionGetter interface {
+	Get() (SessionID, error)
+}
+
+type HostGetter interface {
+	Get() (HostName, error)
+}
+
+// InsertHook is called with every entry after it was stored.
+type InsertHook func(e *Entry) error
+
+// ForgetHook is called with the ids of entries after they were forgotten or deleted.
+type ForgetHook func(ids []int64) error
+
 type DatabaseModule struct {
 	Storage     StorageStreamer
 	Locator     LocationGetter
 	Environment EnvironmentGetter
+	Session     SessionGetter
+	Host        HostGetter
+	InsertHooks []InsertHook
+	ForgetHooks []ForgetHook
+	UndoWindow  time.Duration
 	// TimeGetter?
 }
 
@@ -42,6 +84,29 @@ func (*DefaultEnvironment) Get() (Environment, error) {
 	return os.Environ(), nil
 }
 
+// SessionEnv names the variable a shell integration sets to identify its session.
+const SessionEnv = "XENOPHON_SESSION"
+
+// DefaultSession uses $XENOPHON_SESSION, or the parent process (normally the shell) otherwise.
+type DefaultSession struct{}
+
+func (*DefaultSession) Get() (SessionID, error) {
+	if session := os.Getenv(SessionEnv); session != "" {
+		return SessionID(session), nil
+	}
+	return SessionID(fmt.Sprintf("ppid-%d", os.Getppid())), nil
+}
+
+type DefaultHost struct{}
+
+func (*DefaultHost) Get() (HostName, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return HostName(host), nil
+}
+
 type DefaultLocation struct{}
 
 func (*DefaultLocation) Get() (LocationPath, error) {
@@ -54,11 +119,34 @@ func (*DefaultLocation) Get() (LocationPath, error) {
 
 var ErrNotFound = errors.New("could not find entry")
 var ErrBadDataInsert = errors.New("insert had an error")
+var ErrInsertHook = errors.New("entry stored but an insert hook failed")
+var ErrNoUpdate = errors.New("engine does not support updating entries")
+var ErrNoImport = errors.New("engine does not support importing entries with their ids")
 
 const DefaultCapacity = 10
 
+// EntryOpt sets details of an entry that only the caller of Insert knows.
+type EntryOpt func(e *Entry)
+
+// WithExitCode records the exit status of the inserted command.
+func WithExitCode(code int) EntryOpt {
+	return func(e *Entry) {
+		e.ExitCode = &code
+	}
+}
+
 // Insert inserts a command, env data into the datastore and ensures timestamp,id is returned.
-func (d *DatabaseModule) Insert(command string) (*Entry, error) {
+func (d *DatabaseModule) Insert(command string, entryOpts ...EntryOpt) (*Entry, error) {
+	entry, err := d.NewEntry(command, entryOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return d.InsertEntry(entry)
+}
+
+// NewEntry collects the details of a command from the module's getters without storing
+// it, e.g. to send it to a process that does.
+func (d *DatabaseModule) NewEntry(command string, entryOpts ...EntryOpt) (*Entry, error) {
 
 	location, err := d.Locator.Get()
 	if err != nil {
@@ -70,28 +158,117 @@ func (d *DatabaseModule) Insert(command string) (*Entry, error) {
 		return nil, fmt.Errorf("environment could not be determined: %w", err)
 	}
 
-	e, err := d.Storage.Add(&Entry{
+	session, err := d.Session.Get()
+	if err != nil {
+		return nil, fmt.Errorf("session could not be determined: %w", err)
+	}
+
+	host, err := d.Host.Get()
+	if err != nil {
+		return nil, fmt.Errorf("host could not be determined: %w", err)
+	}
+
+	entry := &Entry{
 		Location: location,
 		Command:  command,
 		Env:      environment,
-	})
+		Session:  session,
+		Host:     host,
+	}
+	for _, opt := range entryOpts {
+		opt(entry)
+	}
+	return entry, nil
+}
+
+// InsertEntry stores an entry whose details were collected elsewhere, e.g. by a remote
+// client, and runs the insert hooks like Insert. Entries without a UUID or sequence
+// number are given one.
+func (d *DatabaseModule) InsertEntry(entry *Entry) (*Entry, error) {
+	if err := d.identify([]*Entry{entry}); err != nil {
+		return nil, err
+	}
+	e, err := d.Storage.Add(entry)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if e == nil {
-		return nil, ErrNotFound
+	if err = checkStored(e); err != nil {
+		return nil, err
 	}
 
-	if e.Time == nil {
-		return nil, ErrBadDataInsert
+	for _, hook := range d.InsertHooks {
+		if err = hook(e); err != nil {
+			return e, fmt.Errorf("%w: %v", ErrInsertHook, err)
+		}
 	}
+	return e, nil
+}
 
-	if e.Id <= 0 {
+// InsertEntries stores entries like InsertEntry, with a single AddBatch. The hooks run
+// for every entry, the first hook error is returned once all are stored.
+func (d *DatabaseModule) InsertEntries(entries []*Entry) ([]*Entry, error) {
+	if err := d.identify(entries); err != nil {
+		return nil, err
+	}
+	stored, err := d.Storage.AddBatch(entries)
+	if err != nil {
+		return nil, err
+	}
+	if len(stored) != len(entries) {
 		return nil, ErrBadDataInsert
 	}
-	return e, nil
+
+	var hookErr error
+	for _, e := range stored {
+		if err = checkStored(e); err != nil {
+			return nil, err
+		}
+		for _, hook := range d.InsertHooks {
+			if err = hook(e); err != nil && hookErr == nil {
+				hookErr = fmt.Errorf("%w: %v", ErrInsertHook, err)
+			}
+		}
+	}
+	return stored, hookErr
+}
+
+// identify gives entries without a UUID or sequence number one. Entries of the same host
+// are numbered in order.
+func (d *DatabaseModule) identify(entries []*Entry) error {
+	last := make(map[HostName]int64)
+	for _, e := range entries {
+		if e.UUID == "" {
+			e.UUID = NewUUID()
+		}
+		if e.Seq != 0 {
+			continue
+		}
+		seq, ok := last[e.Host]
+		if !ok {
+			var err error
+			if seq, err = d.NextSeq(e.Host, time.Now()); err != nil {
+				return fmt.Errorf("sequence number could not be determined: %w", err)
+			}
+		} else {
+			seq++
+		}
+		e.Seq, last[e.Host] = seq, seq
+	}
+	return nil
+}
+
+// checkStored verifies what the engine returned for a stored entry. Negative ids are
+// provisional, handed out for entries the engine has yet to store for good.
+func checkStored(e *Entry) error {
+	if e == nil {
+		return ErrNotFound
+	}
+	if e.Time == nil || e.Id == 0 {
+		return ErrBadDataInsert
+	}
+	return nil
 }
 
 // LastEntries provides the last N entries
@@ -0,0 +1,102 @@
+// Package storagetest provides fakes for the DatabaseModule getters and a conformance
+// suite that every storage engine's tests run, so all engines are verified the same way.
+package storagetest
+
+import "github.com/svanellewee/xenophon/storage"
+
+// Location is a storage.LocationGetter that returns whatever was last Set.
+type Location struct {
+	where string
+	err   error
+}
+
+func NewLocation(where string) *Location {
+	return &Location{where: where}
+}
+
+func (l *Location) Set(where string, err error) {
+	l.where = where
+	l.err = err
+}
+
+func (l *Location) Get() (storage.LocationPath, error) {
+	if l.err != nil {
+		return "", l.err
+	}
+	return storage.LocationPath(l.where), nil
+}
+
+// Environment is a storage.EnvironmentGetter that returns whatever was last Set.
+type Environment struct {
+	env []string
+	err error
+}
+
+func NewEnvironment(env ...string) *Environment {
+	return &Environment{env: env}
+}
+
+func (e *Environment) Set(env []string, err error) {
+	e.env = env
+	e.err = err
+}
+
+func (e *Environment) Get() (storage.Environment, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	return e.env, nil
+}
+
+// Session is a storage.SessionGetter that returns whatever was last Set.
+type Session struct {
+	id  string
+	err error
+}
+
+func NewSession(id string) *Session {
+	return &Session{id: id}
+}
+
+func (s *Session) Set(id string, err error) {
+	s.id = id
+	s.err = err
+}
+
+func (s *Session) Get() (storage.SessionID, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	return storage.SessionID(s.id), nil
+}
+
+// Host is a storage.HostGetter that returns whatever was last Set.
+type Host struct {
+	name string
+	err  error
+}
+
+func NewHost(name string) *Host {
+	return &Host{name: name}
+}
+
+func (h *Host) Set(name string, err error) {
+	h.name = name
+	h.err = err
+}
+
+func (h *Host) Get() (storage.HostName, error) {
+	if h.err != nil {
+		return "", h.err
+	}
+	return storage.HostName(h.name), nil
+}
+
+// Commands lists the commands of entries, in order.
+func Commands(entries []*storage.Entry) []string {
+	results := make([]string, 0, len(entries))
+	for _, e := range entries {
+		results = append(results, e.Command)
+	}
+	return results
+}
@@ -0,0 +1,649 @@
+package storagetest
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/svanellewee/xenophon/storage"
+)
+
+// Factory opens a new, empty engine for a single test. The suite closes it.
+type Factory func(t *testing.T) storage.StorageStreamer
+
+type conformanceTest struct {
+	name string
+	test func(t *testing.T, s storage.StorageStreamer)
+}
+
+var conformanceTests = []conformanceTest{
+	{"Ordering", testOrdering},
+	{"PeriodBoundaries", testPeriodBoundaries},
+	{"KeepsTime", testKeepsTime},
+	{"KeepsIdentity", testKeepsIdentity},
+	{"AddBatch", testAddBatch},
+	{"LocationMatching", testLocationMatching},
+	{"LocationCase", testLocationCase},
+	{"FilterChaining", testFilterChaining},
+	{"Query", testQuery},
+	{"Chaining", testChaining},
+	{"Dedup", testDedup},
+	{"Paging", testPaging},
+	{"Counts", testCounts},
+	{"EmptyResults", testEmptyResults},
+	{"Delete", testDelete},
+	{"Tombstones", testTombstones},
+	{"Update", testUpdate},
+	{"Tags", testTags},
+	{"Notes", testNotes},
+	{"TombstoneNotes", testTombstoneNotes},
+	{"Import", testImport},
+	{"Concurrency", testConcurrency},
+}
+
+// Run verifies that the engines opened by factory behave like every other engine.
+func Run(t *testing.T, factory Factory) {
+	for _, ct := range conformanceTests {
+		ct := ct
+		t.Run(ct.name, func(t *testing.T) {
+			s := factory(t)
+			defer s.Close()
+			ct.test(t, s)
+		})
+	}
+}
+
+// insert stores commands run at location.
+func insert(t *testing.T, s storage.StorageStreamer, location string, commands ...string) []*storage.Entry {
+	mod := storage.NewStorageModule(s,
+		storage.SetLocationGetter(NewLocation(location)),
+		storage.SetEnvironmentGetter(NewEnvironment()))
+	entries := make([]*storage.Entry, 0, len(commands))
+	for _, command := range commands {
+		e, err := mod.Insert(command)
+		require.Nil(t, err)
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func testOrdering(t *testing.T, s storage.StorageStreamer) {
+	inserted := insert(t, s, "/", "one", "two", "three", "four", "five")
+	for i, e := range inserted {
+		assert.Equal(t, "/", string(e.Location))
+		assert.NotNil(t, e.Time)
+		if i > 0 {
+			assert.Greater(t, e.Id, inserted[i-1].Id, "ids increase")
+			assert.False(t, e.Time.Before(*inserted[i-1].Time), "times do not decrease")
+		}
+	}
+
+	assert.Equal(t, []string{"three", "four", "five"}, Commands(s.LastEntries(3).Output()))
+	assert.Equal(t, []string{"one", "two", "three", "four", "five"}, Commands(s.LastEntries(10).Output()))
+	assert.Equal(t, storage.Ids(inserted), storage.Ids(s.LastEntries(5).Output()))
+	assert.Equal(t, []string{"one", "two", "three", "four", "five"}, Commands(s.Location("/").Output()))
+}
+
+func testPeriodBoundaries(t *testing.T, s storage.StorageStreamer) {
+	first := insert(t, s, "/", "first")[0]
+	// Engines may store times with a resolution of a second.
+	time.Sleep(1100 * time.Millisecond)
+	second := insert(t, s, "/", "second")[0]
+
+	assert.Equal(t, []string{"first"}, Commands(s.Period(*first.Time, *first.Time).Output()), "start and end are inclusive")
+	assert.Equal(t, []string{"second"}, Commands(s.Period(*second.Time, *second.Time).Output()))
+	assert.Equal(t, []string{"first", "second"}, Commands(s.Period(*first.Time, *second.Time).Output()))
+	assert.Equal(t, []string{"first", "second"}, Commands(s.Period(first.Time.Add(-time.Hour), second.Time.Add(time.Hour)).Output()))
+	assert.Equal(t, 0, len(s.Period(first.Time.Add(-2*time.Hour), first.Time.Add(-time.Hour)).Output()))
+	assert.Equal(t, 0, len(s.Period(second.Time.Add(time.Hour), second.Time.Add(2*time.Hour)).Output()))
+	assert.Equal(t, 0, len(s.Period(*second.Time, *first.Time).Output()), "start after end")
+}
+
+func testKeepsTime(t *testing.T, s storage.StorageStreamer) {
+	at := time.Date(2020, time.February, 3, 4, 5, 6, 0, time.UTC)
+	e, err := s.Add(&storage.Entry{Command: "queued", Location: "/", Time: &at})
+	require.Nil(t, err)
+	require.NotNil(t, e.Time)
+	assert.True(t, at.Equal(*e.Time), "the given time is stored")
+	insert(t, s, "/", "now")
+
+	assert.Equal(t, []string{"queued"}, Commands(s.Period(at, at).Output()))
+	assert.Equal(t, []string{"now"}, Commands(s.Period(at.Add(time.Hour), time.Now().Add(time.Hour)).Output()))
+	entries := s.LastEntries(10).Output()
+	assert.Equal(t, []string{"queued", "now"}, Commands(entries))
+	assert.True(t, at.Equal(*entries[0].Time))
+}
+
+func testKeepsIdentity(t *testing.T, s storage.StorageStreamer) {
+	e, err := s.Add(&storage.Entry{Command: "synced", Location: "/", Host: "laptop", UUID: "8b1d0f5e-1c2a-4f4b-9d7e-3a5c6b7d8e9f", Seq: 42})
+	require.Nil(t, err)
+	assert.Equal(t, "8b1d0f5e-1c2a-4f4b-9d7e-3a5c6b7d8e9f", e.UUID)
+	assert.Equal(t, int64(42), e.Seq)
+
+	entries := s.LastEntries(10).Output()
+	require.Equal(t, 1, len(entries))
+	assert.Equal(t, "8b1d0f5e-1c2a-4f4b-9d7e-3a5c6b7d8e9f", entries[0].UUID)
+	assert.Equal(t, int64(42), entries[0].Seq)
+	assert.Equal(t, storage.HostName("laptop"), entries[0].Host)
+}
+
+func testAddBatch(t *testing.T, s storage.StorageStreamer) {
+	stored, err := s.AddBatch(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(stored))
+
+	insert(t, s, "/", "before")
+	at := time.Date(2020, time.February, 3, 4, 5, 6, 0, time.UTC)
+	stored, err = s.AddBatch([]*storage.Entry{
+		{Command: "one", Location: "/a", Host: "laptop"},
+		{Command: "two", Location: "/b", Time: &at, UUID: "0e6f3a52-4f7d-4b8e-a1c2-d3e4f5a6b7c8"},
+		{Command: "three", Location: "/a"},
+	})
+	require.Nil(t, err)
+	require.Equal(t, []string{"one", "two", "three"}, Commands(stored), "entries are returned in order")
+	for i, e := range stored {
+		require.NotNil(t, e.Time)
+		if i > 0 {
+			assert.Greater(t, e.Id, stored[i-1].Id, "ids increase")
+		}
+	}
+	assert.True(t, at.Equal(*stored[1].Time), "the given time is kept")
+	assert.Equal(t, "0e6f3a52-4f7d-4b8e-a1c2-d3e4f5a6b7c8", stored[1].UUID)
+	assert.Equal(t, storage.HostName("laptop"), stored[0].Host)
+
+	assert.Equal(t, []string{"before", "one", "two", "three"}, Commands(s.LastEntries(10).Output()))
+	assert.Equal(t, []string{"one", "three"}, Commands(s.Location("/a").Output()))
+	assert.Equal(t, []string{"two"}, Commands(s.Period(at, at).Output()))
+}
+
+func testLocationMatching(t *testing.T, s storage.StorageStreamer) {
+	insert(t, s, "/", "root")
+	insert(t, s, "/tmp", "tmp")
+	insert(t, s, "/tmp/x", "below tmp")
+	insert(t, s, "/TMP", "upper case")
+	insert(t, s, "/tmp", "tmp again")
+
+	assert.Equal(t, []string{"root"}, Commands(s.Location("/").Output()))
+	assert.Equal(t, []string{"tmp", "tmp again"}, Commands(s.Location("/tmp").Output()), "locations match exactly")
+	assert.Equal(t, []string{"below tmp"}, Commands(s.Location("/tmp/x").Output()))
+	assert.Equal(t, 0, len(s.Location("/tm").Output()))
+	assert.Equal(t, 0, len(s.Location("/nowhere").Output()))
+}
+
+func testLocationCase(t *testing.T, s storage.StorageStreamer) {
+	insert(t, s, "/src/app", "lower")
+	insert(t, s, "/Src/App", "mixed")
+	insert(t, s, "/src/app/Web", "below")
+	insert(t, s, "/SRC/APP/web", "upper")
+
+	mod := storage.NewStorageModule(s)
+	for _, c := range []struct {
+		query    string
+		expected []string
+	}{
+		{`dir:/src/**`, []string{"lower", "below"}},
+		{`dir:/Src/**`, []string{"mixed"}},
+		{`dir:/SRC/APP/**`, []string{"upper"}},
+		{`dir:/src/app/web/**`, []string{}},
+	} {
+		q, err := storage.ParseQuery(c.query, time.Now())
+		require.Nil(t, err, c.query)
+		results, err := mod.Query(q)
+		require.Nil(t, err, c.query)
+		assert.Equal(t, c.expected, Commands(results.Output()), "directories are case-sensitive: %s", c.query)
+	}
+
+	stats, err := mod.Stats(storage.StatsQuery{Location: "/src"})
+	require.Nil(t, err)
+	assert.Equal(t, 2, stats.Total, "directories are case-sensitive")
+}
+
+func commandIs(command string) storage.FilterType {
+	return func(i int, e *storage.Entry) bool {
+		return e.Command == command
+	}
+}
+
+func testFilterChaining(t *testing.T, s storage.StorageStreamer) {
+	insert(t, s, "/src", "make", "make test", "git status")
+	insert(t, s, "/tmp", "make", "ls")
+
+	startsWithMake := func(i int, e *storage.Entry) bool {
+		return len(e.Command) >= 4 && e.Command[:4] == "make"
+	}
+	inSrc := func(i int, e *storage.Entry) bool {
+		return e.Location == "/src"
+	}
+
+	assert.Equal(t, []string{"make", "make test", "make"}, Commands(s.LastEntries(10).Filter(startsWithMake).Output()))
+	assert.Equal(t, []string{"make", "make test"}, Commands(s.LastEntries(10).Filter(startsWithMake).Filter(inSrc).Output()))
+	assert.Equal(t, []string{"make"}, Commands(s.LastEntries(10).Filter(startsWithMake).Filter(inSrc).Filter(commandIs("make")).Output()))
+	assert.Equal(t, 0, len(s.LastEntries(10).Filter(startsWithMake).Filter(commandIs("ls")).Output()))
+	assert.Equal(t, []string{"make"}, Commands(s.LastEntries(2).Filter(startsWithMake).Output()))
+	assert.Equal(t, []string{"make"}, Commands(s.Location("/tmp").Filter(startsWithMake).Output()))
+
+	// Filters see the position of each entry in the results they filter.
+	var positions []int
+	s.LastEntries(10).Filter(inSrc).Filter(func(i int, e *storage.Entry) bool {
+		positions = append(positions, i)
+		return true
+	})
+	assert.Equal(t, []int{0, 1, 2}, positions)
+}
+
+func testQuery(t *testing.T, s storage.StorageStreamer) {
+	now := time.Date(2021, time.March, 10, 12, 0, 0, 0, time.UTC)
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+	ok, failed := 0, 2
+	_, err := s.AddBatch([]*storage.Entry{
+		{Command: "git status", Location: "/src/app", Host: "laptop", ExitCode: &ok, Time: ago(72 * time.Hour)},
+		{Command: "git push", Location: "/src/app", Host: "laptop", ExitCode: &failed, Time: ago(time.Hour)},
+		{Command: "make test", Location: "/src/app/web", Host: "desktop", ExitCode: &failed, Time: ago(time.Hour)},
+		{Command: "ls -la", Location: "/tmp", Host: "laptop", Time: ago(time.Minute)},
+		{Command: "legit", Location: "/src", Host: "laptop", ExitCode: &ok, Session: "s1", Time: ago(time.Minute)},
+	})
+	require.Nil(t, err)
+	forgotten, err := s.Add(&storage.Entry{Command: "git stash", Location: "/src/app", Host: "laptop", Time: ago(time.Minute)})
+	require.Nil(t, err)
+	require.Nil(t, s.Delete([]int64{forgotten.Id}))
+
+	mod := storage.NewStorageModule(s)
+	for _, c := range []struct {
+		query    string
+		expected []string
+	}{
+		{``, []string{"git status", "git push", "make test", "ls -la", "legit"}},
+		{`cmd~"^git" and dir:/src/** and since:2d and exit!=0 and host:laptop`, []string{"git push"}},
+		{`cmd~^git`, []string{"git status", "git push"}},
+		{`git`, []string{"git status", "git push", "legit"}},
+		{`cmd="git push" or cmd="ls -la"`, []string{"git push", "ls -la"}},
+		{`cmd!~git`, []string{"make test", "ls -la"}},
+		{`dir:/src/**`, []string{"git status", "git push", "make test", "legit"}},
+		{`dir:/src`, []string{"legit"}},
+		{`dir:/src/*`, []string{"git status", "git push"}},
+		{`dir:/src/**/web`, []string{"make test"}},
+		{`dir!=/tmp`, []string{"git status", "git push", "make test", "legit"}},
+		{`exit=0`, []string{"git status", "legit"}},
+		{`exit>0`, []string{"git push", "make test"}},
+		{`not exit=0`, []string{"git push", "make test", "ls -la"}},
+		{`since:2h`, []string{"git push", "make test", "ls -la", "legit"}},
+		{`until:2h`, []string{"git status"}},
+		{`since:2021-03-09 until:2021-03-10T11:30:00Z`, []string{"git push", "make test"}},
+		{`host!=laptop`, []string{"make test"}},
+		{`host~^desk or session:s1`, []string{"make test", "legit"}},
+		{`(cmd:git or cmd:make) and not (exit=0 or host:desktop)`, []string{"git push"}},
+	} {
+		q, err := storage.ParseQuery(c.query, now)
+		require.Nil(t, err, c.query)
+		results, err := mod.Query(q)
+		require.Nil(t, err, c.query)
+		assert.Equal(t, c.expected, Commands(results.Output()), c.query)
+		assert.Equal(t, c.expected, Commands(s.LastEntries(10).Filter(q.Filter()).Output()), "filter of %s", c.query)
+	}
+}
+
+func testChaining(t *testing.T, s storage.StorageStreamer) {
+	insert(t, s, "/a", "one")
+	insert(t, s, "/b", "two")
+	insert(t, s, "/a", "three")
+
+	assert.Equal(t, []string{"three"}, Commands(s.LastEntries(2).Location("/a").Output()), "steps apply to the results before them")
+	assert.Equal(t, []string{"three"}, Commands(s.Location("/a").LastEntries(1).Output()))
+	assert.Equal(t, []string{"one", "three"}, Commands(s.Period(time.Now().Add(-time.Hour), time.Now().Add(time.Hour)).Location("/a").Output()))
+	assert.Equal(t, []string{"two", "three"}, Commands(s.Filter(func(i int, e *storage.Entry) bool { return e.Command != "one" }).Output()))
+	assert.Equal(t, []string{"three"}, Commands(s.Filter(commandIs("three")).LastEntries(5).Output()))
+}
+
+// counts lists the Count of entries.
+func counts(entries []*storage.Entry) []int {
+	results := make([]int, 0, len(entries))
+	for _, e := range entries {
+		results = append(results, e.Count)
+	}
+	return results
+}
+
+func testDedup(t *testing.T, s storage.StorageStreamer) {
+	insert(t, s, "/a", "ls", "ls", "git status", "ls")
+	insert(t, s, "/b", "git status", "git status", "make")
+	insert(t, s, "/a", "make")
+
+	collapsed := s.Dedup(storage.DedupConsecutive).Output()
+	assert.Equal(t, []string{"ls", "git status", "ls", "git status", "make"}, Commands(collapsed))
+	assert.Equal(t, []int{2, 1, 1, 2, 2}, counts(collapsed))
+	assert.Equal(t, "/a", string(collapsed[4].Location), "the last of a run is kept")
+
+	unique := s.Dedup(storage.DedupUnique).Output()
+	assert.Equal(t, []string{"ls", "git status", "make"}, Commands(unique), "in the order of their last run")
+	assert.Equal(t, []int{3, 3, 2}, counts(unique))
+	all := s.LastEntries(10).Output()
+	assert.Equal(t, all[len(all)-1].Id, unique[2].Id)
+
+	assert.Equal(t, 0, counts(all)[0], "entries that weren't deduplicated have no count")
+	assert.Equal(t, all, s.LastEntries(10).Dedup(storage.DedupNone).Output())
+	assert.Equal(t, 0, len(s.Location("/nowhere").Dedup(storage.DedupUnique).Output()))
+
+	// Dedup applies to the results before it, and counts add up when repeated.
+	inA := s.Location("/a").Dedup(storage.DedupUnique).Output()
+	assert.Equal(t, []string{"git status", "ls", "make"}, Commands(inA))
+	assert.Equal(t, []int{1, 3, 1}, counts(inA))
+	twice := s.Dedup(storage.DedupConsecutive).Dedup(storage.DedupUnique).Output()
+	assert.Equal(t, Commands(unique), Commands(twice))
+	assert.Equal(t, []int{3, 3, 2}, counts(twice))
+	filtered := s.Filter(func(i int, e *storage.Entry) bool { return e.Command != "make" }).Dedup(storage.DedupUnique).Output()
+	assert.Equal(t, []int{3, 3}, counts(filtered))
+}
+
+func testPaging(t *testing.T, s storage.StorageStreamer) {
+	inserted := insert(t, s, "/a", "one", "two", "three")
+	insert(t, s, "/b", "four")
+	inserted = append(inserted, insert(t, s, "/a", "five", "six")...)
+
+	assert.Equal(t, []string{"six", "five", "four", "three", "two", "one"}, Commands(s.Desc().Output()))
+	assert.Equal(t, []string{"one", "two"}, Commands(s.Desc().Asc().Limit(2).Output()))
+	assert.Equal(t, []string{"six", "five"}, Commands(s.Location("/a").Limit(20).Desc().Limit(2).Output()))
+	assert.Equal(t, []string{"five", "three"}, Commands(s.Location("/a").Desc().Offset(1).Limit(2).Output()))
+	assert.Equal(t, []string{"six", "five"}, Commands(s.Desc().LastEntries(2).Output()), "the last entries are the newest")
+	assert.Equal(t, []string{"two", "three"}, Commands(s.Desc().Location("/a").Asc().Offset(1).Limit(2).Output()))
+	assert.Equal(t, []string{"six"}, Commands(s.Desc().Filter(commandIs("six")).Desc().Output()))
+	assert.Equal(t, []string{"five", "four"}, Commands(s.Desc().Filter(func(i int, e *storage.Entry) bool { return e.Command != "six" }).LastEntries(2).Output()))
+	assert.Equal(t, 0, len(s.Limit(0).Output()))
+	assert.Equal(t, 0, len(s.Limit(-1).Output()))
+	assert.Equal(t, 0, len(s.Offset(10).Output()))
+
+	// Page by the last entry of the previous page.
+	var pages [][]string
+	page := s.Location("/a").Desc().Limit(2).Output()
+	for len(page) > 0 {
+		pages = append(pages, Commands(page))
+		page = s.Location("/a").Desc().After(page[len(page)-1].Id).Limit(2).Output()
+	}
+	assert.Equal(t, [][]string{{"six", "five"}, {"three", "two"}, {"one"}}, pages)
+	assert.Equal(t, []string{"three", "four"}, Commands(s.After(inserted[1].Id).Limit(2).Output()))
+	assert.Equal(t, []string{"four", "three"}, Commands(s.LastEntries(10).Desc().After(inserted[3].Id).Limit(2).Output()))
+
+	// Deduplicated results keep the newest entry of a run in either order.
+	insert(t, s, "/a", "six")
+	newest := s.Desc().Dedup(storage.DedupConsecutive).Limit(1).Output()
+	assert.Equal(t, []int{2}, counts(newest))
+	assert.Equal(t, s.Limit(10).Desc().Limit(1).Output()[0].Id, newest[0].Id)
+}
+
+func testCounts(t *testing.T, s storage.StorageStreamer) {
+	assert.Equal(t, 0, s.Count())
+	assert.Equal(t, 0, len(s.CountBy(storage.GroupCommand)))
+
+	yesterday := time.Now().AddDate(0, 0, -1)
+	_, err := s.Add(&storage.Entry{Command: "make", Location: "/b", Time: &yesterday})
+	require.Nil(t, err)
+	insert(t, s, "/a", "ls", "make", "ls")
+	insert(t, s, "/b", "git status", "ls")
+
+	assert.Equal(t, 6, s.Count())
+	assert.Equal(t, 3, s.Location("/a").Count())
+	assert.Equal(t, 3, s.Filter(commandIs("ls")).Count())
+	assert.Equal(t, 2, s.Desc().Limit(2).Count())
+	assert.Equal(t, 3, s.Dedup(storage.DedupUnique).Count(), "deduplicated entries count once")
+	assert.Equal(t, 0, s.Location("/nowhere").Count())
+
+	assert.Equal(t, []storage.Counted{{Key: "ls", Count: 3}, {Key: "make", Count: 2}, {Key: "git status", Count: 1}},
+		s.CountBy(storage.GroupCommand), "most first")
+	assert.Equal(t, []storage.Counted{{Key: "/a", Count: 3}, {Key: "/b", Count: 3}},
+		s.CountBy(storage.GroupLocation), "then by key")
+	assert.Equal(t, []storage.Counted{
+		{Key: time.Now().Format(storage.DayLayout), Count: 5},
+		{Key: yesterday.Format(storage.DayLayout), Count: 1},
+	}, s.CountBy(storage.GroupDay))
+	assert.Equal(t, []storage.Counted{{Key: "ls", Count: 2}, {Key: "make", Count: 1}},
+		s.Location("/a").CountBy(storage.GroupCommand))
+}
+
+func testEmptyResults(t *testing.T, s storage.StorageStreamer) {
+	never := func(i int, e *storage.Entry) bool { return false }
+
+	assert.Equal(t, 0, len(s.LastEntries(10).Output()))
+	assert.Equal(t, 0, len(s.Location("/").Output()))
+	assert.Equal(t, 0, len(s.Period(time.Now().Add(-time.Hour), time.Now()).Output()))
+	assert.Equal(t, 0, len(s.LastEntries(10).Filter(never).Output()))
+
+	insert(t, s, "/", "ls")
+	assert.Equal(t, 0, len(s.LastEntries(0).Output()))
+	assert.Equal(t, 0, len(s.LastEntries(10).Filter(never).Output()))
+	assert.Equal(t, 0, len(s.LastEntries(10).Filter(never).Filter(never).Output()))
+}
+
+func testDelete(t *testing.T, s storage.StorageStreamer) {
+	inserted := insert(t, s, "/", "a", "b", "c", "d")
+
+	require.Nil(t, s.Delete([]int64{inserted[1].Id}))
+	assert.Equal(t, []string{"a", "c", "d"}, Commands(s.LastEntries(10).Output()))
+	require.Nil(t, s.Delete(nil))
+	require.Nil(t, s.Delete([]int64{inserted[1].Id}), "deleting twice is not an error")
+
+	n, err := s.DeleteMatching(func(i int, e *storage.Entry) bool { return e.Command != "c" })
+	require.Nil(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{"c"}, Commands(s.LastEntries(10).Output()))
+	assert.Equal(t, []string{"c"}, Commands(s.Location("/").Output()))
+
+	e := insert(t, s, "/", "e")[0]
+	assert.Greater(t, e.Id, inserted[3].Id, "ids are not reused")
+}
+
+func testTombstones(t *testing.T, s storage.StorageStreamer) {
+	engine, ok := s.(storage.TombstoneEngine)
+	if !ok {
+		t.Skip("engine does not implement storage.TombstoneEngine")
+	}
+	inserted := insert(t, s, "/", "a", "b", "c")
+	at := time.Now()
+
+	require.Nil(t, engine.Tombstone([]int64{inserted[0].Id, inserted[2].Id}, at))
+	assert.Equal(t, []string{"b"}, Commands(s.LastEntries(10).Output()))
+	assert.Equal(t, []string{"b"}, Commands(s.Location("/").Output()))
+
+	tombstones, err := engine.Tombstones()
+	require.Nil(t, err)
+	assert.Equal(t, []string{"a", "c"}, Commands(tombstones))
+	for _, e := range tombstones {
+		require.NotNil(t, e.Deleted)
+		assert.Equal(t, at.Unix(), e.Deleted.Unix())
+	}
+
+	require.Nil(t, engine.Restore([]int64{inserted[0].Id}))
+	assert.Equal(t, []string{"a", "b"}, Commands(s.LastEntries(10).Output()))
+
+	require.Nil(t, s.Delete([]int64{inserted[2].Id}))
+	tombstones, err = engine.Tombstones()
+	require.Nil(t, err)
+	assert.Equal(t, 0, len(tombstones))
+}
+
+func testImport(t *testing.T, s storage.StorageStreamer) {
+	engine, ok := s.(storage.ImportEngine)
+	if !ok {
+		t.Skip("engine does not implement storage.ImportEngine")
+	}
+	at := time.Date(2021, time.May, 6, 7, 8, 9, 0, time.UTC)
+	err := engine.Import([]*storage.Entry{
+		{Id: 3, Command: "three", Location: "/", Time: &at, UUID: "5f0c6b1e-8a4d-4c3b-9e2f-1a2b3c4d5e6f"},
+		{Id: 7, Command: "seven", Location: "/src", Time: &at},
+	})
+	if errors.Is(err, storage.ErrNoImport) {
+		t.Skip("engine can't keep ids")
+	}
+	require.Nil(t, err)
+	added := insert(t, s, "/", "later")
+
+	assert.Greater(t, added[0].Id, int64(7), "later entries are numbered after the imported ones")
+	entries := s.LastEntries(10).Output()
+	assert.Equal(t, []string{"three", "seven", "later"}, Commands(entries))
+	assert.Equal(t, []int64{3, 7, added[0].Id}, storage.Ids(entries))
+	assert.True(t, at.Equal(*entries[0].Time))
+	assert.Equal(t, "5f0c6b1e-8a4d-4c3b-9e2f-1a2b3c4d5e6f", entries[0].UUID)
+	assert.Equal(t, []string{"seven"}, Commands(s.Location("/src").Output()))
+}
+
+func testUpdate(t *testing.T, s storage.StorageStreamer) {
+	engine, ok := s.(storage.UpdateEngine)
+	if !ok {
+		t.Skip("engine does not implement storage.UpdateEngine")
+	}
+	inserted := insert(t, s, "/", "a", "b", "c")
+
+	require.Nil(t, engine.Update([]*storage.Entry{
+		{Id: inserted[0].Id, Command: "A"},
+		{Id: inserted[2].Id, Command: "C", Location: "/elsewhere"},
+		{Id: inserted[2].Id + 1000, Command: "unknown"},
+	}))
+	assert.Equal(t, []string{"A", "b", "C"}, Commands(s.LastEntries(10).Output()))
+	assert.Equal(t, []string{"A", "b", "C"}, Commands(s.Location("/").Output()), "locations are kept")
+	updated := s.Period(*inserted[0].Time, time.Now()).Output()
+	assert.Equal(t, []string{"A", "b", "C"}, Commands(updated))
+	assert.Equal(t, storage.Ids(inserted), storage.Ids(updated), "ids are kept")
+	assert.Equal(t, inserted[0].Time.Unix(), updated[0].Time.Unix(), "times are kept")
+
+	if tombstones, ok := s.(storage.TombstoneEngine); ok {
+		require.Nil(t, tombstones.Tombstone([]int64{inserted[1].Id}, time.Now()))
+		require.Nil(t, engine.Update([]*storage.Entry{{Id: inserted[1].Id, Command: "B"}}))
+		deleted, err := tombstones.Tombstones()
+		require.Nil(t, err)
+		assert.Equal(t, []string{"B"}, Commands(deleted), "tombstones can be updated")
+	}
+}
+
+// tags lists the Tags of entries.
+func tags(entries []*storage.Entry) [][]string {
+	results := make([][]string, 0, len(entries))
+	for _, e := range entries {
+		results = append(results, e.Tags)
+	}
+	return results
+}
+
+func testTags(t *testing.T, s storage.StorageStreamer) {
+	engine, ok := s.(storage.TagEngine)
+	if !ok {
+		t.Skip("engine does not implement storage.TagEngine")
+	}
+	inserted := insert(t, s, "/a", "kubectl rollout", "ls", "make deploy")
+	insert(t, s, "/b", "ls")
+
+	require.Nil(t, engine.AddTags(inserted[0].Id, []string{"prod", "deploy"}))
+	require.Nil(t, engine.AddTags(inserted[2].Id, []string{"deploy"}))
+	require.Nil(t, engine.AddTags(inserted[2].Id, []string{"deploy", storage.StarTag}))
+	assert.Equal(t, storage.ErrNotFound, engine.AddTags(inserted[2].Id+1000, []string{"deploy"}))
+
+	assert.Equal(t, [][]string{{"deploy", "prod"}, nil, {"deploy", storage.StarTag}, nil}, tags(s.LastEntries(10).Output()), "tags are sorted and kept once")
+	assert.Equal(t, []string{"kubectl rollout", "make deploy"}, Commands(s.Tag("deploy").Output()))
+	assert.Equal(t, []string{"make deploy"}, Commands(s.Tag(storage.StarTag).Output()))
+	assert.Equal(t, []string{"make deploy", "kubectl rollout"}, Commands(s.Location("/a").Tag("deploy").Desc().Output()))
+	assert.Equal(t, 0, len(s.Location("/b").Tag("deploy").Output()))
+	assert.Equal(t, 0, len(s.Tag("dep").Output()), "tags match exactly")
+	assert.Equal(t, 2, s.Tag("deploy").Count())
+
+	require.Nil(t, engine.RemoveTags(inserted[0].Id, []string{"prod", "unknown"}))
+	assert.Equal(t, 0, len(s.Tag("prod").Output()))
+	assert.Equal(t, [][]string{{"deploy"}}, tags(s.Tag("deploy").Limit(1).Output()))
+
+	if tombstones, ok := s.(storage.TombstoneEngine); ok {
+		require.Nil(t, tombstones.Tombstone([]int64{inserted[2].Id}, time.Now()))
+		assert.Equal(t, 0, len(s.Tag(storage.StarTag).Output()))
+		require.Nil(t, engine.AddTags(inserted[2].Id, []string{"kept"}), "tombstones can be tagged")
+		require.Nil(t, tombstones.Restore([]int64{inserted[2].Id}))
+		assert.Equal(t, [][]string{{"deploy", "kept", storage.StarTag}}, tags(s.Tag(storage.StarTag).Output()))
+	}
+
+	require.Nil(t, s.Delete([]int64{inserted[2].Id}))
+	assert.Equal(t, []string{"kubectl rollout"}, Commands(s.Tag("deploy").Output()))
+	assert.Equal(t, storage.ErrNotFound, engine.RemoveTags(inserted[2].Id, []string{"deploy"}))
+}
+
+func testNotes(t *testing.T, s storage.StorageStreamer) {
+	engine, ok := s.(storage.NoteEngine)
+	if !ok {
+		t.Skip("engine does not implement storage.NoteEngine")
+	}
+	inserted := insert(t, s, "/", "resolvectl flush-caches", "ls")
+
+	require.Nil(t, engine.SetNote(inserted[0].Id, "this fixed the DNS issue"))
+	assert.Equal(t, storage.ErrNotFound, engine.SetNote(inserted[1].Id+1000, "unknown"))
+	entries := s.LastEntries(10).Output()
+	assert.Equal(t, "this fixed the DNS issue", entries[0].Note)
+	assert.Equal(t, "", entries[1].Note)
+	assert.Equal(t, "this fixed the DNS issue", s.Location("/").Desc().Limit(5).Output()[1].Note)
+
+	require.Nil(t, engine.SetNote(inserted[0].Id, "flushes the DNS cache"))
+	assert.Equal(t, "flushes the DNS cache", s.Period(*inserted[0].Time, time.Now()).Output()[0].Note, "notes are replaced")
+
+	if updater, ok := s.(storage.UpdateEngine); ok {
+		require.Nil(t, updater.Update([]*storage.Entry{{Id: inserted[1].Id, Command: "ls -l", Note: "long"}}))
+		assert.Equal(t, "long", s.LastEntries(1).Output()[0].Note, "updates replace notes")
+	}
+
+	require.Nil(t, engine.SetNote(inserted[0].Id, ""))
+	assert.Equal(t, "", s.LastEntries(10).Output()[0].Note, "an empty note removes it")
+}
+
+func testTombstoneNotes(t *testing.T, s storage.StorageStreamer) {
+	engine, ok := s.(storage.NoteEngine)
+	if !ok {
+		t.Skip("engine does not implement storage.NoteEngine")
+	}
+	tombstones, ok := s.(storage.TombstoneEngine)
+	if !ok {
+		t.Skip("engine does not implement storage.TombstoneEngine")
+	}
+	inserted := insert(t, s, "/", "resolvectl flush-caches", "ls")
+
+	require.Nil(t, tombstones.Tombstone([]int64{inserted[0].Id}, time.Now()))
+	require.Nil(t, engine.SetNote(inserted[0].Id, "forgotten"), "tombstones can be annotated")
+	deleted, err := tombstones.Tombstones()
+	require.Nil(t, err)
+	require.Equal(t, 1, len(deleted))
+	assert.Equal(t, "forgotten", deleted[0].Note)
+
+	require.Nil(t, tombstones.Restore([]int64{inserted[0].Id}))
+	assert.Equal(t, "forgotten", s.LastEntries(10).Output()[0].Note, "restored entries keep their note")
+	assert.Equal(t, "forgotten", s.Location("/").Output()[0].Note)
+
+	require.Nil(t, s.Delete([]int64{inserted[1].Id}))
+	assert.Equal(t, storage.ErrNotFound, engine.SetNote(inserted[1].Id, "gone"), "deleted entries can't be annotated")
+}
+
+func testConcurrency(t *testing.T, s storage.StorageStreamer) {
+	const writers, inserts = 8, 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			mod := storage.NewStorageModule(s, storage.SetLocationGetter(NewLocation(fmt.Sprintf("/%d", w))))
+			for i := 0; i < inserts; i++ {
+				_, err := mod.Insert(fmt.Sprintf("echo %d %d", w, i))
+				assert.Nil(t, err)
+				s.LastEntries(5).Output()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	entries := s.LastEntries(writers * inserts * 2).Output()
+	assert.Equal(t, writers*inserts, len(entries))
+	seen := make(map[int64]bool, len(entries))
+	for _, e := range entries {
+		assert.False(t, seen[e.Id], "id %d is unique", e.Id)
+		seen[e.Id] = true
+	}
+	for w := 0; w < writers; w++ {
+		assert.Equal(t, inserts, len(s.Location(fmt.Sprintf("/%d", w)).Output()))
+	}
+}
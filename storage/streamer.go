@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"math"
 	"time"
 )
 
@@ -11,9 +12,49 @@ type ResultStreamer interface {
 	Period(start time.Time, end time.Time) ResultStreamer
 	Location(location string) ResultStreamer
 	Filter(filter FilterType) ResultStreamer
+	// Tag keeps the results tagged with name, see TagEngine.
+	Tag(name string) ResultStreamer
+	// Dedup collapses entries with the same command, see DedupMode.
+	Dedup(mode DedupMode) ResultStreamer
+	// Asc orders the results oldest first, which they are unless Desc reversed them.
+	Asc() ResultStreamer
+	// Desc orders the results newest first, later steps keep that order.
+	Desc() ResultStreamer
+	// Limit keeps the first n results in their order.
+	Limit(n int) ResultStreamer
+	// Offset skips the first n results in their order.
+	Offset(n int) ResultStreamer
+	// After keeps the results that come after the entry with id in their order, for
+	// paging by the last entry of the previous page instead of an ever larger Offset.
+	After(id int64) ResultStreamer
+	// Count is the number of results, without loading them where the engine can.
+	Count() int
+	// CountBy counts the results per command, location or day, see Grouping.
+	CountBy(group Grouping) []Counted
 	Output() []*Entry
 }
 
+// Err reports why results are incomplete, e.g. because a history file could not be
+// decoded. The results of engines whose reads can fail have an Err method, valid after
+// Output, and results without one are always complete.
+func Err(r ResultStreamer) error {
+	if incomplete, ok := r.(interface{ Err() error }); ok {
+		return incomplete.Err()
+	}
+	return nil
+}
+
+// ReadAll lists every live entry of r, oldest first. Unlike Output it fails when they
+// could not all be read, for callers that act on entries being absent.
+func ReadAll(r ResultStreamer) ([]*Entry, error) {
+	results := r.LastEntries(math.MaxInt32)
+	entries := results.Output()
+	if err := Err(results); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
 // type inMemoryStreamer struct {
 // 	entries []*Entry
 // }
@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SuggestHalfLife is the age at which a single run of a command counts for half as much.
+const SuggestHalfLife = 7 * 24 * time.Hour
+
+// Suggestion is a distinct command ranked by how often and how recently it was run.
+type Suggestion struct {
+	Command string
+	Count   int
+	Last    *time.Time
+	Score   float64
+}
+
+// UnderLocation matches entries run in root or any directory below it.
+func UnderLocation(root string) FilterType {
+	root = filepath.Clean(root)
+	return func(i int, e *Entry) bool {
+		location := filepath.Clean(string(e.Location))
+		if location == root {
+			return true
+		}
+		return strings.HasPrefix(location, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+	}
+}
+
+// Suggest deduplicates entries by command and ranks them by frecency: every run adds a
+// weight that halves every SuggestHalfLife. Only commands starting with prefix are kept.
+func Suggest(entries []*Entry, prefix string, now time.Time) []*Suggestion {
+	byCommand := make(map[string]*Suggestion)
+	for _, e := range entries {
+		command := strings.TrimSpace(e.Command)
+		if command == "" || !strings.HasPrefix(command, prefix) {
+			continue
+		}
+		s, ok := byCommand[command]
+		if !ok {
+			s = &Suggestion{Command: command}
+			byCommand[command] = s
+		}
+		s.Count++
+		weight := 1.0
+		if e.Time != nil {
+			age := now.Sub(*e.Time)
+			if age < 0 {
+				age = 0
+			}
+			weight = math.Pow(0.5, float64(age)/float64(SuggestHalfLife))
+			if s.Last == nil || e.Time.After(*s.Last) {
+				s.Last = e.Time
+			}
+		}
+		s.Score += weight
+	}
+
+	results := make([]*Suggestion, 0, len(byCommand))
+	for _, s := range byCommand {
+		results = append(results, s)
+	}
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Last != nil && b.Last != nil && !a.Last.Equal(*b.Last) {
+			return a.Last.After(*b.Last)
+		}
+		return a.Command < b.Command
+	})
+	return results
+}
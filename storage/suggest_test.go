@@ -0,0 +1,48 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSuggest(t *testing.T) {
+	now := time.Now()
+	at := func(ago time.Duration) *time.Time {
+		t := now.Add(-ago)
+		return &t
+	}
+	entries := []*Entry{
+		{Id: 1, Time: at(30 * 24 * time.Hour), Command: "make build"},
+		{Id: 2, Time: at(30 * 24 * time.Hour), Command: "make build"},
+		{Id: 3, Time: at(30 * 24 * time.Hour), Command: "make build"},
+		{Id: 4, Time: at(time.Hour), Command: "go test ./..."},
+		{Id: 5, Time: at(2 * time.Hour), Command: "go test ./..."},
+		{Id: 6, Time: at(time.Minute), Command: "git status"},
+		{Id: 7, Time: at(time.Minute), Command: "  "},
+	}
+
+	suggestions := Suggest(entries, "", now)
+	assert.Equal(t, 3, len(suggestions))
+	assert.Equal(t, "go test ./...", suggestions[0].Command)
+	assert.Equal(t, 2, suggestions[0].Count)
+	assert.Equal(t, "git status", suggestions[1].Command)
+	assert.Equal(t, "make build", suggestions[2].Command)
+	assert.Equal(t, 3, suggestions[2].Count)
+
+	suggestions = Suggest(entries, "g", now)
+	assert.Equal(t, 2, len(suggestions))
+	for _, s := range suggestions {
+		assert.NotEqual(t, "make build", s.Command)
+	}
+}
+
+func TestUnderLocation(t *testing.T) {
+	under := UnderLocation("/home/me/src")
+	assert.True(t, under(0, &Entry{Location: "/home/me/src"}))
+	assert.True(t, under(0, &Entry{Location: "/home/me/src/pkg"}))
+	assert.False(t, under(0, &Entry{Location: "/home/me/srcfoo"}))
+	assert.False(t, under(0, &Entry{Location: "/home/me"}))
+	assert.True(t, UnderLocation("/")(0, &Entry{Location: "/tmp"}))
+}
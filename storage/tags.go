@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// StarTag is the tag of starred entries, the commands worth keeping at hand.
+const StarTag = "starred"
+
+// TagEngine is implemented by engines that can tag stored entries, e.g. to bookmark
+// them. Tombstones can be tagged too. Both fail with ErrNotFound for unknown ids.
+type TagEngine interface {
+	// AddTags tags the entry with id, tags it already has are kept once.
+	AddTags(id int64, tags []string) error
+	// RemoveTags takes tags off the entry with id, tags it doesn't have are ignored.
+	RemoveTags(id int64, tags []string) error
+}
+
+var ErrNoTags = errors.New("engine does not support tagging entries")
+
+// CheckTags verifies that tags can be stored: words without whitespace.
+func CheckTags(tags []string) error {
+	for _, tag := range tags {
+		if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("invalid tag %q, tags are words without spaces", tag)
+		}
+	}
+	return nil
+}
+
+// MergeTags returns the sorted tags that are in tags or add, each once.
+func MergeTags(tags, add []string) []string {
+	set := make(map[string]bool, len(tags)+len(add))
+	for _, tag := range append(append([]string{}, tags...), add...) {
+		set[tag] = true
+	}
+	results := make([]string, 0, len(set))
+	for tag := range set {
+		results = append(results, tag)
+	}
+	sort.Strings(results)
+	return results
+}
+
+// DropTags returns the sorted tags that are in tags but not in drop.
+func DropTags(tags, drop []string) []string {
+	dropped := make(map[string]bool, len(drop))
+	for _, tag := range drop {
+		dropped[tag] = true
+	}
+	results := make([]string, 0, len(tags))
+	for _, tag := range MergeTags(tags, nil) {
+		if !dropped[tag] {
+			results = append(results, tag)
+		}
+	}
+	return results
+}
+
+// Tagged matches the entries that have the tag name.
+func Tagged(name string) FilterType {
+	return func(i int, e *Entry) bool {
+		for _, tag := range e.Tags {
+			if tag == name {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Tag adds tags to the entry with id, if the engine supports it.
+func (d *DatabaseModule) Tag(id int64, tags ...string) error {
+	engine, ok := d.Storage.(TagEngine)
+	if !ok {
+		return ErrNoTags
+	}
+	if err := CheckTags(tags); err != nil {
+		return err
+	}
+	return engine.AddTags(id, tags)
+}
+
+// Untag takes tags off the entry with id, if the engine supports it.
+func (d *DatabaseModule) Untag(id int64, tags ...string) error {
+	engine, ok := d.Storage.(TagEngine)
+	if !ok {
+		return ErrNoTags
+	}
+	return engine.RemoveTags(id, tags)
+}
@@ -0,0 +1,21 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTags(t *testing.T) {
+	assert.Nil(t, CheckTags([]string{"deploy", "prod-eu", StarTag}))
+	assert.EqualError(t, CheckTags([]string{"deploy", "two words"}), `invalid tag "two words", tags are words without spaces`)
+	assert.Error(t, CheckTags([]string{""}))
+
+	assert.Equal(t, []string{"a", "b", "c"}, MergeTags([]string{"c", "a"}, []string{"b", "a"}))
+	assert.Equal(t, []string{}, MergeTags(nil, nil))
+	assert.Equal(t, []string{"a", "c"}, DropTags([]string{"c", "b", "a"}, []string{"b", "d"}))
+	assert.Equal(t, []string{}, DropTags([]string{"a"}, []string{"a"}))
+
+	assert.True(t, Tagged("b")(0, &Entry{Tags: []string{"a", "b"}}))
+	assert.False(t, Tagged("b")(0, &Entry{}))
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// agoPattern is a duration like 2d or 1w3d12h, agoPart one of its parts.
+var (
+	agoPattern = regexp.MustCompile(`^(\d+[wdhms])+$`)
+	agoPart    = regexp.MustCompile(`(\d+)([wdhms])`)
+	// agoPhrase is a duration like "3 days ago".
+	agoPhrase = regexp.MustCompile(`^(\d+) (week|day|hour|minute|second)s? ago$`)
+)
+
+var agoUnits = map[string]time.Duration{
+	"w":      7 * 24 * time.Hour,
+	"d":      24 * time.Hour,
+	"h":      time.Hour,
+	"m":      time.Minute,
+	"s":      time.Second,
+	"week":   7 * 24 * time.Hour,
+	"day":    24 * time.Hour,
+	"hour":   time.Hour,
+	"minute": time.Minute,
+	"second": time.Second,
+}
+
+// instantLayouts are the local times accepted besides RFC 3339.
+var instantLayouts = []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02T15:04:05", "2006-01-02T15:04"}
+
+var weekdays = map[string]time.Weekday{}
+
+func init() {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		weekdays[strings.ToLower(day.String())] = day
+	}
+}
+
+// ParseTimeRange reads when something happened, relative to now and in now's time zone,
+// and returns the first and the last instant it covers. Durations (2h, 3d, 1w2d, "3 days
+// ago"), times and RFC 3339 times name an instant, so start and end are equal. Dates
+// (2006-01-02) and phrases name whole days, weeks, months or years: today, yesterday,
+// monday, last monday (the most recent one before today), this monday, this week, last
+// week, this month, last month, this year and last year. Weeks start on Monday.
+func ParseTimeRange(value string, now time.Time) (start, end time.Time, err error) {
+	raw := strings.TrimSpace(value)
+	value = strings.Join(strings.Fields(strings.ToLower(value)), " ")
+	if value == "now" {
+		return now, now, nil
+	}
+	if agoPattern.MatchString(value) {
+		var ago time.Duration
+		for _, part := range agoPart.FindAllStringSubmatch(value, -1) {
+			n, err := strconv.Atoi(part[1])
+			if err != nil {
+				return start, end, err
+			}
+			ago += time.Duration(n) * agoUnits[part[2]]
+		}
+		return now.Add(-ago), now.Add(-ago), nil
+	}
+	if match := agoPhrase.FindStringSubmatch(value); match != nil {
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return start, end, err
+		}
+		at := now.Add(-time.Duration(n) * agoUnits[match[2]])
+		return at, at, nil
+	}
+	if t, err := time.ParseInLocation(DayLayout, raw, now.Location()); err == nil {
+		return t, t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	for _, layout := range instantLayouts {
+		if t, err := time.ParseInLocation(layout, raw, now.Location()); err == nil {
+			return t, t, nil
+		}
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t, t, nil
+	}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	// Days since Monday, Sunday is the last day of the week.
+	monday := today.AddDate(0, 0, -(int(today.Weekday())+6)%7)
+	days := func(from time.Time, n int) (time.Time, time.Time, error) {
+		return from, from.AddDate(0, 0, n).Add(-time.Nanosecond), nil
+	}
+	switch value {
+	case "today":
+		return days(today, 1)
+	case "yesterday":
+		return days(today.AddDate(0, 0, -1), 1)
+	case "this week":
+		return days(monday, 7)
+	case "last week":
+		return days(monday.AddDate(0, 0, -7), 7)
+	case "this month":
+		first := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+		return first, first.AddDate(0, 1, 0).Add(-time.Nanosecond), nil
+	case "last month":
+		first := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, now.Location())
+		return first, first.AddDate(0, 1, 0).Add(-time.Nanosecond), nil
+	case "this year":
+		first := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, now.Location())
+		return first, first.AddDate(1, 0, 0).Add(-time.Nanosecond), nil
+	case "last year":
+		first := time.Date(now.Year()-1, time.January, 1, 0, 0, 0, 0, now.Location())
+		return first, first.AddDate(1, 0, 0).Add(-time.Nanosecond), nil
+	}
+
+	name, this := strings.TrimPrefix(value, "last "), strings.HasPrefix(value, "this ")
+	if this {
+		name = strings.TrimPrefix(value, "this ")
+	}
+	if day, ok := weekdays[name]; ok {
+		if this {
+			return days(monday.AddDate(0, 0, (int(day)+6)%7), 1)
+		}
+		back := (int(today.Weekday()) - int(day) + 7) % 7
+		if back == 0 {
+			back = 7
+		}
+		return days(today.AddDate(0, 0, -back), 1)
+	}
+	return start, end, fmt.Errorf("can't tell when %q is", raw)
+}
+
+// ParseSince is the first instant of ParseTimeRange.
+func ParseSince(value string, now time.Time) (time.Time, error) {
+	start, _, err := ParseTimeRange(value, now)
+	return start, err
+}
+
+// ParseUntil is the last instant of ParseTimeRange.
+func ParseUntil(value string, now time.Time) (time.Time, error) {
+	_, end, err := ParseTimeRange(value, now)
+	return end, err
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTimeRange(t *testing.T) {
+	zone, err := time.LoadLocation("Europe/Amsterdam")
+	require.Nil(t, err)
+	// Wednesday, the day summer time started.
+	now := time.Date(2021, time.March, 31, 15, 30, 0, 0, zone)
+	day := func(month time.Month, d int) time.Time {
+		return time.Date(2021, month, d, 0, 0, 0, 0, zone)
+	}
+	last := func(t time.Time) time.Time { return t.Add(-time.Nanosecond) }
+
+	for value, expected := range map[string][2]time.Time{
+		"now":                  {now, now},
+		"2h":                   {now.Add(-2 * time.Hour), now.Add(-2 * time.Hour)},
+		"1w2d3h":               {now.Add(-219 * time.Hour), now.Add(-219 * time.Hour)},
+		"3 days ago":           {now.Add(-72 * time.Hour), now.Add(-72 * time.Hour)},
+		"1 hour ago":           {now.Add(-time.Hour), now.Add(-time.Hour)},
+		"2021-03-28":           {day(time.March, 28), last(day(time.March, 29))},
+		"2021-03-28 10:15":     {time.Date(2021, time.March, 28, 10, 15, 0, 0, zone), time.Date(2021, time.March, 28, 10, 15, 0, 0, zone)},
+		"2021-03-28T10:15:30":  {time.Date(2021, time.March, 28, 10, 15, 30, 0, zone), time.Date(2021, time.March, 28, 10, 15, 30, 0, zone)},
+		"2021-03-28T10:15:00Z": {time.Date(2021, time.March, 28, 10, 15, 0, 0, time.UTC), time.Date(2021, time.March, 28, 10, 15, 0, 0, time.UTC)},
+		"today":                {day(time.March, 31), last(day(time.April, 1))},
+		" Yesterday ":          {day(time.March, 30), last(day(time.March, 31))},
+		"monday":               {day(time.March, 29), last(day(time.March, 30))},
+		"last monday":          {day(time.March, 29), last(day(time.March, 30))},
+		"last wednesday":       {day(time.March, 24), last(day(time.March, 25))},
+		"last sunday":          {day(time.March, 28), last(day(time.March, 29))},
+		"this friday":          {day(time.April, 2), last(day(time.April, 3))},
+		"this sunday":          {day(time.April, 4), last(day(time.April, 5))},
+		"this week":            {day(time.March, 29), last(day(time.April, 5))},
+		"last  week":           {day(time.March, 22), last(day(time.March, 29))},
+		"this month":           {day(time.March, 1), last(day(time.April, 1))},
+		"last month":           {day(time.February, 1), last(day(time.March, 1))},
+		"this year":            {day(time.January, 1), last(time.Date(2022, time.January, 1, 0, 0, 0, 0, zone))},
+		"last year":            {time.Date(2020, time.January, 1, 0, 0, 0, 0, zone), last(day(time.January, 1))},
+	} {
+		start, end, err := ParseTimeRange(value, now)
+		require.Nil(t, err, value)
+		assert.True(t, expected[0].Equal(start), "%q starts at %v, not %v", value, start, expected[0])
+		assert.True(t, expected[1].Equal(end), "%q ends at %v, not %v", value, end, expected[1])
+	}
+
+	// The day summer time started has 23 hours.
+	start, end, err := ParseTimeRange("2021-03-28", now)
+	require.Nil(t, err)
+	assert.Equal(t, 23*time.Hour, end.Sub(start)+time.Nanosecond)
+
+	for _, value := range []string{"", "soon", "5y", "last", "last fortnight", "2021-02-30", "3 days"} {
+		_, _, err := ParseTimeRange(value, now)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestParseSinceUntil(t *testing.T) {
+	now := time.Date(2021, time.March, 31, 15, 30, 0, 0, time.UTC)
+	since, err := ParseSince("yesterday", now)
+	require.Nil(t, err)
+	until, err := ParseUntil("yesterday", now)
+	require.Nil(t, err)
+	assert.Equal(t, time.Date(2021, time.March, 30, 0, 0, 0, 0, time.UTC), since)
+	assert.Equal(t, time.Date(2021, time.March, 30, 23, 59, 59, 999999999, time.UTC), until)
+
+	_, err = ParseUntil("whenever", now)
+	assert.Error(t, err)
+}